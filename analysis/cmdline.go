@@ -2,6 +2,8 @@ package analysis
 
 import (
 	"bufio"
+	. "cryptocurrency/node_util"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -12,6 +14,7 @@ import (
 var analysisCommands = map[string]func([]string){
 	"GetTPS":          GetTPSCmd,
 	"GetTokensMinted": GetTokensMintedCmd,
+	"Simulate":        SimulateCmd,
 }
 
 func GetTPSCmd(fields []string) {
@@ -29,6 +32,97 @@ func GetTokensMintedCmd([]string) {
 	fmt.Println(tokensMinted)
 }
 
+// SimulateCmd runs a simulation, with options given as key=value fields:
+// miners (comma separated hashrates in DPM), duration (e.g. 24h), upgrades (comma separated name:height pairs, for
+// upgrades to simulate at other heights than the network's), transactions (per block, 1 by default), seed, format
+// (csv or json, csv by default), report (blocks or miners, for CSV) and out (a file to write to instead of stdout).
+func SimulateCmd(fields []string) {
+	config, options, err := parseSimulateFields(fields[1:])
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	result, err := Simulate(config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	out := os.Stdout
+	if options["out"] != "" {
+		out, err = os.Create(options["out"])
+		if err != nil {
+			panic(err)
+		}
+		defer out.Close()
+	}
+	switch options["format"] {
+	case "", "csv":
+		err = WriteSimulationCSV(out, result, options["report"] == "miners")
+	case "json":
+		err = WriteSimulationJSON(out, result)
+	default:
+		fmt.Println("Invalid format " + options["format"])
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func parseSimulateFields(fields []string) (SimulationConfig, map[string]string, error) {
+	config := SimulationConfig{Transactions: 1, Seed: 1}
+	options := map[string]string{}
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return config, nil, fmt.Errorf("invalid option %q", field)
+		}
+		var err error
+		switch key {
+		case "miners":
+			for _, hashrate := range strings.Split(value, ",") {
+				dpm, err := strconv.ParseFloat(hashrate, 64)
+				if err != nil {
+					return config, nil, fmt.Errorf("invalid hashrate %q", hashrate)
+				}
+				config.Hashrates = append(config.Hashrates, dpm)
+			}
+		case "duration":
+			config.Duration, err = time.ParseDuration(value)
+		case "upgrades":
+			config.Upgrades = NetworkUpgrades{}
+			for name, height := range Env.Upgrades {
+				config.Upgrades[name] = height
+			}
+			for _, upgrade := range strings.Split(value, ",") {
+				name, height, ok := strings.Cut(upgrade, ":")
+				if _, known := LookupUpgrade(UpgradeName(name)); !ok || !known {
+					return config, nil, fmt.Errorf("invalid upgrade %q", upgrade)
+				}
+				config.Upgrades[UpgradeName(name)], err = strconv.Atoi(height)
+				if err != nil {
+					return config, nil, fmt.Errorf("invalid upgrade height %q", upgrade)
+				}
+			}
+		case "transactions":
+			config.Transactions, err = strconv.Atoi(value)
+		case "seed":
+			config.Seed, err = strconv.ParseInt(value, 10, 64)
+		case "format", "report", "out":
+			options[key] = value
+		default:
+			return config, nil, fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return config, nil, fmt.Errorf("invalid %s %q", key, value)
+		}
+	}
+	if config.Duration <= 0 {
+		return config, nil, errors.New("a duration is required")
+	}
+	return config, options, nil
+}
+
 func RunAnalysisCmd(input string) {
 	cmds := strings.Split(input, ";")
 	for _, cmd := range cmds {
@@ -0,0 +1,208 @@
+package analysis
+
+import (
+	. "cryptocurrency/node_util"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Overview
+// Simulate replays the node's own GetDifficulty and CalculateBlockReward for a set of virtual miners, so changes to
+// the difficulty adjustment or the block reward can be evaluated before they are proposed.
+// Each miner has a hashrate in difficulty points per minute (DPM), and mines its own block on top of the current tip
+// with the difficulty GetDifficulty gives it. A block of difficulty D takes a miner with hashrate H a random time with
+// a mean of D/H minutes, so the miner that finishes first wins the block, and every miner starts again on top of it.
+// The random times come from a seeded generator, so a simulation with the same config always gives the same result.
+
+// SimulationConfig describes a simulation.
+type SimulationConfig struct {
+	Hashrates    []float64       // Hashrate of each miner, in DPM
+	Duration     time.Duration   // Simulated time to mine blocks for
+	Upgrades     NetworkUpgrades // Upgrade heights to simulate, or nil to use the current network's
+	Transactions int             // Transactions in each block
+	Seed         int64
+}
+
+// SimulatedBlock is a block mined during a simulation.
+type SimulatedBlock struct {
+	Height     int     `json:"height"`
+	Time       float64 `json:"time"` // Seconds since the start of the simulation
+	Miner      int     `json:"miner"`
+	Difficulty uint64  `json:"difficulty"`
+	BlockTime  float64 `json:"blockTime"` // Seconds
+	Reward     float64 `json:"reward"`
+	Emission   float64 `json:"emission"` // Total block rewards up to and including this block
+}
+
+// MinerSummary is what a miner did during a simulation.
+type MinerSummary struct {
+	Miner          int     `json:"miner"`
+	Hashrate       float64 `json:"hashrate"`
+	Blocks         int     `json:"blocks"`
+	MeanBlockTime  float64 `json:"meanBlockTime"` // Seconds
+	LastDifficulty uint64  `json:"lastDifficulty"`
+	Rewards        float64 `json:"rewards"` // Without the rewards for the first BlocksBeforeReward blocks, as the ledger counts them
+}
+
+type SimulationResult struct {
+	Blocks        []SimulatedBlock `json:"blocks"`
+	Miners        []MinerSummary   `json:"miners"`
+	TotalEmission float64          `json:"totalEmission"`
+}
+
+// simulatedMiner is the state GetDifficulty needs for a miner: its last mined block.
+type simulatedMiner struct {
+	lastDifficulty uint64
+	lastTime       time.Duration
+	difficulty     uint64
+	finish         time.Duration // When the miner will finish the block it is mining
+	blockTimes     time.Duration
+	rewards        float64
+}
+
+// Simulate mines blocks with virtual miners for the duration of a simulation.
+func Simulate(config SimulationConfig) (SimulationResult, error) {
+	if len(config.Hashrates) == 0 {
+		return SimulationResult{}, errors.New("no miners to simulate")
+	}
+	for _, hashrate := range config.Hashrates {
+		if hashrate <= 0 {
+			return SimulationResult{}, fmt.Errorf("invalid hashrate %v", hashrate)
+		}
+	}
+	if config.Transactions < 1 {
+		// The difficulty is divided by the number of transactions after the Qingdao upgrade
+		return SimulationResult{}, errors.New("blocks must have at least one transaction")
+	}
+	if config.Upgrades != nil {
+		upgrades := Env.Upgrades
+		defer func() {
+			Env.Upgrades = upgrades
+		}()
+		Env.Upgrades = config.Upgrades
+	}
+	random := rand.New(rand.NewSource(config.Seed))
+	miners := make([]simulatedMiner, len(config.Hashrates))
+	for i := range miners {
+		miners[i].lastDifficulty = InitialBlockDifficulty
+		miners[i].lastTime = time.Minute
+	}
+	var result SimulationResult
+	var now time.Duration
+	minedBlocks := make([]int, len(miners))
+	minerCount := int64(0)
+	for height := 1; ; height++ {
+		// Every miner starts a block on top of the tip
+		winner := 0
+		for i := range miners {
+			miners[i].difficulty = GetDifficulty(miners[i].lastTime, miners[i].lastDifficulty, config.Transactions, height)
+			minutes := random.ExpFloat64() * float64(miners[i].difficulty) / config.Hashrates[i]
+			miningTime := time.Duration(minutes * float64(time.Minute))
+			if miningTime < time.Second {
+				// GetDifficulty divides by the whole number of seconds the last block took
+				miningTime = time.Second
+			}
+			miners[i].finish = now + miningTime
+			if miners[i].finish < miners[winner].finish {
+				winner = i
+			}
+		}
+		miner := &miners[winner]
+		if miner.finish > config.Duration {
+			break
+		}
+		miningTime := miner.finish - now
+		now = miner.finish
+		if minedBlocks[winner] == 0 {
+			minerCount++
+		}
+		minedBlocks[winner]++
+		reward := CalculateBlockReward(minerCount, height)
+		miner.lastDifficulty, miner.lastTime = miner.difficulty, miningTime
+		miner.blockTimes += miningTime
+		miner.rewards += reward
+		result.TotalEmission += reward
+		result.Blocks = append(result.Blocks, SimulatedBlock{
+			Height:     height,
+			Time:       now.Seconds(),
+			Miner:      winner,
+			Difficulty: miner.difficulty,
+			BlockTime:  miningTime.Seconds(),
+			Reward:     reward,
+			Emission:   result.TotalEmission,
+		})
+	}
+	for i, miner := range miners {
+		summary := MinerSummary{
+			Miner:          i,
+			Hashrate:       config.Hashrates[i],
+			Blocks:         minedBlocks[i],
+			LastDifficulty: miner.lastDifficulty,
+			Rewards:        miner.rewards,
+		}
+		if minedBlocks[i] > 0 {
+			summary.MeanBlockTime = miner.blockTimes.Seconds() / float64(minedBlocks[i])
+		}
+		if len(result.Blocks) > 50 {
+			// The ledger doesn't pay the first BlocksBeforeReward blocks a miner mines once fees start
+			summary.Rewards = 0
+			if minedBlocks[i] > BlocksBeforeReward {
+				summary.Rewards = miner.rewards - float64(BlocksBeforeReward)
+			}
+		}
+		result.Miners = append(result.Miners, summary)
+	}
+	return result, nil
+}
+
+// WriteSimulationJSON writes a simulation's blocks, miners and total emission as JSON.
+func WriteSimulationJSON(w io.Writer, result SimulationResult) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// WriteSimulationCSV writes a simulation's blocks, or its miners if minerSummary is set, as CSV.
+func WriteSimulationCSV(w io.Writer, result SimulationResult, minerSummary bool) error {
+	writer := csv.NewWriter(w)
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	var rows [][]string
+	if minerSummary {
+		rows = append(rows, []string{"miner", "hashrate", "blocks", "mean_block_time", "last_difficulty", "rewards"})
+		for _, miner := range result.Miners {
+			rows = append(rows, []string{
+				strconv.Itoa(miner.Miner),
+				formatFloat(miner.Hashrate),
+				strconv.Itoa(miner.Blocks),
+				formatFloat(miner.MeanBlockTime),
+				strconv.FormatUint(miner.LastDifficulty, 10),
+				formatFloat(miner.Rewards),
+			})
+		}
+	} else {
+		rows = append(rows, []string{"height", "time", "miner", "difficulty", "block_time", "reward", "emission"})
+		for _, block := range result.Blocks {
+			rows = append(rows, []string{
+				strconv.Itoa(block.Height),
+				formatFloat(block.Time),
+				strconv.Itoa(block.Miner),
+				strconv.FormatUint(block.Difficulty, 10),
+				formatFloat(block.BlockTime),
+				formatFloat(block.Reward),
+				formatFloat(block.Emission),
+			})
+		}
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
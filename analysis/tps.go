@@ -9,7 +9,7 @@ func GetTPS(duration time.Duration) float64 {
 	now := time.Now()
 	txCount := 0
 	for i := len(Blockchain) - 1; i >= 0; i-- {
-		block := Blockchain[i]
+		block := BlockAt(i)
 		if now.Sub(block.Timestamp) > duration {
 			break
 		}
@@ -0,0 +1,113 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistentFiles(t *testing.T) {
+	inTempDir := func(t *testing.T) func() {
+		wd, err := os.Getwd()
+		assert.Nil(t, err)
+		assert.Nil(t, os.Chdir(t.TempDir()))
+		return func() {
+			_ = os.Chdir(wd)
+		}
+	}
+	t.Run("It replaces a file without leaving a temporary file behind", func(t *testing.T) {
+		// Arrange
+		defer inTempDir(t)()
+		assert.Nil(t, os.WriteFile("peers.txt", []byte("http://127.0.0.1:1567\n"), 0600))
+		// Act
+		err := WriteFileAtomic("peers.txt", []byte("http://127.0.0.1:8080\n"), 0600)
+		// Assert
+		assert.Nil(t, err)
+		contents, err := os.ReadFile("peers.txt")
+		assert.Nil(t, err)
+		assert.Equal(t, "http://127.0.0.1:8080\n", string(contents))
+		_, err = os.Stat("peers.txt.tmp")
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("It recovers a complete write that was never renamed", func(t *testing.T) {
+		// Arrange
+		defer inTempDir(t)()
+		assert.Nil(t, os.WriteFile("peers.txt.tmp", []byte("http://127.0.0.1:8080\n"), 0600))
+		// Act
+		RecoverPersistentFiles()
+		// Assert
+		assert.Equal(t, []string{"http://127.0.0.1:8080"}, GetPeers())
+		_, err := os.Stat("peers.txt.tmp")
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("It drops a half-written peer", func(t *testing.T) {
+		// Arrange
+		defer inTempDir(t)()
+		assert.Nil(t, os.WriteFile("peers.txt", []byte("http://127.0.0.1:1567\nhttp:"), 0600))
+		// Act
+		RecoverPersistentFiles()
+		AddPeer("http://127.0.0.1:8080")
+		// Assert
+		assert.Equal(t, []string{"http://127.0.0.1:1567", "http://127.0.0.1:8080"}, GetPeers())
+	})
+	t.Run("It cuts a half-written record off the mempool journal", func(t *testing.T) {
+		// Arrange
+		defer inTempDir(t)()
+		journal, err := OpenMempoolJournal(MempoolJournalFile)
+		assert.Nil(t, err)
+		assert.Nil(t, journal.Append(Transaction{Amount: 1}))
+		complete, err := os.ReadFile(MempoolJournalFile)
+		assert.Nil(t, err)
+		assert.Nil(t, journal.Append(Transaction{Amount: 2}))
+		assert.Nil(t, journal.Close())
+		data, err := os.ReadFile(MempoolJournalFile)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(MempoolJournalFile, data[:len(data)-5], 0600))
+		// Act
+		RecoverPersistentFiles()
+		// Assert
+		contents, err := os.ReadFile(MempoolJournalFile)
+		assert.Nil(t, err)
+		assert.Equal(t, complete, contents)
+	})
+	t.Run("It recovers a rewrite of the mempool journal that was never renamed", func(t *testing.T) {
+		// Arrange
+		defer inTempDir(t)()
+		journal, err := OpenMempoolJournal(MempoolJournalFile + ".tmp")
+		assert.Nil(t, err)
+		assert.Nil(t, journal.Append(Transaction{Amount: 1}))
+		assert.Nil(t, journal.Close())
+		// Act
+		RecoverPersistentFiles()
+		// Assert
+		transactions, err := ReadMempoolJournal(MempoolJournalFile)
+		assert.Nil(t, err)
+		assert.Len(t, transactions, 1)
+		_, err = os.Stat(MempoolJournalFile + ".tmp")
+		assert.True(t, os.IsNotExist(err))
+	})
+	t.Run("It moves a truncated key aside instead of deleting it", func(t *testing.T) {
+		// Arrange
+		defer inTempDir(t)()
+		truncatedKey := []byte(`"{'Y':[1,2,3]}-'AQID`)
+		assert.Nil(t, os.WriteFile("key.json", truncatedKey, 0600))
+		// Act
+		RecoverPersistentFiles()
+		// Assert
+		_, err := os.Stat("key.json")
+		assert.True(t, os.IsNotExist(err))
+		contents, err := os.ReadFile("key.json.corrupt")
+		assert.Nil(t, err)
+		assert.Equal(t, truncatedKey, contents)
+	})
+}
@@ -23,7 +23,7 @@ func TestHashBlock(t *testing.T) {
 			Y: []byte("123"),
 		}
 		block := Block{
-			Transactions: []Transaction{
+			LegacyTransactions: []Transaction{
 				{
 					Sender:    key,
 					Recipient: key,
@@ -0,0 +1,134 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockLimitsTestEntry creates a mempool entry with a body of the given size, and a contract that used the given gas.
+func blockLimitsTestEntry(sender string, amount float64, timestamp int64, fee float64, bodySize int, gas float64) *MempoolEntry {
+	entry := NewMempoolEntry(Transaction{
+		Sender:    PublicKey{Y: []byte(sender)},
+		Recipient: PublicKey{Y: []byte("recipient")},
+		Amount:    amount,
+		Timestamp: time.Unix(timestamp, 0),
+		Body:      make([]byte, bodySize),
+		Contracts: []Contract{{GasUsed: gas}},
+	}, nil, StateTransition{})
+	entry.Fee = fee
+	return entry
+}
+
+func TestBlockLimits(t *testing.T) {
+	maxBytes, maxGas, maxTransactions := MaxBlockBytes, MaxBlockGas, MaxBlockTransactions
+	t.Cleanup(func() {
+		Regtest = false
+		LoadEnv()
+		MaxBlockBytes, MaxBlockGas, MaxBlockTransactions = maxBytes, maxGas, maxTransactions
+		Blockchain = nil
+		Pool = NewMempool()
+	})
+	t.Run("It packs transactions up to the size limit and leaves the rest in the pool", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		large := blockLimitsTestEntry("a", 1, 1, 0.9, 1000, 0)
+		small := blockLimitsTestEntry("b", 2, 2, 0.5, 10, 0)
+		other := blockLimitsTestEntry("c", 3, 3, 0.4, 10, 0)
+		for _, entry := range []*MempoolEntry{large, small, other} {
+			assert.Nil(t, pool.Add(entry))
+		}
+		limits := BlockUsage{Bytes: small.Size + other.Size, Gas: 100, Transactions: 10}
+		// Act
+		selected := pool.Pack(limits, time.Now())
+		// Assert
+		assert.Equal(t, []float64{2, 3}, selectedAmounts(selected))
+		assert.Equal(t, 3, pool.Len())
+	})
+	t.Run("It packs transactions up to the gas and transaction limits", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		assert.Nil(t, pool.Add(blockLimitsTestEntry("a", 1, 1, 0.9, 0, 60)))
+		assert.Nil(t, pool.Add(blockLimitsTestEntry("b", 2, 2, 0.5, 0, 60)))
+		assert.Nil(t, pool.Add(blockLimitsTestEntry("c", 3, 3, 0.4, 0, 30)))
+		assert.Nil(t, pool.Add(blockLimitsTestEntry("d", 4, 4, 0.3, 0, 0)))
+		// Act
+		byGas := pool.Pack(BlockUsage{Bytes: 1000000, Gas: 100, Transactions: 10}, time.Now())
+		byCount := pool.Pack(BlockUsage{Bytes: 1000000, Gas: 1000, Transactions: 2}, time.Now())
+		// Assert
+		assert.Equal(t, []float64{1, 3, 4}, selectedAmounts(byGas))
+		assert.Equal(t, []float64{1, 2}, selectedAmounts(byCount))
+	})
+	t.Run("It keeps a sender's transactions behind one that doesn't fit", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		first := blockLimitsTestEntry("a", 1, 1, 0.9, 1000, 0)
+		second := blockLimitsTestEntry("a", 2, 2, 0.9, 10, 0)
+		other := blockLimitsTestEntry("b", 3, 3, 0.1, 10, 0)
+		for _, entry := range []*MempoolEntry{first, second, other} {
+			assert.Nil(t, pool.Add(entry))
+		}
+		// Act
+		selected := pool.Pack(BlockUsage{Bytes: second.Size + other.Size, Gas: 100, Transactions: 10}, time.Now())
+		// Assert
+		assert.Equal(t, []float64{3}, selectedAmounts(selected))
+	})
+	t.Run("It only enforces the limits from the Lagos upgrade", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Env.Upgrades[Lagos] = 5
+		MaxBlockTransactions = 1
+		transactions := []Transaction{{Amount: 1}, {Amount: 2}}
+		// Act
+		before := CheckBlockLimits(transactions, 4)
+		after := CheckBlockLimits(transactions, 5)
+		// Assert
+		assert.Nil(t, before)
+		assert.NotNil(t, after)
+		assert.Equal(t, ReasonExceedsBlockLimits, after.Code)
+	})
+	t.Run("It only limits gas before the Zen upgrade, since its proofs don't cover gas usage", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Zen] = 5
+		transactions := []Transaction{{Contracts: []Contract{{GasUsed: MaxBlockGas + 1}}}}
+		// Act
+		before := CheckBlockLimits(transactions, 4)
+		after := CheckBlockLimits(transactions, 5)
+		// Assert
+		assert.NotNil(t, before)
+		assert.Equal(t, ReasonExceedsBlockLimits, before.Code)
+		assert.Nil(t, after)
+	})
+	t.Run("It measures a block's transactions", func(t *testing.T) {
+		// Arrange
+		transactions := []Transaction{{Contracts: []Contract{{GasUsed: 2}, {GasUsed: 3}}}, {Body: []byte("body")}}
+		// Act
+		usage := MeasureTransactions(transactions)
+		// Assert
+		assert.Equal(t, 2, usage.Transactions)
+		assert.Equal(t, 5.0, usage.Gas)
+		assert.Equal(t, len(EncodeTransaction(transactions[0]))+len(EncodeTransaction(transactions[1])), usage.Bytes)
+	})
+	t.Run("It refuses transactions that can't fit in a block", func(t *testing.T) {
+		// Arrange
+		regtestChain(t)
+		MaxBlockBytes = 10
+		// Act
+		_, err := Generate(1)
+		// Assert
+		assert.NotNil(t, err)
+		assert.Equal(t, ReasonExceedsBlockLimits, AsValidationError(err).Code)
+		assert.Equal(t, 0, Pool.Len())
+	})
+}
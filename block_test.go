@@ -25,7 +25,7 @@ func TestBlock(t *testing.T) {
 		b := []byte("321")
 		// Act
 		block := Block{
-			Transactions: []Transaction{
+			LegacyTransactions: []Transaction{
 				{
 					Sender:    PublicKey{Y: a},
 					Recipient: PublicKey{Y: b},
@@ -42,9 +42,9 @@ func TestBlock(t *testing.T) {
 			TimeVerifiers:          nil,
 		}
 		// Assert
-		assert.Equal(t, a, block.Transactions[0].Sender.Y)
-		assert.Equal(t, b, block.Transactions[0].Recipient.Y)
-		assert.Equal(t, float64(2024), block.Transactions[0].Amount)
+		assert.Equal(t, a, block.LegacyTransactions[0].Sender.Y)
+		assert.Equal(t, b, block.LegacyTransactions[0].Recipient.Y)
+		assert.Equal(t, float64(2024), block.LegacyTransactions[0].Amount)
 		assert.Equal(t, int64(24), block.Nonce)
 	})
 	t.Run("It marshals and unmarshals the block correctly", func(t *testing.T) {
@@ -52,7 +52,7 @@ func TestBlock(t *testing.T) {
 		a := []byte("123")
 		b := []byte("321")
 		block := Block{
-			Transactions: []Transaction{
+			LegacyTransactions: []Transaction{
 				{
 					Sender:    PublicKey{Y: a},
 					Recipient: PublicKey{Y: b},
@@ -80,7 +80,7 @@ func TestBlock(t *testing.T) {
 		}
 		timestamp := time.Time{}
 		block.Timestamp = timestamp
-		for _, transaction := range block.Transactions {
+		for _, transaction := range block.LegacyTransactions {
 			transaction.Timestamp = timestamp
 		}
 		// Assert
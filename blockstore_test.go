@@ -0,0 +1,157 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockStore(t *testing.T) {
+	t.Run("It reads back appended blocks after being reopened", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		dir := t.TempDir()
+		store, err := OpenBlockStore(dir)
+		assert.Nil(t, err)
+		genesis := GenesisBlock()
+		block := Block{Nonce: 7, Difficulty: 1, PreviousBlockHash: HashBlock(genesis, 0)}
+		// Act
+		assert.Nil(t, store.Append(genesis, 0))
+		assert.Nil(t, store.Append(block, 1))
+		assert.Nil(t, store.Close())
+		store, err = OpenBlockStore(dir)
+		assert.Nil(t, err)
+		// Assert
+		assert.Equal(t, 2, store.Len())
+		stored, err := store.Get(1)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(7), stored.Nonce)
+		_, height, err := store.GetByHash(HashBlock(block, 1))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, height)
+	})
+	t.Run("It truncates a partially written record", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		dir := t.TempDir()
+		store, err := OpenBlockStore(dir)
+		assert.Nil(t, err)
+		assert.Nil(t, store.Append(GenesisBlock(), 0))
+		assert.Nil(t, store.Close())
+		segment, err := os.OpenFile(filepath.Join(dir, "segment_00000.dat"), os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = segment.Write([]byte{0, 0, 1, 0, 1, 2})
+		assert.Nil(t, err)
+		assert.Nil(t, segment.Close())
+		// Act
+		store, err = OpenBlockStore(dir)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, 1, store.Len())
+		assert.Nil(t, store.Append(Block{Nonce: 1}, 1))
+		stored, err := store.Get(1)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), stored.Nonce)
+	})
+	t.Run("It recovers an unindexed header under the hash of its full block", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		dir := t.TempDir()
+		store, err := OpenHeaderStore(dir, func(int) ([64]byte, bool) { return [64]byte{}, false })
+		assert.Nil(t, err)
+		block := Block{Nonce: 7, LegacyTransactions: []Transaction{{Amount: 1}}}
+		hash := HashBlock(block, 0)
+		assert.Nil(t, store.AppendWithHash(BlockHeader(block), 0, hash))
+		assert.Nil(t, store.Close())
+		// The header was written, but its index entry wasn't
+		assert.Nil(t, os.Truncate(filepath.Join(dir, "index.dat"), 0))
+		// Act
+		store, err = OpenHeaderStore(dir, func(height int) ([64]byte, bool) { return hash, height == 0 })
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, 1, store.Len())
+		recovered, _ := store.HashAt(0)
+		assert.Equal(t, hash, recovered)
+	})
+	t.Run("It removes blocks at and above the truncation height", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		store, err := OpenBlockStore(t.TempDir())
+		assert.Nil(t, err)
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, store.Append(Block{Nonce: int64(i)}, i))
+		}
+		// Act
+		assert.Nil(t, store.Truncate(1))
+		// Assert
+		assert.Equal(t, 1, store.Len())
+		_, err = store.Get(1)
+		assert.NotNil(t, err)
+	})
+	t.Run("It keeps only block headers in memory and reads blocks from the store", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		wd, err := os.Getwd()
+		assert.Nil(t, err)
+		assert.Nil(t, os.Chdir(t.TempDir()))
+		Blockchain = nil
+		defer func() {
+			_ = Store.Close()
+			_ = HeaderStore.Close()
+			Store = nil
+			HeaderStore = nil
+			Blockchain = nil
+			_ = os.Chdir(wd)
+		}()
+		LoadBlockchain()
+		transaction := Transaction{Sender: PublicKey{Y: []byte("sender")}, Recipient: PublicKey{Y: []byte("recipient")}, Amount: 1}
+		assert.Nil(t, Append(GenesisBlock()))
+		assert.Nil(t, Append(Block{Nonce: 1, PreviousBlockHash: BlockHashAt(0), LegacyTransactions: []Transaction{transaction}}))
+		hash := BlockHashAt(1)
+		// Act
+		assert.Nil(t, Store.Close())
+		assert.Nil(t, HeaderStore.Close())
+		Store = nil
+		HeaderStore = nil
+		Blockchain = nil
+		LoadBlockchain()
+		// Assert
+		assert.Equal(t, 2, len(Blockchain))
+		assert.Empty(t, ExtractTransactions(Blockchain[1]))
+		stored := ExtractTransactions(BlockAt(1))
+		assert.Equal(t, 1, len(stored))
+		assert.Equal(t, transaction.Sender, stored[0].Sender)
+		assert.Equal(t, transaction.Amount, stored[0].Amount)
+		assert.Equal(t, hash, BlockHashAt(1))
+	})
+	t.Run("It returns an error instead of appending a block it can't store", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Blockchain = nil
+		store, err := OpenBlockStore(t.TempDir())
+		assert.Nil(t, err)
+		Store = store
+		defer func() {
+			Store = nil
+			Blockchain = nil
+		}()
+		assert.Nil(t, Append(GenesisBlock()))
+		assert.Nil(t, store.Close())
+		// Act
+		err = Append(Block{Nonce: 1})
+		// Assert
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, len(Blockchain))
+	})
+}
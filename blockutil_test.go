@@ -53,6 +53,9 @@ func TestGetBalance(t *testing.T) {
 	})
 	t.Run("It returns the correct balance of a key", func(t *testing.T) {
 		// Arrange
+		LoadEnv()
+		defer LoadEnv()
+		Env.Upgrades[Kyoto] = -1 // The transaction doesn't have a nonce
 		Blockchain = nil
 		Append(GenesisBlock())
 		key := []byte("123")
@@ -63,7 +66,7 @@ func TestGetBalance(t *testing.T) {
 			Y: key,
 		}
 		Append(Block{
-			Transactions: []Transaction{
+			LegacyTransactions: []Transaction{
 				{
 					Sender:    sender,
 					Recipient: receiver,
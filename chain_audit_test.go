@@ -0,0 +1,69 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainAudit(t *testing.T) {
+	t.Run("It verifies each block at its own height", func(t *testing.T) {
+		// Arrange
+		testChain(t, 4)
+		tip := BlockHashAt(4)
+		// Act
+		failures, err := AuditChain(0, len(Blockchain))
+		// Assert
+		assert.Nil(t, err)
+		assert.Empty(t, failures)
+		assert.False(t, VerifyBlock(Blockchain[2], 2))
+		assert.Equal(t, 5, len(Blockchain))
+		assert.Equal(t, tip, BlockHashAt(4))
+	})
+	t.Run("It reports every invalid block with its reasons", func(t *testing.T) {
+		// Arrange
+		testChain(t, 4)
+		Blockchain[2].Difficulty += 1000
+		// Act
+		failures, err := AuditChain(0, len(Blockchain))
+		// Assert
+		assert.Nil(t, err)
+		assert.Len(t, failures, 2)
+		assert.Equal(t, 2, failures[0].Height)
+		assert.Contains(t, reasonCodesOf(failures[0].Reasons), ReasonBadProofOfWork)
+		assert.Equal(t, 3, failures[1].Height)
+		assert.Contains(t, reasonCodesOf(failures[1].Reasons), ReasonBadPreviousHash)
+	})
+	t.Run("It only reports blocks in the range", func(t *testing.T) {
+		// Arrange
+		testChain(t, 4)
+		Blockchain[2].Difficulty += 1000
+		// Act
+		failures, err := AuditChain(3, 4)
+		// Assert
+		assert.Nil(t, err)
+		assert.Len(t, failures, 1)
+		assert.Equal(t, 3, failures[0].Height)
+	})
+	t.Run("It refuses to audit a pruned blockchain", func(t *testing.T) {
+		// Arrange
+		testChain(t, 1)
+		PrunedHeight = 1
+		defer func() {
+			PrunedHeight = 0
+		}()
+		// Act
+		_, err := AuditChain(0, len(Blockchain))
+		// Assert
+		assert.Equal(t, ErrAuditPruned, err)
+	})
+}
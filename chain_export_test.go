@@ -0,0 +1,134 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func exportTestBlock() Block {
+	return Block{
+		LegacyTransactions: []Transaction{
+			{
+				Sender:          PublicKey{Y: []byte("sender")},
+				Recipient:       PublicKey{Y: []byte("recipient")},
+				Amount:          1.5,
+				SenderSignature: Signature{S: []byte("signature")},
+				Timestamp:       time.Unix(0, 1700000000000000000),
+				Contracts: []Contract{
+					{Contents: "contract", Parties: []ContractParty{{PublicKey: PublicKey{Y: []byte("party")}}}, GasUsed: 2},
+				},
+				Body:           []byte("a ^body$ with - \"delimiters\""),
+				BodySignatures: []Signature{{S: []byte("body signature")}},
+				Nonce:          3,
+				Tip:            0.25,
+				Replaces:       [32]byte{1, 2, 3},
+				ValidAfter:     10,
+				ValidUntil:     1700000600,
+			},
+		},
+		Miner:      PublicKey{Y: []byte("miner")},
+		Nonce:      42,
+		MiningTime: time.Minute,
+		Difficulty: 50000,
+		Timestamp:  time.Unix(0, 1700000000000000000),
+		Transition: StateTransition{
+			LegacyUpdatedData: map[string][]byte{"b": []byte("2"), "a": {}},
+			ZenUpdatedData:    []MerkleNode{{Data: []byte("data"), Children: map[byte]int{1: 2, 0: 1}, Hash: "hash"}},
+		},
+		ZenProof: []byte("proof"),
+	}
+}
+
+func TestChainExport(t *testing.T) {
+	t.Run("It decodes blocks to exactly what was encoded", func(t *testing.T) {
+		// Arrange
+		block := exportTestBlock()
+		// Act
+		decoded, err := DecodeBlock(EncodeBlock(block))
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, block, decoded)
+		assert.Equal(t, HashBlock(block, 1), HashBlock(decoded, 1))
+	})
+	t.Run("It reads back an exported chain", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Blockchain = []Block{GenesisBlock(), exportTestBlock()}
+		path := filepath.Join(t.TempDir(), "chain.bin")
+		// Act
+		err := ExportChain(path)
+		blocks, readErr := ReadChainExport(path)
+		// Assert
+		assert.Nil(t, err)
+		assert.Nil(t, readErr)
+		assert.Equal(t, Blockchain, blocks)
+	})
+	t.Run("It rejects a corrupted export", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Blockchain = []Block{GenesisBlock(), exportTestBlock()}
+		path := filepath.Join(t.TempDir(), "chain.bin")
+		assert.Nil(t, ExportChain(path))
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		data[len(data)-10] ^= 0xff
+		assert.Nil(t, os.WriteFile(path, data, 0644))
+		// Act
+		_, err = ReadChainExport(path)
+		// Assert
+		assert.ErrorContains(t, err, "checksum mismatch")
+	})
+	t.Run("It rejects an export from another network", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Blockchain = []Block{GenesisBlock()}
+		path := filepath.Join(t.TempDir(), "chain.bin")
+		assert.Nil(t, ExportChain(path))
+		Env.Network = "other"
+		defer LoadEnv()
+		// Act
+		_, err := ReadChainExport(path)
+		// Assert
+		assert.ErrorContains(t, err, "network")
+	})
+	t.Run("It reads an export made with the first version of the format", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		defer LoadEnv()
+		for _, upgrade := range []UpgradeName{Kyoto, Lagos, Oslo} {
+			Env.Upgrades[upgrade] = -1 // Added since the export was made
+		}
+		// Act
+		blocks, err := ReadChainExport(filepath.Join("testdata", "chain_export_v1.bin"))
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(blocks))
+		transactions := ExtractTransactions(blocks[1])
+		assert.Equal(t, 1, len(transactions))
+		assert.Equal(t, 1.5, transactions[0].Amount)
+		assert.Equal(t, []byte("body"), transactions[0].Body)
+		assert.Equal(t, uint64(0), transactions[0].Nonce)
+	})
+	t.Run("It rejects an export if an upgrade it doesn't know about activates within it", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		defer LoadEnv()
+		// Act
+		_, err := ReadChainExport(filepath.Join("testdata", "chain_export_v1.bin"))
+		// Assert
+		assert.ErrorContains(t, err, "upgrade heights")
+	})
+}
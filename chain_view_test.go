@@ -0,0 +1,125 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"sync"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// testStateView is a StateView with fixed nonces and balances.
+type testStateView struct {
+	nonces   map[string]uint64
+	balances map[string]float64
+}
+
+func (s testStateView) Balance(key []byte) float64 {
+	return s.balances[string(key)]
+}
+
+func (s testStateView) Nonce(key []byte) uint64 {
+	return s.nonces[string(key)]
+}
+
+func (s testStateView) State() State {
+	return EmptyState()
+}
+
+func TestChainView(t *testing.T) {
+	testChain(t, 3)
+	blocks := append([]Block{}, Blockchain...)
+	t.Run("It validates blocks against a chain view without the blockchain", func(t *testing.T) {
+		// Arrange
+		Blockchain = nil
+		defer func() {
+			Blockchain = blocks
+		}()
+		state := testStateView{}
+		// Act
+		problems := ValidateBlock(BlocksView(blocks[:3]), state, blocks[3], 3)
+		// Assert
+		assert.Empty(t, problems)
+	})
+	t.Run("It validates a block against the branch it is given", func(t *testing.T) {
+		// Arrange
+		state := testStateView{}
+		// Act
+		problems := ValidateBlock(BlocksView(blocks[:2]), state, blocks[3], 2)
+		// Assert
+		assert.Contains(t, reasonCodesOf(problems), ReasonBadPreviousHash)
+	})
+	t.Run("It validates blocks from several goroutines at once", func(t *testing.T) {
+		// Arrange
+		state := testStateView{}
+		results := make([][]*ValidationError, len(blocks))
+		var wg sync.WaitGroup
+		// Act
+		for height := 1; height < len(blocks); height++ {
+			wg.Add(1)
+			go func(height int) {
+				defer wg.Done()
+				results[height] = ValidateBlock(BlocksView(blocks[:height]), state, blocks[height], height)
+			}(height)
+		}
+		wg.Wait()
+		// Assert
+		for height := 1; height < len(blocks); height++ {
+			assert.Empty(t, results[height])
+		}
+	})
+	t.Run("It checks nonces against the state view", func(t *testing.T) {
+		// Arrange
+		transactions := ExtractTransactions(blocks[1])
+		used := testStateView{nonces: map[string]uint64{string(transactions[0].Sender.Y): 1}}
+		// Act
+		fresh := ValidateNonces(testStateView{}, transactions, 1)
+		replayed := ValidateNonces(used, transactions, 1)
+		// Assert
+		assert.True(t, fresh)
+		assert.False(t, replayed)
+	})
+	t.Run("It looks up miners in a chain of blocks", func(t *testing.T) {
+		// Arrange
+		view := BlocksView(blocks)
+		miner := blocks[1].Miner.Y
+		// Act
+		last, found := view.LastMinedBlock(miner)
+		// Assert
+		assert.True(t, found)
+		assert.Equal(t, blocks[3], last)
+		assert.False(t, view.IsNewMiner(miner, 1))
+		assert.True(t, view.IsNewMiner([]byte("other"), 3))
+		assert.Equal(t, int64(1), view.MinerCount(3))
+		assert.Equal(t, 0, MinVerifiers(view))
+	})
+	t.Run("It makes a sender afford all of their transactions in a block together", func(t *testing.T) {
+		// Arrange
+		transactions := testSignedTransfers(t, 1, 1)
+		sender := string(transactions[0].Sender.Y)
+		short := testStateView{balances: map[string]float64{sender: 1.5}}
+		enough := testStateView{balances: map[string]float64{sender: 2}}
+		// Act
+		shortErr := CheckTransactions(BlocksView(blocks[:3]), short, transactions, 3)
+		enoughErr := CheckTransactions(BlocksView(blocks[:3]), enough, transactions, 3)
+		// Assert
+		assert.Equal(t, ReasonDoubleSpend, shortErr.Code)
+		assert.Nil(t, enoughErr)
+	})
+	t.Run("It checks the transactions after one created by a smart contract", func(t *testing.T) {
+		// Arrange
+		transactions := append([]Transaction{{FromSmartContract: true}}, testSignedTransfers(t, 1)...)
+		// Act
+		err := CheckTransactions(BlocksView(blocks[:3]), testStateView{}, transactions, 3)
+		// Assert
+		assert.Equal(t, ReasonDoubleSpend, err.Code)
+	})
+}
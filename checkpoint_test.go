@@ -0,0 +1,133 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// setCheckpoint makes the given block hash the only checkpoint of the current network.
+func setCheckpoint(height int, hash [64]byte) {
+	Env.Checkpoints = map[string][]Checkpoint{Env.Network: {{Height: height, Hash: hex.EncodeToString(hash[:])}}}
+}
+
+func TestCheckpoints(t *testing.T) {
+	defer func() {
+		FastSync = false
+		LoadEnv()
+	}()
+	t.Run("It rejects headers that conflict with a checkpoint", func(t *testing.T) {
+		// Arrange
+		testChain(t, 4)
+		headers := Headers(1, 5)
+		setCheckpoint(2, [64]byte{1})
+		// Act
+		err := VerifyHeaders(1, headers)
+		// Assert
+		assert.NotNil(t, err)
+	})
+	t.Run("It accepts headers that match a checkpoint", func(t *testing.T) {
+		// Arrange
+		testChain(t, 4)
+		headers := Headers(1, 5)
+		setCheckpoint(2, BlockHashAt(2))
+		// Act
+		err := VerifyHeaders(1, headers)
+		// Assert
+		assert.Nil(t, err)
+	})
+	t.Run("It refuses to reorganize below a checkpoint", func(t *testing.T) {
+		// Arrange
+		testWorkChain(1, 1, 1)
+		setCheckpoint(3, BlockHashAt(3))
+		tip := BlockHashAt(3)
+		// Act
+		_, err := Reorganize(2, []Block{{Nonce: 100, Difficulty: 5, PreviousBlockHash: BlockHashAt(1)}}, false)
+		// Assert
+		assert.True(t, errors.Is(err, ErrCheckpointConflict))
+		assert.Equal(t, tip, BlockHashAt(3))
+	})
+	t.Run("It ignores competing blocks at a checkpoint's height", func(t *testing.T) {
+		// Arrange
+		testWorkChain(1, 1)
+		setCheckpoint(2, BlockHashAt(2))
+		// Act
+		_, err := Forks.AddBlock(Block{Nonce: 50, Difficulty: 1, PreviousBlockHash: BlockHashAt(1)})
+		// Assert
+		assert.Equal(t, ErrCheckpointConflict, err)
+		assert.Equal(t, 0, Forks.Len())
+	})
+	t.Run("It refuses to load checkpoints with invalid hashes", func(t *testing.T) {
+		// Arrange
+		wd, err := os.Getwd()
+		assert.Nil(t, err)
+		assert.Nil(t, os.Chdir(t.TempDir()))
+		defer func() {
+			_ = os.Chdir(wd)
+		}()
+		env := `{"network": "testnet", "checkpoints": {"testnet": [{"height": 1, "hash": "` + strings.Repeat("zz", 64) + `"}]}}`
+		assert.Nil(t, os.WriteFile("env.json", []byte(env), 0600))
+		// Act
+		load := func() {
+			LoadEnv()
+		}
+		// Assert
+		assert.Panics(t, load)
+	})
+	t.Run("It imports a chain without checking proofs below the latest checkpoint in fast-sync mode", func(t *testing.T) {
+		// Arrange
+		testChain(t, 3)
+		path := filepath.Join(t.TempDir(), "chain.bin")
+		assert.Nil(t, ExportChain(path))
+		setCheckpoint(3, BlockHashAt(3))
+		tip := BlockHashAt(3)
+		FastSync = true
+		// Act
+		err := ImportChain(path)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, tip, BlockHashAt(3))
+		assert.False(t, SkipFullVerification(1))
+	})
+	t.Run("It syncs without checking signatures below the latest checkpoint in fast-sync mode", func(t *testing.T) {
+		// Arrange
+		testChain(t, 4)
+		forged := testForgedBranch(3)
+		peer := staticSyncPeer(3, Headers(3, 5), forged)
+		defer peer.Close()
+		setCheckpoint(4, BlockHashAt(4))
+		TruncateBlockchain(3)
+		testPeers(t, peer.URL)
+		FastSync = true
+		// Act
+		SyncBlockchain(-1)
+		// Assert
+		assert.Len(t, Blockchain, 5)
+		assert.False(t, SkipFullVerification(3))
+	})
+	t.Run("It refuses to import a chain that conflicts with a checkpoint", func(t *testing.T) {
+		// Arrange
+		testChain(t, 3)
+		path := filepath.Join(t.TempDir(), "chain.bin")
+		assert.Nil(t, ExportChain(path))
+		setCheckpoint(2, [64]byte{1})
+		// Act
+		err := ImportChain(path)
+		// Assert
+		assert.True(t, errors.Is(err, ErrCheckpointConflict))
+	})
+}
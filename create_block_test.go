@@ -31,23 +31,21 @@ func TestCreateBlock(t *testing.T) {
 		var amount float64
 		amount = 123
 		Blockchain = nil
-		TransactionHashes[[32]byte{}] = 1
 		// Act
-		MiningTransactions = []Transaction{
-			{
-				Sender:    senderPublicKey,
-				Recipient: recipientPublicKey,
-				Amount:    amount,
-			},
-		}
+		Pool = NewMempool()
+		_ = Pool.Add(NewMempoolEntry(Transaction{
+			Sender:    senderPublicKey,
+			Recipient: recipientPublicKey,
+			Amount:    amount,
+		}, nil, StateTransition{}))
 		block, err := CreateBlock()
 		if err != nil {
 			panic(err)
 		}
 		// Assert
-		assert.Equal(t, senderPublicKey, block.Transactions[0].Sender)
-		assert.Equal(t, recipientPublicKey, block.Transactions[0].Recipient)
-		assert.Equal(t, amount, block.Transactions[0].Amount)
+		assert.Equal(t, senderPublicKey, block.LegacyTransactions[0].Sender)
+		assert.Equal(t, recipientPublicKey, block.LegacyTransactions[0].Recipient)
+		assert.Equal(t, amount, block.LegacyTransactions[0].Amount)
 	})
 	t.Run("It creates a block with a valid hash", func(t *testing.T) {
 		// Arrange
@@ -63,15 +61,13 @@ func TestCreateBlock(t *testing.T) {
 		amount = 123
 		var maxHash uint64
 		maxHash = 0x1000000000000000
-		TransactionHashes[[32]byte{}] = 1
 		// Act
-		MiningTransactions = []Transaction{
-			{
-				Sender:    senderPublicKey,
-				Recipient: recipientPublicKey,
-				Amount:    amount,
-			},
-		}
+		Pool = NewMempool()
+		_ = Pool.Add(NewMempoolEntry(Transaction{
+			Sender:    senderPublicKey,
+			Recipient: recipientPublicKey,
+			Amount:    amount,
+		}, nil, StateTransition{}))
 		block, err := CreateBlock()
 		if err != nil {
 			panic(err)
@@ -0,0 +1,115 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiry(t *testing.T) {
+	t.Run("It treats small bounds as heights and large bounds as times", func(t *testing.T) {
+		// Arrange
+		byHeight := nonceTestTransaction("a", 1, 1)
+		byHeight.ValidUntil = 10
+		byTime := nonceTestTransaction("a", 1, 1)
+		byTime.ValidUntil = 1700000000
+		// Act
+		heightLive := TransactionExpired(byHeight, 10, time.Unix(1800000000, 0))
+		heightExpired := TransactionExpired(byHeight, 11, time.Unix(0, 0))
+		timeLive := TransactionExpired(byTime, 1000, time.Unix(1700000000, 0))
+		timeExpired := TransactionExpired(byTime, 0, time.Unix(1700000001, 0))
+		// Assert
+		assert.False(t, heightLive)
+		assert.True(t, heightExpired)
+		assert.False(t, timeLive)
+		assert.True(t, timeExpired)
+	})
+	t.Run("It rejects blocks with transactions outside their window", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		early := nonceTestTransaction("a", 1, 1)
+		early.ValidAfter = 5
+		late := nonceTestTransaction("a", 1, 1)
+		late.ValidUntil = 3
+		// Act
+		tooEarly := VerifyExpiry([]Transaction{early}, 4, time.Now())
+		started := VerifyExpiry([]Transaction{early}, 5, time.Now())
+		tooLate := VerifyExpiry([]Transaction{late}, 4, time.Now())
+		// Assert
+		assert.False(t, tooEarly)
+		assert.True(t, started)
+		assert.False(t, tooLate)
+	})
+	t.Run("It rejects windows before the upgrade", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = 5
+		defer LoadEnv()
+		transaction := nonceTestTransaction("a", 1, 0)
+		transaction.ValidUntil = 100
+		// Act
+		before := VerifyExpiry([]Transaction{transaction}, 4, time.Now())
+		// Assert
+		assert.False(t, before)
+	})
+	t.Run("It drops expired transactions from the mempool", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		expiring := nonceTestTransaction("a", 1, 1)
+		expiring.ValidUntil = 2
+		expiringEntry := NewMempoolEntry(expiring, nil, StateTransition{})
+		assert.Nil(t, pool.Add(expiringEntry))
+		assert.Nil(t, pool.Add(NewMempoolEntry(nonceTestTransaction("b", 2, 1), nil, StateTransition{})))
+		// Act
+		removed := pool.RemoveExpired(3, time.Now())
+		// Assert
+		assert.Equal(t, 1, removed)
+		assert.False(t, pool.Contains(expiringEntry.Hash))
+		assert.Equal(t, 1, pool.Len())
+	})
+	t.Run("It holds back transactions that aren't valid yet", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Blockchain = nil
+		Append(GenesisBlock())
+		pool := NewMempool()
+		waiting := nonceTestTransaction("a", 1, 1)
+		waiting.ValidAfter = time.Now().Add(time.Hour).Unix()
+		assert.Nil(t, pool.Add(NewMempoolEntry(waiting, nil, StateTransition{})))
+		assert.Nil(t, pool.Add(NewMempoolEntry(nonceTestTransaction("a", 2, 2), nil, StateTransition{})))
+		assert.Nil(t, pool.Add(NewMempoolEntry(nonceTestTransaction("b", 3, 1), nil, StateTransition{})))
+		// Act
+		now := pool.Select(10, time.Now())
+		later := pool.Select(10, time.Now().Add(2*time.Hour))
+		// Assert
+		assert.Equal(t, []float64{3}, selectedAmounts(now))
+		assert.Len(t, later, 3)
+	})
+	t.Run("It serializes the validity window", func(t *testing.T) {
+		// Arrange
+		transaction := nonceTestTransaction("a", 1, 1)
+		transaction.ValidAfter = 4
+		transaction.ValidUntil = 1700000000
+		// Act
+		transactionJson, err := json.Marshal(transaction)
+		assert.Nil(t, err)
+		var decoded Transaction
+		err = json.Unmarshal(transactionJson, &decoded)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, transaction.ValidAfter, decoded.ValidAfter)
+		assert.Equal(t, transaction.ValidUntil, decoded.ValidUntil)
+		assert.NotEqual(t, TransactionHash(nonceTestTransaction("a", 1, 1)), TransactionHash(transaction))
+	})
+}
@@ -0,0 +1,192 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// feeMarketTestTransaction creates a transaction without a nonce, paying the given tip.
+func feeMarketTestTransaction(sender string, amount float64, tip float64) Transaction {
+	return Transaction{
+		Sender:    PublicKey{Y: []byte(sender)},
+		Recipient: PublicKey{Y: []byte("recipient")},
+		Amount:    amount,
+		Timestamp: time.Unix(1, 0),
+		Tip:       tip,
+	}
+}
+
+// feeMarketTestChain starts a blockchain with the genesis block followed by empty blocks, up to the given length.
+func feeMarketTestChain(length int) {
+	Blockchain = nil
+	Append(GenesisBlock())
+	for height := 1; height < length; height++ {
+		Append(Block{Nonce: int64(height), Miner: PublicKey{Y: []byte("early miner")}})
+	}
+}
+
+func TestFeeMarket(t *testing.T) {
+	defer func() {
+		LoadEnv()
+		Blockchain = nil
+		Pool = NewMempool()
+	}()
+	t.Run("It raises the base fee after full blocks and lowers it to TransactionFee after empty ones", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = -1 // The transactions don't have nonces
+		MaxBlockTransactions = 2
+		feeMarketTestChain(2)
+		start := BaseFee(2)
+		// Act
+		Append(Block{Nonce: 2, LegacyTransactions: []Transaction{
+			feeMarketTestTransaction("a", 1, 0), feeMarketTestTransaction("b", 1, 0),
+		}})
+		afterFull := BaseFee(3)
+		Append(Block{Nonce: 3, LegacyTransactions: []Transaction{feeMarketTestTransaction("a", 1, 0)}})
+		afterTarget := BaseFee(4)
+		for height := 4; height < 60; height++ {
+			Append(Block{Nonce: int64(height)})
+		}
+		// Assert
+		assert.InDelta(t, start*(1+BaseFeeMaxChange), afterFull, 1e-12)
+		assert.InDelta(t, afterFull, afterTarget, 1e-12)
+		assert.Equal(t, TransactionFee, BaseFee(60))
+		for height := 0; height <= len(Blockchain); height++ {
+			assert.InDelta(t, ChainBaseFee(BlocksView(Blockchain), height), BaseFee(height), 1e-12)
+		}
+	})
+	t.Run("It keeps the base fee at TransactionFee before the Oslo upgrade", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = -1 // The transactions don't have nonces
+		Env.Upgrades[Oslo] = -1
+		MaxBlockTransactions = 1
+		feeMarketTestChain(2)
+		// Act
+		Append(Block{Nonce: 2, LegacyTransactions: []Transaction{feeMarketTestTransaction("a", 1, 0)}})
+		// Assert
+		assert.Equal(t, TransactionFee, BaseFee(3))
+	})
+	t.Run("It makes the sender afford a transaction's fees before the Oslo upgrade", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = -1 // The transactions don't have nonces
+		Env.Upgrades[Oslo] = -1
+		feeMarketTestChain(51)
+		state := testStateView{balances: map[string]float64{"a": 1}}
+		// Act
+		err := CheckTransactions(NodeChain, state, []Transaction{feeMarketTestTransaction("a", 1, 0)}, 51)
+		// Assert
+		assert.NotNil(t, err)
+		assert.Equal(t, ReasonDoubleSpend, err.Code)
+	})
+	t.Run("It burns the base fee and pays the tip to the miner", func(t *testing.T) {
+		for _, oslo := range []int{0, -1} {
+			// Arrange
+			loadLatestEnv()
+			Env.Upgrades[Kyoto] = -1 // The transactions don't have nonces
+			Env.Upgrades[Oslo] = oslo
+			BaseFeeDestination = BaseFeeBurn
+			feeMarketTestChain(51)
+			baseFee := BaseFee(51)
+			// Act
+			Append(Block{Nonce: 51, Miner: PublicKey{Y: []byte("miner")}, LegacyTransactions: []Transaction{
+				feeMarketTestTransaction("a", 1, 0.5),
+			}})
+			// Assert
+			miner, _ := AccountLedger.Account([]byte("miner"))
+			reward := CalculateBlockReward(AccountLedger.MinerCount(51), 51)
+			assert.InDelta(t, -(1.5 + baseFee), GetBalance([]byte("a")), 1e-12)
+			if oslo == 0 {
+				assert.InDelta(t, reward+0.5, miner.MiningTotal, 1e-12)
+			} else {
+				assert.InDelta(t, reward+0.5+TransactionFee, miner.MiningTotal, 1e-12)
+			}
+		}
+	})
+	t.Run("It splits the base fee between the time verifiers when it is redistributed", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = -1 // The transactions don't have nonces
+		BaseFeeDestination = BaseFeeRedistribute
+		feeMarketTestChain(51)
+		baseFee := BaseFee(51)
+		// Act
+		Append(Block{
+			Nonce:              51,
+			Miner:              PublicKey{Y: []byte("miner")},
+			TimeVerifiers:      []PublicKey{{Y: []byte("v1")}, {Y: []byte("v2")}},
+			LegacyTransactions: []Transaction{feeMarketTestTransaction("a", 1, 0)},
+		})
+		// Assert
+		assert.InDelta(t, baseFee/2, GetBalance([]byte("v1")), 1e-12)
+		assert.InDelta(t, baseFee/2, GetBalance([]byte("v2")), 1e-12)
+	})
+	t.Run("It orders the mempool by tip", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = -1 // The transactions don't have nonces
+		feeMarketTestChain(1)
+		pool := NewMempool()
+		low := NewMempoolEntry(feeMarketTestTransaction("a", 1, 0.1), nil, StateTransition{})
+		high := NewMempoolEntry(feeMarketTestTransaction("b", 2, 0.2), nil, StateTransition{})
+		assert.Nil(t, pool.Add(low))
+		assert.Nil(t, pool.Add(high))
+		// Act
+		selected := pool.Select(10, time.Now())
+		// Assert
+		assert.Equal(t, []float64{2, 1}, selectedAmounts(selected))
+		assert.Equal(t, 0.1, low.Fee)
+		assert.Equal(t, BaseFee(1), low.BaseFees)
+		assert.Equal(t, 0.1+BaseFee(1), low.TotalFee())
+	})
+	t.Run("It recommends tips from the tips paid in recent blocks", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = -1 // The transactions don't have nonces
+		feeMarketTestChain(1)
+		Pool = NewMempool()
+		var transactions []Transaction
+		for _, tip := range []float64{0.4, 0.1, 0.3, 0.2} {
+			transactions = append(transactions, feeMarketTestTransaction("a", 1, tip))
+		}
+		Append(Block{Nonce: 1, LegacyTransactions: transactions})
+		size := len(EncodeTransaction(transactions[0]))
+		// Act
+		estimate := EstimateFees()
+		slow, standard, fast := estimate.Tip(size)
+		// Assert
+		assert.Equal(t, size, estimate.TransactionSize)
+		assert.Equal(t, BaseFee(2), estimate.BaseFee)
+		assert.InDelta(t, 0.1, slow, 1e-8)
+		assert.InDelta(t, 0.2, standard, 1e-8)
+		assert.InDelta(t, 0.3, fast, 1e-8)
+	})
+	t.Run("It recommends a fast tip that outbids the mempool when the next block is full", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = -1 // The transactions don't have nonces
+		MaxBlockTransactions = 1
+		feeMarketTestChain(1)
+		Pool = NewMempool()
+		packed := NewMempoolEntry(feeMarketTestTransaction("a", 1, 0.2), nil, StateTransition{})
+		assert.Nil(t, Pool.Add(packed))
+		assert.Nil(t, Pool.Add(NewMempoolEntry(feeMarketTestTransaction("b", 2, 0.1), nil, StateTransition{})))
+		// Act
+		estimate := EstimateFees()
+		// Assert
+		assert.InDelta(t, packed.FeeRate()*ReplacementFeeBump, estimate.Fast, 1e-12)
+	})
+}
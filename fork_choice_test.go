@@ -0,0 +1,86 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForkChoice(t *testing.T) {
+	t.Run("It measures chains by cumulative difficulty", func(t *testing.T) {
+		// Arrange
+		short := []Block{{Difficulty: 10}, {Difficulty: 40}}
+		long := []Block{{Difficulty: 10}, {Difficulty: 10}, {Difficulty: 10}}
+		// Act
+		shortWork := ChainWork(short)
+		longWork := ChainWork(long)
+		// Assert
+		assert.Equal(t, big.NewInt(50), shortWork)
+		assert.Equal(t, 1, shortWork.Cmp(longWork))
+	})
+	t.Run("It rolls back to the fork point and reports the reorg", func(t *testing.T) {
+		// Arrange
+		testWorkChain(1, 1, 1)
+		removed := [][64]byte{BlockHashAt(2), BlockHashAt(3)}
+		var events []ReorgEvent
+		OnReorg(func(event ReorgEvent) {
+			events = append(events, event)
+		})
+		replacement := Block{Nonce: 100, Difficulty: 5, PreviousBlockHash: BlockHashAt(1)}
+		// Act
+		event, err := Reorganize(2, []Block{replacement}, false)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(Blockchain))
+		assert.Equal(t, 2, event.ForkHeight)
+		assert.Equal(t, 2, event.Depth)
+		assert.Equal(t, removed, event.Removed)
+		assert.Equal(t, [][64]byte{BlockHashAt(2)}, event.Added)
+		assert.Len(t, events, 1)
+	})
+	t.Run("It puts transactions from abandoned blocks back in the mempool", func(t *testing.T) {
+		// Arrange
+		testWorkChain(1)
+		transaction := testSignedTransaction(t)
+		Append(Block{Nonce: 2, Difficulty: 1, PreviousBlockHash: BlockHashAt(1), LegacyTransactions: []Transaction{transaction}})
+		assert.Equal(t, uint64(1), AccountNonce(transaction.Sender.Y))
+		// Act
+		_, err := Reorganize(2, []Block{{Nonce: 3, Difficulty: 5, PreviousBlockHash: BlockHashAt(1)}}, false)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(0), AccountNonce(transaction.Sender.Y))
+		assert.True(t, Pool.Contains(TransactionHash(transaction)))
+	})
+	t.Run("It tracks a competing branch with less work", func(t *testing.T) {
+		// Arrange
+		testWorkChain(5, 5)
+		tip := BlockHashAt(2)
+		competing := Block{Nonce: 50, Difficulty: 1, PreviousBlockHash: BlockHashAt(1)}
+		// Act
+		reorganized, err := Forks.AddBlock(competing)
+		// Assert
+		assert.Nil(t, err)
+		assert.False(t, reorganized)
+		assert.Equal(t, 1, Forks.Len())
+		assert.Equal(t, tip, BlockHashAt(2))
+	})
+	t.Run("It rejects blocks with an unknown parent", func(t *testing.T) {
+		// Arrange
+		testWorkChain(1)
+		orphan := Block{Nonce: 7, Difficulty: 1, PreviousBlockHash: [64]byte{1}}
+		// Act
+		_, err := Forks.AddBlock(orphan)
+		// Assert
+		assert.Equal(t, ErrUnknownParent, err)
+	})
+}
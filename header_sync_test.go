@@ -0,0 +1,173 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticSyncPeer starts a peer that serves the given headers from the given height, and the bodies of the given
+// blocks, which start at the same height.
+func staticSyncPeer(start int, headers []HeaderRecord, blocks []Block) *httptest.Server {
+	return httptest.NewServer(NetworkHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var response any = HeadersResponse{Start: start, Headers: headers}
+		if req.URL.Path == "/bodies" {
+			from, _ := strconv.Atoi(req.URL.Query().Get("from"))
+			to, _ := strconv.Atoi(req.URL.Query().Get("to"))
+			if from < start || to > start+len(blocks) || from >= to {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			response = BodiesResponse{Start: from, Blocks: blocks[from-start : to-start]}
+		}
+		responseBytes, _ := json.Marshal(response)
+		_, _ = w.Write(responseBytes)
+	})))
+}
+
+// testPeers moves the test to a temporary directory whose peers.txt lists the given peers.
+func testPeers(t *testing.T, peers ...string) {
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+	assert.Nil(t, os.WriteFile("peers.txt", []byte(strings.Join(peers, "\n")+"\n"), 0600))
+}
+
+func TestHeaderSync(t *testing.T) {
+	t.Run("It builds a locator that thins out towards the genesis block", func(t *testing.T) {
+		// Arrange
+		testChain(t, 30)
+		// Act
+		locator := BlockLocator()
+		// Assert
+		assert.Equal(t, 30, locator[0].Height)
+		assert.Equal(t, 21, locator[9].Height)
+		assert.Equal(t, 0, locator[len(locator)-1].Height)
+		assert.Less(t, len(locator), 20)
+	})
+	t.Run("It serves the headers after the last shared block", func(t *testing.T) {
+		// Arrange
+		testChain(t, 5)
+		shared := BlockHashAt(2)
+		locator := []LocatorEntry{
+			{Height: 4, Hash: strings.Repeat("ab", 64)},
+			{Height: 2, Hash: hex.EncodeToString(shared[:])},
+		}
+		locatorBytes, err := json.Marshal(locator)
+		assert.Nil(t, err)
+		recorder := httptest.NewRecorder()
+		// Act
+		HandleHeadersRequest(recorder, httptest.NewRequest(http.MethodGet, "/headers", strings.NewReader(string(locatorBytes))))
+		// Assert
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var response HeadersResponse
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, 3, response.Start)
+		assert.Len(t, response.Headers, 3)
+		assert.Equal(t, BlockHashAt(3), response.Headers[0].Hash)
+		assert.Equal(t, 1, response.Headers[0].Transactions)
+		assert.Nil(t, response.Headers[0].Header.LegacyTransactions)
+	})
+	t.Run("It refuses a locator from another chain", func(t *testing.T) {
+		// Arrange
+		testChain(t, 2)
+		locatorBytes, err := json.Marshal([]LocatorEntry{{Height: 0, Hash: "00"}})
+		assert.Nil(t, err)
+		recorder := httptest.NewRecorder()
+		// Act
+		HandleHeadersRequest(recorder, httptest.NewRequest(http.MethodGet, "/headers", strings.NewReader(string(locatorBytes))))
+		// Assert
+		assert.Equal(t, http.StatusConflict, recorder.Code)
+	})
+	t.Run("It serves block bodies by height range", func(t *testing.T) {
+		// Arrange
+		testChain(t, 5)
+		recorder := httptest.NewRecorder()
+		// Act
+		HandleBodiesRequest(recorder, httptest.NewRequest(http.MethodGet, "/bodies?from=2&to=4", nil))
+		// Assert
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var response BodiesResponse
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, 2, response.Start)
+		assert.Len(t, response.Blocks, 2)
+		assert.True(t, VerifyBody(response.Blocks[0], Headers(2, 3)[0], 2))
+	})
+	t.Run("It verifies the links, proof of work and difficulty of headers", func(t *testing.T) {
+		// Arrange
+		testChain(t, 4)
+		headers := Headers(2, 5)
+		wrongDifficulty := append([]HeaderRecord{}, headers...)
+		wrongDifficulty[1].Header.Difficulty++
+		wrongLink := append([]HeaderRecord{}, headers...)
+		wrongLink[2].Header.PreviousBlockHash = [64]byte{1}
+		// Act
+		valid := VerifyHeaders(2, headers)
+		difficultyErr := VerifyHeaders(2, wrongDifficulty)
+		linkErr := VerifyHeaders(2, wrongLink)
+		// Assert
+		assert.Nil(t, valid)
+		assert.NotNil(t, difficultyErr)
+		assert.NotNil(t, linkErr)
+	})
+	t.Run("It falls back to the next chain when the one claiming the most work has no valid blocks", func(t *testing.T) {
+		// Arrange
+		testChain(t, 6)
+		honestHeaders := Headers(3, 7)
+		honestBlocks := BlocksAt(3, 7)
+		forged := make([]HeaderRecord, len(honestHeaders))
+		previousHash := BlockHashAt(2)
+		for i := range forged {
+			// A header's hash isn't checked against its block, so any hash passes the proof of work
+			forged[i] = HeaderRecord{Header: honestHeaders[i].Header, Hash: [64]byte{0, 0, 0, 0, 0, 0, 0, 0, byte(i + 1)}, Transactions: -1}
+			forged[i].Header.Difficulty = MaximumUint64 / 2
+			forged[i].Header.PreviousBlockHash = previousHash
+			previousHash = forged[i].Hash
+		}
+		TruncateBlockchain(3)
+		PeerScores = NewPeerScoreboard()
+		honest := staticSyncPeer(3, honestHeaders, honestBlocks)
+		defer honest.Close()
+		forging := staticSyncPeer(3, forged, nil)
+		defer forging.Close()
+		testPeers(t, forging.URL, honest.URL)
+		// Act
+		SyncBlockchain(-1)
+		// Assert
+		assert.Len(t, Blockchain, 7)
+		assert.Equal(t, honestHeaders[3].Hash, BlockHashAt(6))
+		assert.Greater(t, PeerScores.Penalty(forging.URL), 0)
+	})
+	t.Run("It refuses a chain with more work whose blocks are invalid", func(t *testing.T) {
+		// Arrange
+		testChain(t, 4)
+		forged := testForgedBranch(3)
+		peer := staticSyncPeer(3, Headers(3, 5), forged)
+		defer peer.Close()
+		TruncateBlockchain(3)
+		testPeers(t, peer.URL)
+		// Act
+		SyncBlockchain(-1)
+		// Assert
+		assert.Len(t, Blockchain, 3)
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// scanBalance is the original whole-chain balance calculation, used as a reference for the ledger.
+func scanBalance(key []byte) float64 {
+	isNewMiner := func(miner []byte, maxBlockPosition int) bool {
+		for i := 1; i < len(Blockchain) && i <= maxBlockPosition; i++ {
+			if bytes.Equal(Blockchain[i].Miner.Y, miner) {
+				return false
+			}
+		}
+		return true
+	}
+	minerCount := func(maxBlockPosition int) int64 {
+		var result int64
+		for i := 1; i < len(Blockchain) && i <= maxBlockPosition; i++ {
+			if isNewMiner(Blockchain[i].Miner.Y, i-1) {
+				result++
+			}
+		}
+		return result
+	}
+	total := 0.0
+	miningTotal := 0.0
+	blocksMined := 0
+	for i := 1; i < len(Blockchain); i++ {
+		block := Blockchain[i]
+		for _, transaction := range ExtractTransactions(block) {
+			if bytes.Equal(transaction.Sender.Y, key) {
+				total -= transaction.Amount
+				if i > 50 {
+					total -= TransactionFee + (BodyFeePerByte * float64(len(transaction.Body)))
+				}
+			} else if bytes.Equal(transaction.Recipient.Y, key) {
+				total += transaction.Amount
+			}
+		}
+		if bytes.Equal(block.Miner.Y, key) {
+			miningTotal += float64(len(block.TimeVerifiers)-len(Blockchain[i-1].TimeVerifiers)) * 0.1
+			if i > 50 {
+				fees := 0.0
+				for _, transaction := range ExtractTransactions(block) {
+					fees += TransactionFee
+					fees += BodyFeePerByte * float64(len(transaction.Body))
+				}
+				miningTotal += fees
+			}
+			miningTotal += CalculateBlockReward(minerCount(i), i)
+			blocksMined++
+		}
+	}
+	if blocksMined > BlocksBeforeReward && len(Blockchain) > 50 {
+		total += miningTotal - float64(BlocksBeforeReward)
+	} else if len(Blockchain) < 50 {
+		total += miningTotal
+	}
+	return total
+}
+
+func randomLedgerBlock(r *rand.Rand, keys [][]byte) Block {
+	block := Block{
+		Nonce: r.Int63(),
+		Miner: PublicKey{Y: keys[r.Intn(len(keys))]},
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		block.TimeVerifiers = append(block.TimeVerifiers, PublicKey{Y: keys[r.Intn(len(keys))]})
+	}
+	for i := r.Intn(4); i > 0; i-- {
+		block.LegacyTransactions = append(block.LegacyTransactions, Transaction{
+			Sender:    PublicKey{Y: keys[r.Intn(len(keys))]},
+			Recipient: PublicKey{Y: keys[r.Intn(len(keys))]},
+			Amount:    float64(r.Intn(100)) / 10,
+			Body:      make([]byte, r.Intn(20)),
+		})
+	}
+	return block
+}
+
+func TestAccountLedger(t *testing.T) {
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	t.Run("It gives the same balances as scanning the blockchain", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Env.Upgrades[Kyoto] = -1 // The random transactions don't have nonces
+		Env.Upgrades[Oslo] = -1  // The reference balances predate the fee market
+		r := rand.New(rand.NewSource(1))
+		Blockchain = nil
+		Append(GenesisBlock())
+		for height := 1; height < 70; height++ {
+			// Act
+			Append(randomLedgerBlock(r, keys))
+			// Assert
+			for _, key := range keys {
+				assert.Equal(t, scanBalance(key), GetBalance(key))
+			}
+		}
+	})
+	t.Run("It gives the same balances after the blockchain is truncated", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Env.Upgrades[Kyoto] = -1 // The random transactions don't have nonces
+		Env.Upgrades[Oslo] = -1  // The reference balances predate the fee market
+		r := rand.New(rand.NewSource(2))
+		Blockchain = nil
+		Append(GenesisBlock())
+		for height := 1; height < 70; height++ {
+			Append(randomLedgerBlock(r, keys))
+		}
+		GetBalance(keys[0])
+		// Act
+		TruncateBlockchain(55)
+		for height := 55; height < 60; height++ {
+			Append(randomLedgerBlock(r, keys))
+		}
+		// Assert
+		for _, key := range keys {
+			assert.Equal(t, scanBalance(key), GetBalance(key))
+		}
+	})
+	t.Run("It counts each miner once", func(t *testing.T) {
+		// Arrange
+		Blockchain = nil
+		Append(GenesisBlock())
+		// Act
+		Append(Block{Nonce: 1, Miner: PublicKey{Y: keys[0]}})
+		Append(Block{Nonce: 2, Miner: PublicKey{Y: keys[0]}})
+		Append(Block{Nonce: 3, Miner: PublicKey{Y: keys[1]}})
+		// Assert
+		assert.Equal(t, int64(1), GetMinerCount(2))
+		assert.Equal(t, int64(2), GetMinerCount(3))
+		assert.True(t, IsNewMiner(PublicKey{Y: keys[1]}, 2))
+		assert.False(t, IsNewMiner(PublicKey{Y: keys[1]}, 3))
+	})
+}
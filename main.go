@@ -24,12 +24,24 @@ func main() {
 	command := flag.String("command", "exit", "Run a command and exit")
 	Verbose = flag.Bool("verbose", false, "Set to true to enable verbose logging")
 	benchmark := flag.Bool("benchmark", false, "Set to true to enable benchmarking")
+	flag.BoolVar(&PruneMode, "prune", false, "Set to true to only keep full blocks for recent history")
+	flag.BoolVar(&FastSync, "fastsync", false, "Set to true to skip signature and proof checks below the latest checkpoint")
+	regtest := flag.Bool("regtest", false, "Set to true to run a private in-memory chain with blocks generated on demand")
 	flag.Parse()
 	LoadEnv()
-	LoadStateCmd(nil)
+	if *regtest {
+		EnableRegtest()
+	}
+	RecoverPersistentFiles()
+	if !Regtest {
+		// The regtest chain is only kept in memory
+		LoadStateCmd(nil)
+	}
 	SyncBlockchain(-1)
 	if len(Blockchain) == 0 {
-		Append(GenesisBlock())
+		if err := Append(GenesisBlock()); err != nil {
+			panic(err)
+		}
 	}
 	if *benchmark {
 		Benchmark()
@@ -39,9 +51,13 @@ func main() {
 		*serve = true
 	}
 	if *serve {
-		listener := EstablishConnection()
-		defer CloseConnection(listener)
-		if *mine {
+		if !Regtest {
+			listener := EstablishConnection()
+			defer CloseConnection(listener)
+		}
+		if *mine && !Regtest {
+			// Regtest blocks are only mined by the generate command
+			LoadMempoolJournal()
 			go Mine()
 		}
 		http.HandleFunc("/l2Transaction", HandleTransactionRequest)
@@ -0,0 +1,241 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func mempoolTestEntry(sender string, amount float64, timestamp int64, fee float64) *MempoolEntry {
+	entry := NewMempoolEntry(Transaction{
+		Sender:    PublicKey{Y: []byte(sender)},
+		Recipient: PublicKey{Y: []byte("recipient")},
+		Amount:    amount,
+		Timestamp: time.Unix(timestamp, 0),
+	}, nil, StateTransition{})
+	entry.Fee = fee
+	return entry
+}
+
+func selectedAmounts(entries []MempoolEntry) []float64 {
+	var amounts []float64
+	for _, entry := range entries {
+		amounts = append(amounts, entry.Transaction.Amount)
+	}
+	return amounts
+}
+
+func TestMempool(t *testing.T) {
+	t.Run("It selects the highest fee rate first", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		assert.Nil(t, pool.Add(mempoolTestEntry("a", 1, 1, 0.1)))
+		assert.Nil(t, pool.Add(mempoolTestEntry("b", 2, 2, 0.3)))
+		assert.Nil(t, pool.Add(mempoolTestEntry("c", 3, 3, 0.2)))
+		// Act
+		selected := pool.Select(2, time.Now())
+		// Assert
+		assert.Equal(t, []float64{2, 3}, selectedAmounts(selected))
+	})
+	t.Run("It keeps each sender's transactions in order", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		assert.Nil(t, pool.Add(mempoolTestEntry("a", 2, 2, 0.9)))
+		assert.Nil(t, pool.Add(mempoolTestEntry("a", 1, 1, 0.1)))
+		assert.Nil(t, pool.Add(mempoolTestEntry("b", 3, 3, 0.5)))
+		// Act
+		selected := pool.Select(3, time.Now())
+		// Assert
+		assert.Equal(t, []float64{3, 1, 2}, selectedAmounts(selected))
+	})
+	t.Run("It rejects a transaction it already has", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		assert.Nil(t, pool.Add(mempoolTestEntry("a", 1, 1, 0.1)))
+		// Act
+		err := pool.Add(mempoolTestEntry("a", 1, 1, 0.1))
+		// Assert
+		assert.Equal(t, ErrMempoolDuplicate, err)
+		assert.Equal(t, 1, pool.Len())
+	})
+	t.Run("It evicts the lowest fee rate when full", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		pool.MaxTransactions = 2
+		low := mempoolTestEntry("a", 1, 1, 0.1)
+		assert.Nil(t, pool.Add(low))
+		assert.Nil(t, pool.Add(mempoolTestEntry("b", 2, 2, 0.3)))
+		// Act
+		err := pool.Add(mempoolTestEntry("c", 3, 3, 0.2))
+		rejected := pool.Add(mempoolTestEntry("d", 4, 4, 0.05))
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, ErrMempoolFull, rejected)
+		assert.False(t, pool.Contains(low.Hash))
+		assert.Equal(t, []float64{2, 3}, selectedAmounts(pool.Select(10, time.Now())))
+	})
+	t.Run("It removes transactions included in a block", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		mined := mempoolTestEntry("a", 1, 1, 0.1)
+		assert.Nil(t, pool.Add(mined))
+		assert.Nil(t, pool.Add(mempoolTestEntry("b", 2, 2, 0.1)))
+		version := pool.Version()
+		// Act
+		pool.RemoveIncluded(Block{LegacyTransactions: []Transaction{mined.Transaction}})
+		// Assert
+		assert.False(t, pool.Contains(mined.Hash))
+		assert.Equal(t, 1, pool.Len())
+		assert.NotEqual(t, version, pool.Version())
+	})
+	t.Run("It rejects a transaction its sender can't afford on top of their pending transactions", func(t *testing.T) {
+		// Arrange
+		testChain(t, 1)
+		transactions := testSignedTransfers(t, 0.6, 0.6)
+		// The sender's block reward covers one of the transactions, but not both
+		Append(Block{Miner: transactions[0].Sender, PreviousBlockHash: BlockHashAt(1)})
+		// Act
+		first := Pool.Accept(transactions[0])
+		second := Pool.Accept(transactions[1])
+		// Assert
+		assert.Nil(t, first)
+		assert.Equal(t, ReasonDoubleSpend, AsValidationError(second).Code)
+	})
+	t.Run("It only accepts one of two transactions its sender can't afford together when they arrive at once", func(t *testing.T) {
+		// Arrange
+		testChain(t, 1)
+		transactions := testSignedTransfers(t, 0.6, 0.6)
+		Append(Block{Miner: transactions[0].Sender, PreviousBlockHash: BlockHashAt(1)})
+		errs := make([]error, len(transactions))
+		var wg sync.WaitGroup
+		// Act
+		for i, transaction := range transactions {
+			wg.Add(1)
+			go func(i int, transaction Transaction) {
+				defer wg.Done()
+				errs[i] = Pool.Accept(transaction)
+			}(i, transaction)
+		}
+		wg.Wait()
+		// Assert
+		assert.Equal(t, 1, Pool.Len())
+		assert.True(t, errs[0] == nil || errs[1] == nil)
+	})
+}
+
+func TestMempoolJournal(t *testing.T) {
+	t.Run("It reads back journaled transactions", func(t *testing.T) {
+		// Arrange
+		path := filepath.Join(t.TempDir(), "mempool.journal")
+		journal, err := OpenMempoolJournal(path)
+		assert.Nil(t, err)
+		first := mempoolTestEntry("a", 1, 1, 0).Transaction
+		second := mempoolTestEntry("b", 2, 2, 0).Transaction
+		// Act
+		assert.Nil(t, journal.Append(first))
+		assert.Nil(t, journal.Append(second))
+		assert.Nil(t, journal.Close())
+		transactions, err := ReadMempoolJournal(path)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, []Transaction{first, second}, transactions)
+	})
+	t.Run("It ignores a record cut off by a crash", func(t *testing.T) {
+		// Arrange
+		path := filepath.Join(t.TempDir(), "mempool.journal")
+		journal, err := OpenMempoolJournal(path)
+		assert.Nil(t, err)
+		first := mempoolTestEntry("a", 1, 1, 0).Transaction
+		assert.Nil(t, journal.Append(first))
+		assert.Nil(t, journal.Append(mempoolTestEntry("b", 2, 2, 0).Transaction))
+		assert.Nil(t, journal.Close())
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(path, data[:len(data)-5], 0600))
+		// Act
+		transactions, err := ReadMempoolJournal(path)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, []Transaction{first}, transactions)
+	})
+	t.Run("It drops transactions that leave the mempool", func(t *testing.T) {
+		// Arrange
+		path := filepath.Join(t.TempDir(), "mempool.journal")
+		journal, err := OpenMempoolJournal(path)
+		assert.Nil(t, err)
+		Journal, Pool = journal, NewMempool()
+		defer func() {
+			_ = Journal.Close()
+			Journal = nil
+		}()
+		removed := mempoolTestEntry("a", 1, 1, 0)
+		pending := mempoolTestEntry("b", 2, 2, 0)
+		assert.Nil(t, Pool.Add(pending))
+		assert.Nil(t, journal.Append(removed.Transaction))
+		assert.Nil(t, journal.Append(pending.Transaction))
+		// Act
+		PruneJournal()
+		// Assert
+		assert.Equal(t, 1, journal.Len())
+		transactions, err := ReadMempoolJournal(path)
+		assert.Nil(t, err)
+		assert.Equal(t, []Transaction{pending.Transaction}, transactions)
+	})
+	t.Run("It refuses a transaction it can't journal", func(t *testing.T) {
+		// Arrange
+		testChain(t, 1)
+		transaction := testSignedTransfers(t, 0.6)[0]
+		Append(Block{Miner: transaction.Sender, PreviousBlockHash: BlockHashAt(1)})
+		journal, err := OpenMempoolJournal(filepath.Join(t.TempDir(), "mempool.journal"))
+		assert.Nil(t, err)
+		assert.Nil(t, journal.Close())
+		Journal = journal
+		defer func() {
+			Journal = nil
+		}()
+		// Act
+		err = Pool.Accept(transaction)
+		// Assert
+		assert.NotNil(t, err)
+		assert.False(t, Pool.Contains(TransactionHash(transaction)))
+	})
+	t.Run("It drops transactions that are no longer valid when replayed", func(t *testing.T) {
+		// Arrange
+		wd, err := os.Getwd()
+		assert.Nil(t, err)
+		assert.Nil(t, os.Chdir(t.TempDir()))
+		defer func() {
+			_ = os.Chdir(wd)
+		}()
+		journal, err := OpenMempoolJournal(MempoolJournalFile)
+		assert.Nil(t, err)
+		assert.Nil(t, journal.Append(mempoolTestEntry("a", 1, 1, 0).Transaction))
+		assert.Nil(t, journal.Close())
+		Pool = NewMempool()
+		defer func() {
+			_ = Journal.Close()
+			Journal = nil
+		}()
+		// Act
+		LoadMempoolJournal()
+		// Assert
+		assert.Equal(t, 0, Pool.Len())
+		assert.Equal(t, 0, Journal.Len())
+		transactions, err := ReadMempoolJournal(MempoolJournalFile)
+		assert.Nil(t, err)
+		assert.Empty(t, transactions)
+	})
+}
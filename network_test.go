@@ -0,0 +1,190 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworks(t *testing.T) {
+	defer LoadEnv()
+	t.Run("It keeps the testnet genesis block unchanged", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		legacy := Block{
+			Timestamp:              time.Time{},
+			TimeVerifierSignatures: []Signature{},
+			TimeVerifiers:          []PublicKey{},
+		}
+		// Act
+		genesis := GenesisBlock()
+		// Assert
+		assert.Equal(t, "testnet", Network.Name)
+		assert.Equal(t, HashBlock(legacy, 0), HashBlock(genesis, 0))
+	})
+	t.Run("It applies the parameters of the selected network", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		testnetID := NetworkID()
+		// Act
+		err := LoadNetwork("devnet")
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, Network.MinimumBlockDifficulty, MinimumBlockDifficulty)
+		assert.Equal(t, Network.BlocksBeforeReward, BlocksBeforeReward)
+		assert.NotEqual(t, testnetID, NetworkID())
+	})
+	t.Run("It only schedules the latest upgrades from the genesis block on networks without a history", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		testnetKyoto := IsActive(Kyoto, 0)
+		// Act
+		err := LoadNetwork("devnet")
+		// Assert
+		assert.Nil(t, err)
+		assert.False(t, testnetKyoto)
+		assert.True(t, IsActive(Kyoto, 0))
+		assert.True(t, IsActive(Lagos, 0))
+		assert.True(t, IsActive(Oslo, 0))
+	})
+	t.Run("It refuses to load an unknown network", func(t *testing.T) {
+		// Act
+		err := LoadNetwork("moonnet")
+		// Assert
+		assert.NotNil(t, err)
+	})
+	t.Run("It credits genesis allocations", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Network.Genesis.Allocations = []Allocation{{Key: "0102", Amount: 1000}}
+		Blockchain = nil
+		AccountLedger = NewLedger()
+		// Act
+		Append(GenesisBlock())
+		// Assert
+		assert.Equal(t, 1000.0, GetBalance([]byte{1, 2}))
+	})
+	t.Run("It rejects requests from other networks", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		handler := NetworkHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		other := httptest.NewRequest(http.MethodGet, "/info", nil)
+		other.Header.Set(NetworkHeader, "mainnet/0000000000000000")
+		same := httptest.NewRequest(http.MethodGet, "/info", nil)
+		same.Header.Set(NetworkHeader, NetworkID())
+		otherRecorder, sameRecorder, legacyRecorder := httptest.NewRecorder(), httptest.NewRecorder(), httptest.NewRecorder()
+		// Act
+		handler.ServeHTTP(otherRecorder, other)
+		handler.ServeHTTP(sameRecorder, same)
+		handler.ServeHTTP(legacyRecorder, httptest.NewRequest(http.MethodGet, "/info", nil))
+		// Assert
+		assert.Equal(t, http.StatusMisdirectedRequest, otherRecorder.Code)
+		assert.Equal(t, http.StatusOK, sameRecorder.Code)
+		assert.Equal(t, http.StatusOK, legacyRecorder.Code)
+		assert.Equal(t, NetworkID(), sameRecorder.Header().Get(NetworkHeader))
+	})
+	t.Run("It refuses responses from other networks", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		var received string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			received = req.Header.Get(NetworkHeader)
+			w.Header().Set(NetworkHeader, "mainnet/0000000000000000")
+		}))
+		defer server.Close()
+		// Act
+		_, err := PeerClient.Get(server.URL)
+		// Assert
+		assert.True(t, errors.Is(err, ErrWrongNetwork))
+		assert.Equal(t, NetworkID(), received)
+	})
+	t.Run("It accepts responses without a network ID from peers with the same genesis block", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		server := httptest.NewServer(http.HandlerFunc(HandleInfoRequest))
+		defer server.Close()
+		// Act
+		_, err := PeerClient.Get(server.URL + "/info")
+		// Assert
+		assert.Nil(t, err)
+	})
+	t.Run("It refuses responses without a network ID from peers that don't show the same genesis block", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		var infoRequests int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/info" {
+				infoRequests++
+				_, _ = w.Write([]byte(`{"height": 1, "genesis": "00"}`))
+			}
+		}))
+		defer server.Close()
+		// Act
+		_, firstErr := PeerClient.Get(server.URL + "/blockchain")
+		_, secondErr := PeerClient.Get(server.URL + "/headers")
+		// Assert
+		assert.True(t, errors.Is(firstErr, ErrWrongNetwork))
+		assert.True(t, errors.Is(secondErr, ErrWrongNetwork))
+		assert.Equal(t, 1, infoRequests)
+	})
+	t.Run("It only accepts responses from peers without \"/info\" on the legacy network", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+		// Act
+		_, testnetErr := PeerClient.Get(server.URL + "/blockchain")
+		assert.Nil(t, LoadNetwork("devnet"))
+		_, devnetErr := PeerClient.Get(server.URL + "/blockchain")
+		// Assert
+		assert.Nil(t, testnetErr)
+		assert.True(t, errors.Is(devnetErr, ErrWrongNetwork))
+	})
+	t.Run("It only sends the network ID to other nodes", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		var received string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			received = req.Header.Get(NetworkHeader)
+		}))
+		defer server.Close()
+		// Act
+		_, err := http.Get(server.URL)
+		// Assert
+		assert.Nil(t, err)
+		assert.Empty(t, received)
+	})
+	t.Run("It falls back to the seed peers", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Network.SeedPeers = []string{"http://127.0.0.1:9000"}
+		wd, err := os.Getwd()
+		assert.Nil(t, err)
+		assert.Nil(t, os.Chdir(t.TempDir()))
+		defer func() {
+			_ = os.Chdir(wd)
+		}()
+		// Act
+		peers := GetPeers()
+		AddPeer("http://127.0.0.1:9001")
+		// Assert
+		assert.Equal(t, []string{"http://127.0.0.1:9000"}, peers)
+		assert.Equal(t, []string{"http://127.0.0.1:9000", "http://127.0.0.1:9001"}, GetPeers())
+	})
+}
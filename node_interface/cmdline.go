@@ -16,11 +16,14 @@ import (
 	. "cryptocurrency/rollup"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/open-quantum-safe/liboqs-go/oqs"
 )
@@ -50,6 +53,16 @@ var commands = map[string]func([]string){
 	"getBlockchainLen":     GetBlockchainLenCmd,
 	"queryOracle":          QueryOracleCmd,
 	"readSmartContract":    ReadSmartContractCmd,
+	"getTransaction":       GetTransactionCmd,
+	"history":              HistoryCmd,
+	"nonce":                NonceCmd,
+	"cancel":               CancelCmd,
+	"exportChain":          ExportChainCmd,
+	"importChain":          ImportChainCmd,
+	"verifyChain":          VerifyChainCmd,
+	"upgrades":             UpgradesCmd,
+	"generate":             GenerateCmd,
+	"feeEstimate":          FeeEstimateCmd,
 }
 
 func SyncCmd([]string) {
@@ -77,33 +90,102 @@ func BalanceCmd(fields []string) {
 	fmt.Println(fmt.Sprintf("Balance: %f", balance))
 }
 
+// expiresOption removes the "--expires <duration or blocks>" option from a command's fields, and returns the
+// ValidUntil bound it sets, or 0 if it isn't given.
+func expiresOption(fields []string) ([]string, int64, error) {
+	for i, field := range fields {
+		if field != "--expires" {
+			continue
+		}
+		if i+1 >= len(fields) {
+			return nil, 0, errors.New("--expires needs a duration (e.g. 30m) or a number of blocks")
+		}
+		if !NoncesActive(len(Blockchain)) {
+			return nil, 0, errors.New("transactions can't expire before the Kyoto upgrade")
+		}
+		value := fields[i+1]
+		remaining := append(append([]string{}, fields[:i]...), fields[i+2:]...)
+		if blocks, err := strconv.ParseInt(value, 10, 64); err == nil && blocks > 0 {
+			return remaining, int64(len(Blockchain)) + blocks, nil
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return nil, 0, fmt.Errorf("invalid expiry %q", value)
+		}
+		return remaining, ExpiryAfter(duration), nil
+	}
+	return fields, 0, nil
+}
+
+// tipOption removes the "--tip <amount>" option from a command's fields, and returns the tip it sets, or 0 if it isn't
+// given.
+func tipOption(fields []string) ([]string, float64, error) {
+	for i, field := range fields {
+		if field != "--tip" {
+			continue
+		}
+		if i+1 >= len(fields) {
+			return nil, 0, errors.New("--tip needs an amount (see feeEstimate)")
+		}
+		if !NoncesActive(len(Blockchain)) {
+			return nil, 0, errors.New("transactions can't have tips before the Kyoto upgrade")
+		}
+		tip, err := strconv.ParseFloat(fields[i+1], 64)
+		if err != nil || tip < 0 || math.IsNaN(tip) || math.IsInf(tip, 0) {
+			return nil, 0, fmt.Errorf("invalid tip %q", fields[i+1])
+		}
+		return append(append([]string{}, fields[:i]...), fields[i+2:]...), tip, nil
+	}
+	return fields, 0, nil
+}
+
 func SendCmd(fields []string) {
+	fields, validUntil, err := expiresOption(fields)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fields, tip, err := tipOption(fields)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	receiverStrFields := fields[1 : len(fields)-1]
 	receiverStr := strings.Join(receiverStrFields, " ")
 	var receiver []byte
-	err := json.Unmarshal([]byte(receiverStr), &receiver)
+	err = json.Unmarshal([]byte(receiverStr), &receiver)
 	if err != nil {
 		panic(err)
 	}
 	amount := fields[len(fields)-1]
 	var transactionBody []byte
-	Send(string(receiver), amount, transactionBody)
+	Send(string(receiver), amount, transactionBody, validUntil, tip)
 	Log("Waiting for all workers to finish", true)
 	Wg.Wait()
 	Log("All workers have finished", true)
 }
 
 func SendWithBodyCmd(fields []string) {
+	fields, validUntil, err := expiresOption(fields)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fields, tip, err := tipOption(fields)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	receiverStrFields := fields[2 : len(fields)-1]
 	receiverStr := strings.Join(receiverStrFields, " ")
 	var receiver []byte
-	err := json.Unmarshal([]byte(receiverStr), &receiver)
+	err = json.Unmarshal([]byte(receiverStr), &receiver)
 	if err != nil {
 		panic(err)
 	}
 	amount := fields[len(fields)-1]
 	transactionBody := []byte(fields[1])
-	Send(string(receiver), amount, transactionBody)
+	Send(string(receiver), amount, transactionBody, validUntil, tip)
 	Log("Waiting for all workers to finish", true)
 	Wg.Wait()
 	Log("All workers have finished", true)
@@ -147,7 +229,17 @@ func RunSmartContractCmd(fields []string) {
 	}
 }
 
-func KeygenCmd([]string) {
+// KeygenCmd generates a new key pair and saves it to key.json.
+//
+// An existing key is never overwritten unless the "--overwrite" flag is passed, since it may hold funds.
+func KeygenCmd(fields []string) {
+	overwrite := len(fields) > 1 && fields[1] == "--overwrite"
+	if _, err := os.Stat("key.json"); err == nil && !overwrite {
+		fmt.Println("A key already exists in key.json. Run \"keygen --overwrite\" to replace it. The existing key will be lost.")
+		return
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		panic(err)
+	}
 	var privateKey PrivateKey
 	sigName := "Dilithium3"
 	signer := oqs.Signature{}
@@ -167,7 +259,7 @@ func KeygenCmd([]string) {
 	if err != nil {
 		panic(err)
 	}
-	err = os.WriteFile("key.json", keyJson, 0644)
+	err = WriteFileAtomic("key.json", keyJson, 0600)
 	if err != nil {
 		panic(err)
 	}
@@ -204,21 +296,16 @@ func DecryptCmd([]string) {
 	DecryptKey(password)
 }
 
+// SaveStateCmd saves the blockchain to the block store.
+//
+// Blocks are written to the store as they are appended, so this only rewrites blocks that differ from the stored chain.
 func SaveStateCmd([]string) {
-	blockchainJson, err := json.Marshal(Blockchain)
-	// Save the blockchain to a file
-	if err != nil {
-		panic(err)
-	}
-	err = os.WriteFile("blockchain.json", blockchainJson, 0644)
-	if err != nil {
-		panic(err)
-	}
+	SaveBlockchain()
 }
 
-// LoadStateCmd loads the blockchain from a file.
+// LoadStateCmd loads the blockchain from the block store.
 //
-// It reads the content of the "blockchain.json" file and unmarshals it into the Blockchain variable.
+// If the block store is empty, a legacy "blockchain.json" file is imported into it first.
 // If any error occurs during the process, it panics.
 //
 // Parameters:
@@ -226,20 +313,12 @@ func SaveStateCmd([]string) {
 //
 // Return type: none.
 func LoadStateCmd([]string) {
-	// Load the blockchain from a file
-	blockchainJson, err := os.ReadFile("blockchain.json")
-	if err != nil {
-		panic(err)
-	}
-	err = json.Unmarshal(blockchainJson, &Blockchain)
-	if err != nil {
-		panic(err)
-	}
+	LoadBlockchain()
 }
 
 func AddPeerCmd(fields []string) {
 	// Add the peer to the local peer list
-	AddPeer("http://" + fields[1] + ":8080\n")
+	AddPeer("http://" + fields[1] + ":8080")
 	// Add the peer to the peer's peer list
 	peerServer := fields[1]
 	localIp := fields[2]
@@ -248,7 +327,7 @@ func AddPeerCmd(fields []string) {
 	if err != nil {
 		panic(err)
 	}
-	_, err = http.DefaultClient.Do(req)
+	_, err = PeerClient.Do(req)
 	if err != nil {
 		panic(err)
 	}
@@ -281,15 +360,25 @@ func HelpCmd([]string) {
 	fmt.Println("help - Display this help menu")
 	fmt.Println("license - Display this software's license (GNU GPL v3)")
 	fmt.Println("sync - Sync the blockchain with peers")
-	fmt.Println("keygen - Generate a new key")
+	fmt.Println("keygen [--overwrite] - Generate a new key (pass --overwrite to replace an existing key)")
 	fmt.Println("showPublicKey - Print your public key")
 	fmt.Println("encrypt - Encrypt your keys for extra security")
 	fmt.Println("decrypt - Decrypt your keys so you can use them")
-	fmt.Println("send <public key> <amount> - Send an amount to a public key")
+	fmt.Println("send <public key> <amount> [--expires <duration or blocks>] [--tip <amount>] - Send an amount to a public key, optionally dropping the transaction if it isn't mined in time, or tipping the miner to have it mined sooner")
 	fmt.Println("sendL2 <public key> <amount> - Send an amount to a public key via L2 rollups (alpha)")
 	fmt.Println("balance <public key> - Get the balance of a public key")
-	fmt.Println("savestate - Save the blockchain to a file")
-	fmt.Println("loadstate - Load the blockchain from a file")
+	fmt.Println("getTransaction <hash> - Look up a transaction by its hash")
+	fmt.Println("history <public key> - List the transactions sent and received by a public key")
+	fmt.Println("nonce <public key> - Get the nonce of the last mined transaction from a public key, and the next nonce to use")
+	fmt.Println("cancel <hash> - Cancel a pending transaction you sent, by replacing it with a higher-fee transaction to yourself")
+	fmt.Println("savestate - Save the blockchain to the block store")
+	fmt.Println("loadstate - Load the blockchain from the block store")
+	fmt.Println("exportChain <path> - Export the blockchain to a binary file")
+	fmt.Println("importChain <path> - Verify and import a blockchain exported with exportChain")
+	fmt.Println("verifyChain [from] [to] - Replay the blockchain and re-verify the blocks from height from up to to")
+	fmt.Println("generate <n> - Mine n blocks from the pending transactions instantly (regtest only)")
+	fmt.Println("feeEstimate [bytes] - Show the base fee of the next block, and recommend tips for a transaction of the given size")
+	fmt.Println("upgrades - List the network upgrades and whether each is active, pending or disabled on this network")
 	fmt.Println("deploySmartContract <blockasm path> - Deploy a smart contract to the blockchain")
 	fmt.Println("addPeer <ip> - Connect to a peer")
 	fmt.Println("startAnalysisConsole - Start a specialized console for analyzing the blockchain and network")
@@ -314,7 +403,7 @@ func GetNthBlockCmd(fields []string) {
 	if len(Blockchain)-1 < n || n < 0 {
 		panic("Block out of range")
 	}
-	block := Blockchain[n]
+	block := BlockAt(n)
 	property := fields[2]
 	switch property {
 	case "hash":
@@ -338,7 +427,7 @@ func GetNthTransactionCmd(fields []string) {
 	if err != nil {
 		panic(err)
 	}
-	block := Blockchain[blockPos]
+	block := BlockAt(int(blockPos))
 	tx := ExtractTransactions(block)[txPos]
 	property := fields[3]
 	switch property {
@@ -353,6 +442,108 @@ func GetNthTransactionCmd(fields []string) {
 	}
 }
 
+func GetTransactionCmd(fields []string) {
+	hashBytes, err := hex.DecodeString(fields[1])
+	if err != nil || len(hashBytes) != 32 {
+		fmt.Println("Invalid transaction hash", fields[1])
+		return
+	}
+	transaction, location, ok := GetTransaction([32]byte(hashBytes))
+	if !ok {
+		fmt.Println("Transaction not found")
+		return
+	}
+	recordJson, err := json.MarshalIndent(NewTransactionRecord(transaction, location), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(recordJson))
+}
+
+func HistoryCmd(fields []string) {
+	var key []byte
+	if len(fields) == 1 {
+		key = GetKey("").PublicKey.Y
+	} else {
+		keyStr := strings.Join(fields[1:], " ")
+		err := json.Unmarshal([]byte(keyStr), &key)
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, record := range GetHistory(key) {
+		direction := "received"
+		if record.Sent && record.Received {
+			direction = "self"
+		} else if record.Sent {
+			direction = "sent"
+		}
+		fmt.Printf("%s %s %f (block %d, %d confirmations)\n", record.Hash, direction, record.Amount, record.BlockHeight, record.Confirmations)
+	}
+}
+
+// NonceCmd prints the nonce of the last mined transaction from a public key, and the nonce its next transaction should use.
+func NonceCmd(fields []string) {
+	var key []byte
+	if len(fields) == 1 {
+		key = GetKey("").PublicKey.Y
+	} else {
+		keyStr := strings.Join(fields[1:], " ")
+		err := json.Unmarshal([]byte(keyStr), &key)
+		if err != nil {
+			panic(err)
+		}
+	}
+	fmt.Printf("Last nonce: %d\n", AccountNonce(key))
+	fmt.Printf("Next nonce: %d\n", FetchNextNonce(key))
+}
+
+// CancelCmd replaces a pending transaction with a zero-value transaction to the sender.
+func CancelCmd(fields []string) {
+	if len(fields) < 2 {
+		fmt.Println("Usage: cancel <hash>")
+		return
+	}
+	hashBytes, err := hex.DecodeString(fields[1])
+	if err != nil || len(hashBytes) != 32 {
+		fmt.Println("Invalid transaction hash", fields[1])
+		return
+	}
+	if err = CancelTransaction([32]byte(hashBytes)); err != nil {
+		fmt.Println("Couldn't cancel transaction:", err)
+		return
+	}
+	Log("Waiting for all workers to finish", true)
+	Wg.Wait()
+	Log("Cancellation sent to peers", false)
+}
+
+// ExportChainCmd writes the blockchain to a file in the binary chain export format.
+func ExportChainCmd(fields []string) {
+	if len(fields) < 2 {
+		fmt.Println("Usage: exportChain <path>")
+		return
+	}
+	if err := ExportChain(fields[1]); err != nil {
+		fmt.Println("Failed to export chain:", err)
+		return
+	}
+	Log(fmt.Sprintf("Exported %d blocks to %s.", len(Blockchain), fields[1]), false)
+}
+
+// ImportChainCmd replaces the blockchain with a chain export, after verifying every block in it.
+func ImportChainCmd(fields []string) {
+	if len(fields) < 2 {
+		fmt.Println("Usage: importChain <path>")
+		return
+	}
+	if err := ImportChain(fields[1]); err != nil {
+		fmt.Println("Failed to import chain:", err)
+		return
+	}
+	Log(fmt.Sprintf("Imported %d blocks from %s.", len(Blockchain), fields[1]), false)
+}
+
 func StartAnalysisConsoleCmd([]string) {
 	StartAnalysisCmdline()
 }
@@ -433,3 +624,90 @@ func StartCmdLine() {
 		RunCmd(cmd)
 	}
 }
+
+// VerifyChainCmd replays the blockchain from the genesis block, verifying each block in a range of heights at its own
+// height, and prints every block that fails with the reasons why.
+func VerifyChainCmd(fields []string) {
+	from, to := 0, len(Blockchain)
+	var err error
+	if len(fields) > 1 {
+		if from, err = strconv.Atoi(fields[1]); err != nil {
+			fmt.Println("Usage: verifyChain [from] [to]")
+			return
+		}
+	}
+	if len(fields) > 2 {
+		if to, err = strconv.Atoi(fields[2]); err != nil {
+			fmt.Println("Usage: verifyChain [from] [to]")
+			return
+		}
+	}
+	if to > len(Blockchain) {
+		to = len(Blockchain)
+	}
+	if Conn == nil && !Regtest {
+		// ZK proofs are verified by the VM
+		listener := EstablishConnection()
+		defer CloseConnection(listener)
+	}
+	failures, err := AuditChain(from, to)
+	if err != nil {
+		fmt.Println("Failed to verify chain:", err)
+		return
+	}
+	for _, failure := range failures {
+		fmt.Println(failure)
+	}
+	Log(fmt.Sprintf("Verified blocks %d to %d: %d invalid.", from, to, len(failures)), false)
+}
+
+// UpgradesCmd prints every registered network upgrade, with its activation height and whether it applies to the next
+// block on the current network.
+func UpgradesCmd([]string) {
+	height := len(Blockchain)
+	fmt.Printf("Network: %s, next block: %d\n", Env.Network, height)
+	for _, upgrade := range UpgradeRegistry {
+		activation := "-"
+		if activationHeight, ok := ActivationHeight(upgrade.Name); ok {
+			activation = strconv.Itoa(activationHeight)
+		}
+		fmt.Printf("%-12s %-8s %-8s %s\n", upgrade.Name, activation, UpgradeStatus(upgrade.Name, height), upgrade.Description)
+	}
+}
+
+// GenerateCmd mines blocks instantly in regtest mode, and broadcasts them to peers.
+func GenerateCmd(fields []string) {
+	n := 1
+	if len(fields) > 1 {
+		var err error
+		if n, err = strconv.Atoi(fields[1]); err != nil || n < 1 {
+			fmt.Println("Usage: generate <n>")
+			return
+		}
+	}
+	blocks, err := Generate(n)
+	if err != nil {
+		fmt.Println("Failed to generate blocks:", err)
+	}
+	Log(fmt.Sprintf("Generated %d blocks. Blockchain height: %d.", len(blocks), len(Blockchain)), false)
+}
+
+// FeeEstimateCmd prints the base fee of the next block, and the tips recommended for a transaction of the size given
+// in bytes (the median size of recent transactions by default).
+func FeeEstimateCmd(fields []string) {
+	estimate := EstimateFees()
+	size := estimate.TransactionSize
+	if len(fields) > 1 {
+		var err error
+		if size, err = strconv.Atoi(fields[1]); err != nil || size < 1 {
+			fmt.Println("Usage: feeEstimate [bytes]")
+			return
+		}
+	}
+	if !FeeMarketActive(len(Blockchain)) {
+		fmt.Println("The fee market isn't active yet, so fees are fixed and paid to the miner.")
+	}
+	fmt.Printf("Base fee: %v\n", estimate.BaseFee)
+	slow, standard, fast := estimate.Tip(size)
+	fmt.Printf("Recommended tips for a %d byte transaction: %v (slow), %v (standard), %v (fast)\n", size, slow, standard, fast)
+}
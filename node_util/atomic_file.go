@@ -0,0 +1,187 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Overview
+// Persistent files are never written in place. The new contents are written to "<path>.tmp" and synced, the
+// temporary file is renamed over the original, and the directory is synced so the rename itself is durable.
+// A crash therefore leaves either the old file or the new one, plus possibly a leftover temporary file, which
+// RecoverPersistentFiles cleans up on startup.
+
+const tempFileSuffix = ".tmp"
+const corruptFileSuffix = ".corrupt"
+
+// WriteFileAtomic replaces the contents of a file so that a crash leaves either the old or the new contents.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return WriteFileAtomicFunc(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteFileAtomicFunc is like WriteFileAtomic, but streams the new contents from a write function.
+//
+// If the write function fails, the original file is left untouched.
+func WriteFileAtomicFunc(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	tempPath := path + tempFileSuffix
+	file, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err = os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RecoverFile cleans up after an interrupted write to a file.
+//
+// The repair function checks the contents of the file, returning the contents to keep and whether they are usable.
+// If the original file is missing or unusable, a complete temporary file left by WriteFileAtomic takes its place.
+// A file that still can't be used is moved aside to "<path>.corrupt", so nothing is ever deleted that might be
+// needed to recover it by hand.
+func RecoverFile(path string, repair func(data []byte) ([]byte, bool)) {
+	tempPath := path + tempFileSuffix
+	tempData, tempErr := os.ReadFile(tempPath)
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		panic(err)
+	}
+	exists := err == nil
+	repaired, ok := []byte(nil), false
+	if exists {
+		repaired, ok = repair(data)
+	}
+	if tempErr == nil {
+		if !ok {
+			if tempRepaired, tempOk := repair(tempData); tempOk {
+				Warn(fmt.Sprintf("Recovering %s from an interrupted write.", path))
+				if exists {
+					moveAside(path)
+				}
+				if err = WriteFileAtomic(path, tempRepaired, 0600); err != nil {
+					panic(err)
+				}
+				return
+			}
+		}
+		Warn(fmt.Sprintf("Discarding an interrupted write to %s.", path))
+		moveAside(tempPath)
+	}
+	if !exists {
+		return
+	}
+	if !ok {
+		Warn(fmt.Sprintf("%s is corrupt. Moving it to %s.", path, path+corruptFileSuffix))
+		moveAside(path)
+		return
+	}
+	if !bytes.Equal(repaired, data) {
+		Warn(fmt.Sprintf("Repairing %s.", path))
+		if err = WriteFileAtomic(path, repaired, 0600); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func moveAside(path string) {
+	if err := os.Rename(path, path+corruptFileSuffix); err != nil {
+		panic(err)
+	}
+}
+
+// repairKey accepts key.json if it holds a complete key, or anything that could be an encrypted key.
+func repairKey(data []byte) ([]byte, bool) {
+	if bytes.HasPrefix(data, []byte(`"{'Y':`)) {
+		var key PrivateKey
+		return data, json.Unmarshal(data, &key) == nil && len(key.PublicKey.Y) > 0
+	}
+	// Encrypted keys hold at least a 12 byte nonce and a 16 byte authentication tag.
+	return data, len(data) >= 28
+}
+
+// repairPeers drops any lines of peers.txt that aren't peer addresses, such as a line cut off by a crash.
+func repairPeers(data []byte) ([]byte, bool) {
+	var peers []string
+	dropped := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !IsPeerAddress(line) {
+			dropped = true
+			continue
+		}
+		peers = append(peers, line)
+	}
+	if !dropped {
+		return data, true
+	}
+	return []byte(FormatPeers(peers)), true
+}
+
+// repairJson accepts any file that holds valid JSON.
+func repairJson(data []byte) ([]byte, bool) {
+	return data, json.Valid(data)
+}
+
+// IsPeerAddress reports whether a string is a usable peer address, such as "http://127.0.0.1:8080".
+func IsPeerAddress(address string) bool {
+	parsed, err := url.Parse(address)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// RecoverPersistentFiles checks the node's persistent files on startup, recovering from interrupted writes.
+func RecoverPersistentFiles() {
+	RecoverFile("key.json", repairKey)
+	RecoverFile("peers.txt", repairPeers)
+	RecoverFile(pruneSnapshotPath(), repairJson)
+	RecoverFile(MempoolJournalFile, repairJournal)
+}
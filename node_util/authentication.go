@@ -51,7 +51,7 @@ func RequestAuthentication(peerIp string) (PublicKey, bool, error) {
 	if err != nil {
 		return PublicKey{}, false, err
 	}
-	res, err := http.DefaultClient.Do(req)
+	res, err := PeerClient.Do(req)
 	if err != nil {
 		return PublicKey{}, false, err
 	}
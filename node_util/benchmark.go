@@ -7,7 +7,7 @@ import (
 
 // Benchmark is a function that performs a benchmark by creating transactions, creating a block, and measuring the time it takes.
 //
-// It creates two transactions using the GetKey function to get the public key of the sender and recipient. The transactions have a zero amount, a zero sender signature, a timestamp of the current time, no contracts, no body, no body signatures, and a flag indicating that it is not from a smart contract. The transactions are appended to the MiningTransactions slice.
+// It creates two transactions using the GetKey function to get the public key of the sender and recipient. The transactions have a zero amount, a zero sender signature, a timestamp of the current time, no contracts, no body, no body signatures, and a flag indicating that it is not from a smart contract. The transactions are added to the mempool.
 //
 // It then starts a timer using the time.Now function.
 //
@@ -36,7 +36,9 @@ func Benchmark() {
 			BodySignatures:    nil,
 			FromSmartContract: false,
 		}
-		MiningTransactions = append(MiningTransactions, transaction)
+		if err := Pool.Add(NewMempoolEntry(transaction, nil, StateTransition{})); err != nil {
+			panic(err)
+		}
 	}
 	// Start timer
 	start := time.Now()
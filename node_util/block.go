@@ -9,6 +9,8 @@ You should have received a copy of the GNU General Public License along with thi
 package node_util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strconv"
@@ -54,6 +56,87 @@ type Transaction struct {
 	FromSmartContract bool
 	Body              []byte
 	BodySignatures    []Signature
+	Nonce             uint64   // The sender's transaction count, including this transaction (0 before the Kyoto upgrade)
+	Tip               float64  // Paid to the miner on top of the fees, so the transaction is mined sooner
+	Replaces          [32]byte // Hash of a pending transaction this one replaces, if any
+	ValidAfter        int64    // The transaction can't be mined before this height or time, if set (see expiry.go)
+	ValidUntil        int64    // The transaction can't be mined after this height or time, if set
+}
+
+// TransactionExtensions returns the fields added to transactions by network upgrades, in order.
+//
+// Trailing fields that aren't set are left out, so transactions without them serialize, hash and sign exactly as
+// they did before the upgrades.
+func TransactionExtensions(transaction Transaction) []string {
+	fields := []string{
+		strconv.FormatUint(transaction.Nonce, 10),
+		strconv.FormatFloat(transaction.Tip, 'f', -1, 64),
+		"0",
+		strconv.FormatInt(transaction.ValidAfter, 10),
+		strconv.FormatInt(transaction.ValidUntil, 10),
+	}
+	if transaction.Replaces != [32]byte{} {
+		fields[2] = hex.EncodeToString(transaction.Replaces[:])
+	}
+	for len(fields) > 0 && fields[len(fields)-1] == "0" {
+		fields = fields[:len(fields)-1]
+	}
+	return fields
+}
+
+// setTransactionExtensions parses the fields returned by TransactionExtensions.
+func setTransactionExtensions(transaction *Transaction, fields []string) error {
+	var err error
+	if len(fields) > 0 {
+		if transaction.Nonce, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 1 {
+		if transaction.Tip, err = strconv.ParseFloat(fields[1], 64); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 2 && fields[2] != "0" {
+		replaces, err := hex.DecodeString(fields[2])
+		if err != nil || len(replaces) != 32 {
+			return fmt.Errorf("invalid replaced transaction hash %q", fields[2])
+		}
+		transaction.Replaces = [32]byte(replaces)
+	}
+	if len(fields) > 3 {
+		if transaction.ValidAfter, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+			return err
+		}
+	}
+	if len(fields) > 4 {
+		if transaction.ValidUntil, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TransactionHash returns the hash that identifies a transaction.
+//
+// It is the sha256 hash of the sender, recipient, amount, timestamp and any extension fields, separated by colons (see docs/definitions/transaction.md).
+func TransactionHash(transaction Transaction) [32]byte {
+	transactionString := fmt.Sprintf("%s:%s:%f:%d", EncodePublicKey(transaction.Sender), EncodePublicKey(transaction.Recipient), transaction.Amount, transaction.Timestamp.UnixNano())
+	for _, field := range TransactionExtensions(transaction) {
+		transactionString += ":" + field
+	}
+	return sha256.Sum256([]byte(transactionString))
+}
+
+// TransactionSigningHash returns the hash a transaction's sender signs.
+//
+// It is the sha256 hash of the raw sender and recipient keys, amount, timestamp and any extension fields, separated by colons.
+func TransactionSigningHash(transaction Transaction) [32]byte {
+	transactionString := fmt.Sprintf("%s:%s:%s:%d", transaction.Sender.Y, transaction.Recipient.Y, strconv.FormatFloat(transaction.Amount, 'f', -1, 64), transaction.Timestamp.UnixNano())
+	for _, field := range TransactionExtensions(transaction) {
+		transactionString += ":" + field
+	}
+	return sha256.Sum256([]byte(transactionString))
 }
 
 func (i Transaction) MarshalJSON() ([]byte, error) {
@@ -86,6 +169,9 @@ func (i Transaction) MarshalJSON() ([]byte, error) {
 	}
 	bodySignatures := string(bodySignaturesBytes)
 	result := []byte(EncodePublicKey(i.Sender) + "^" + EncodePublicKey(i.Recipient) + "^" + fmt.Sprintf("%f", i.Amount) + "^" + signature + "^" + strconv.FormatInt(i.Timestamp.UnixNano(), 10) + "^" + contracts + "^" + strconv.FormatBool(i.FromSmartContract) + "^" + string(bodyBytes) + "^" + bodySignatures)
+	for _, field := range TransactionExtensions(i) {
+		result = append(result, []byte("^"+field)...)
+	}
 	result = []byte(strings.Replace(string(result), `"`, "", -1))
 	result = []byte(`"` + string(result) + `"`)
 	return result, nil
@@ -143,6 +229,9 @@ func (i *Transaction) UnmarshalJSON(data []byte) error {
 		}
 		bodySignatures = append(bodySignatures, bodySignature)
 	}
+	if len(parts) > 9 {
+		return setTransactionExtensions(i, parts[9:])
+	}
 	return nil
 }
 
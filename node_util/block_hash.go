@@ -87,8 +87,9 @@ type PreZenBlock struct {
 
 func HashBlock(block Block, blockHeight int) [64]byte {
 	// Automatically downgrades to older block formats if necessary
-	if Env.Upgrades.Washington < blockHeight {
-		if Env.Upgrades.Zen < blockHeight && Env.Upgrades.Zen != -1 {
+	// The Washington and Zen block formats start with the block after the upgrade's height
+	if IsActive(Washington, blockHeight-1) {
+		if IsActive(Zen, blockHeight-1) {
 			var blockCpy Block
 			marshaled, err := json.Marshal(block)
 			if err != nil {
@@ -0,0 +1,89 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"fmt"
+	"math"
+)
+
+// Overview
+// From the Lagos upgrade, a block's transactions (including those created by smart contracts) are limited in total
+// encoded size, total contract gas and number. The limits are set by the network's params.json, and blocks that go
+// past any of them are invalid. The miner packs the highest-priority transactions that fit, and leaves the rest in
+// the mempool for later blocks. Transactions that could never fit in a block are refused by the mempool.
+// Before Lagos, blocks have no size or gas limit, and the miner only caps the number of transactions.
+// A contract's gas usage is reported by the block, and only checked by re-executing the contract before the Zen
+// upgrade. After Zen, the ZK proof doesn't cover it, so the gas limit isn't enforced, and blocks are only limited in
+// size and number of transactions.
+
+// BlockUsage is how much of a block's capacity some transactions take up. It is also used for the limits themselves.
+type BlockUsage struct {
+	Bytes        int
+	Gas          float64
+	Transactions int
+}
+
+// Add returns the usage of both sets of transactions.
+func (u BlockUsage) Add(other BlockUsage) BlockUsage {
+	return BlockUsage{
+		Bytes:        u.Bytes + other.Bytes,
+		Gas:          u.Gas + other.Gas,
+		Transactions: u.Transactions + other.Transactions,
+	}
+}
+
+// Within reports whether the usage is within every one of the limits.
+func (u BlockUsage) Within(limits BlockUsage) bool {
+	return u.Bytes <= limits.Bytes && u.Gas <= limits.Gas && u.Transactions <= limits.Transactions
+}
+
+// MeasureTransactions returns the usage of a block's transactions.
+func MeasureTransactions(transactions []Transaction) BlockUsage {
+	usage := BlockUsage{Transactions: len(transactions)}
+	for _, transaction := range transactions {
+		usage.Bytes += len(EncodeTransaction(transaction))
+		for _, contract := range transaction.Contracts {
+			usage.Gas += contract.GasUsed
+		}
+	}
+	return usage
+}
+
+// BlockLimits returns the network's limits for a block at a height. After the Zen upgrade, gas is unlimited.
+func BlockLimits(height int) BlockUsage {
+	limits := BlockUsage{Bytes: MaxBlockBytes, Gas: MaxBlockGas, Transactions: MaxBlockTransactions}
+	if IsActive(Zen, height) {
+		limits.Gas = math.Inf(1)
+	}
+	return limits
+}
+
+// BlockLimitsActive reports whether blocks at a height are limited by BlockLimits.
+func BlockLimitsActive(height int) bool {
+	return IsActive(Lagos, height)
+}
+
+// CheckBlockLimits checks that the transactions of a block at the given height are within the block limits, and
+// returns which limit they go past, or nil if they are within them.
+func CheckBlockLimits(transactions []Transaction, height int) *ValidationError {
+	if !BlockLimitsActive(height) {
+		return nil
+	}
+	usage, limits := MeasureTransactions(transactions), BlockLimits(height)
+	switch {
+	case usage.Bytes > limits.Bytes:
+		return NewValidationError(ReasonExceedsBlockLimits, fmt.Sprintf("transactions take %d bytes, the limit is %d", usage.Bytes, limits.Bytes))
+	case usage.Gas > limits.Gas:
+		return NewValidationError(ReasonExceedsBlockLimits, fmt.Sprintf("contracts use %v gas, the limit is %v", usage.Gas, limits.Gas))
+	case usage.Transactions > limits.Transactions:
+		return NewValidationError(ReasonExceedsBlockLimits, fmt.Sprintf("%d transactions, the limit is %d", usage.Transactions, limits.Transactions))
+	}
+	return nil
+}
@@ -14,14 +14,15 @@ func CalculateBlockReward(minerCount int64, blockHeight int) float64 {
 	// The more miners, the less reward
 	// This is designed to prevent miners from forking their hash power to get more rewards
 	p := 0.95
-	if Env.Upgrades.Guadalajara <= blockHeight {
+	if IsActive(Guadalajara, blockHeight) {
 		p = 0.99
 	}
 	var reward float64
-	if Env.Upgrades.Alexandria > blockHeight {
+	if !IsActive(Alexandria, blockHeight) {
 		reward = math.Pow(p, float64(minerCount))
 	} else {
-		years := (blockHeight - Env.Upgrades.Alexandria) / 31536000
+		alexandria, _ := ActivationHeight(Alexandria)
+		years := (blockHeight - alexandria) / 31536000
 		reward = math.Pow(p, float64(minerCount)) * math.Pow(5, float64(years)) // Block reward multiplies by a constant (5) every year. This will prevent a limited supply.
 	}
 	return reward
@@ -9,32 +9,49 @@ You should have received a copy of the GNU General Public License along with thi
 package node_util
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 )
 
 var Blockchain []Block
 
-// GenesisBlock returns a new genesis block.
+// GenesisBlock returns the genesis block of the network the node is on (see network.go).
 //
 // It returns a Block struct with the following fields:
-// - Transactions: a slice of Transaction structs (nil)
+// - Transactions: the network's initial allocations, as transactions with no sender (nil if there are none)
 // - Miner: a PublicKey struct
 // - Nonce: an int64 with value 0
 // - MiningTime: an int64 with value 0
 // - Difficulty: an uint64 with value 0
 // - PreviousBlockHash: a [64]byte array with all elements set to 0
-// - Timestamp: a time.Time struct with the zero value
+// - Timestamp: the network's genesis timestamp
 // - TimeVerifierSignatures: a slice of Signature structs (empty)
 // - TimeVerifiers: a slice of PublicKey structs (empty)
 func GenesisBlock() Block {
+	var allocations []Transaction
+	for _, allocation := range Network.Genesis.Allocations {
+		key, err := hex.DecodeString(allocation.Key)
+		if err != nil {
+			panic(err)
+		}
+		allocations = append(allocations, Transaction{
+			Recipient: PublicKey{Y: key},
+			Amount:    allocation.Amount,
+		})
+	}
 	return Block{
-		LegacyTransactions:     nil,
+		LegacyTransactions:     allocations,
 		Miner:                  PublicKey{},
 		Nonce:                  0,
 		MiningTime:             0,
 		Difficulty:             0,
 		PreviousBlockHash:      [64]byte{},
-		Timestamp:              time.Time{},
+		Timestamp:              Network.Genesis.Timestamp,
 		TimeVerifierSignatures: []Signature{},
 		TimeVerifiers:          []PublicKey{},
 	}
@@ -43,7 +60,314 @@ func GenesisBlock() Block {
 // Append adds a new block to the blockchain.
 //
 // It takes a single parameter, `block`, of type `Block`, which represents the block to be appended to the blockchain.
-// This function does not return any value.
-func Append(block Block) {
-	Blockchain = append(Blockchain, block)
+// If the block store is open, the block is written to disk first, and only its header is kept in memory.
+// On a pruned node, old blocks are pruned once enough blocks have been appended since the last prune.
+// It returns an error, and leaves the blockchain unchanged, if the block can't be written to the block store.
+func Append(block Block) error {
+	if Store != nil {
+		if err := storeBlock(block, len(Blockchain)); err != nil {
+			return err
+		}
+		Blockchain = append(Blockchain, BlockHeader(block))
+	} else {
+		Blockchain = append(Blockchain, block)
+	}
+	ChainState.Update()
+	AccountLedger.Update()
+	TxIndex.Update()
+	Pool.RemoveIncluded(block)
+	Pool.RemoveExpired(len(Blockchain), time.Now())
+	PruneJournal()
+	if PruneMode && len(Blockchain)-(BlocksUntilFinality+PruneMargin)-PrunedHeight >= PruneInterval {
+		PruneBlockchain(len(Blockchain) - (BlocksUntilFinality + PruneMargin))
+	}
+	return nil
+}
+
+// storeBlock writes a block to the block store, and its header to the header store.
+//
+// If the header can't be written, the block is removed from the block store again, so the two stay the same length.
+func storeBlock(block Block, height int) error {
+	if err := Store.Append(block, height); err != nil {
+		return err
+	}
+	if HeaderStore != nil {
+		hash, _ := Store.HashAt(height)
+		if err := HeaderStore.AppendWithHash(BlockHeader(block), height, hash); err != nil {
+			if truncateErr := Store.Truncate(height); truncateErr != nil {
+				return errors.Join(err, truncateErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// BlockAt returns the block at the given height, including its transactions, state transition and proof.
+//
+// When the block store is open, the blockchain only holds block headers, and the rest of each block is read from the
+// store when it is needed (the store keeps the most recently read blocks cached). Pruned blocks only have a header.
+func BlockAt(height int) Block {
+	return readBlock(Store, Blockchain, height)
+}
+
+// BlocksAt returns the blocks in a range of heights, including their transactions.
+func BlocksAt(from int, to int) []Block {
+	blocks := make([]Block, 0, to-from)
+	for height := from; height < to; height++ {
+		blocks = append(blocks, BlockAt(height))
+	}
+	return blocks
+}
+
+// readBlock returns the block at a height of a chain whose blocks are kept in a block store.
+func readBlock(store *BlockStore, chain []Block, height int) Block {
+	block, ok := storedBlock(store, chain, height)
+	if !ok {
+		return chain[height]
+	}
+	return block
+}
+
+// storedBlock reads the block at a height of a chain from a block store. It reports false if the block has been
+// pruned, or if the chain was changed without going through Append and holds a block that isn't in the store.
+func storedBlock(store *BlockStore, chain []Block, height int) (Block, bool) {
+	if store == nil || height < PrunedHeight || height >= store.Len() {
+		return Block{}, false
+	}
+	block, err := store.Get(height)
+	if errors.Is(err, ErrBlockPruned) {
+		return Block{}, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	return block, SameBlock(block, chain[height])
+}
+
+// TruncateBlockchain removes every block at or above the given height from the blockchain and the block store.
+//
+// Transactions in the removed blocks are put back into the mempool, so they can be mined again.
+func TruncateBlockchain(height int) {
+	if height >= len(Blockchain) {
+		return
+	}
+	if height < PrunedHeight {
+		panic(fmt.Sprintf("cannot truncate the blockchain to height %d, below the pruned height %d", height, PrunedHeight))
+	}
+	var removed []Transaction
+	for _, block := range BlocksAt(height, len(Blockchain)) {
+		removed = append(removed, ExtractTransactions(block)...)
+	}
+	Blockchain = Blockchain[:height]
+	if Store != nil {
+		if err := Store.Truncate(height); err != nil {
+			panic(err)
+		}
+	}
+	if HeaderStore != nil {
+		if err := HeaderStore.Truncate(height); err != nil {
+			panic(err)
+		}
+	}
+	ChainState.Rollback(height)
+	AccountLedger.Rollback(height)
+	TxIndex.Rollback(height)
+	Pool.Reinject(removed)
+}
+
+// ReplaceBlockchain replaces the local blockchain with another chain.
+//
+// Blocks shared by both chains are kept, so only the blocks after the fork point are rewritten in the block store.
+// The chain isn't verified, and replacing blocks is reported to OnReorg listeners like any other reorganization.
+// A pruned node can't replace blocks it has already pruned, so chains forking below the pruned height are ignored.
+func ReplaceBlockchain(chain []Block) {
+	forkHeight := 0
+	for forkHeight < len(chain) && forkHeight < len(Blockchain) {
+		if HashBlock(chain[forkHeight], forkHeight) != BlockHashAt(forkHeight) {
+			break
+		}
+		forkHeight++
+	}
+	if forkHeight < PrunedHeight {
+		Warn(fmt.Sprintf("Ignoring chain that forks at block %d, below the pruned height %d.", forkHeight, PrunedHeight))
+		return
+	}
+	if _, err := Reorganize(forkHeight, chain[forkHeight:], false); err != nil {
+		panic(err)
+	}
+}
+
+// LoadBlockchain opens the block store and loads the headers of its blocks into the blockchain. The rest of each block
+// is read from the store when it is needed (see BlockAt).
+//
+// If the store is empty and a legacy "blockchain.json" file exists, the file is imported into the store first.
+// If the store has been pruned, the state and ledger are restored from the prune snapshot (see LoadPrunedBlockchain).
+func LoadBlockchain() {
+	if Store == nil {
+		store, err := OpenBlockStore(BlockStoreDir)
+		if err != nil {
+			panic(err)
+		}
+		Store = store
+	}
+	if Store.Len() == 0 {
+		if _, err := os.Stat("blockchain.json"); err == nil {
+			Log("Importing blockchain.json into the block store...", false)
+			if err = Store.ImportJSON("blockchain.json"); err != nil {
+				panic(err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			panic(err)
+		}
+	}
+	openHeaderStore()
+	if _, err := os.Stat(pruneSnapshotPath()); err == nil || PruneMode {
+		LoadPrunedBlockchain()
+		return
+	}
+	Blockchain = loadHeaders()
+}
+
+// openHeaderStore opens the header store, and makes it match the block store, backfilling headers for blocks stored
+// before it existed.
+func openHeaderStore() {
+	if HeaderStore == nil {
+		store, err := OpenHeaderStore(filepath.Join(BlockStoreDir, "headers"), Store.HashAt)
+		if err != nil {
+			panic(err)
+		}
+		HeaderStore = store
+	}
+	height := 0
+	for height < HeaderStore.Len() && height < Store.Len() {
+		headerHash, _ := HeaderStore.HashAt(height)
+		blockHash, _ := Store.HashAt(height)
+		if headerHash != blockHash {
+			break
+		}
+		height++
+	}
+	if err := HeaderStore.Truncate(height); err != nil {
+		panic(err)
+	}
+	for ; height < Store.Len(); height++ {
+		block, err := Store.Get(height)
+		if err != nil {
+			panic(err)
+		}
+		hash, _ := Store.HashAt(height)
+		if err = HeaderStore.AppendWithHash(BlockHeader(block), height, hash); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// loadHeaders reads every header in the header store, in height order.
+func loadHeaders() []Block {
+	headers := make([]Block, 0, HeaderStore.Len())
+	for height := 0; height < HeaderStore.Len(); height++ {
+		header, err := HeaderStore.Get(height)
+		if err != nil {
+			panic(err)
+		}
+		headers = append(headers, header)
+	}
+	return headers
+}
+
+// SaveBlockchain makes the block store match the in-memory blockchain.
+//
+// Blocks are normally written as they are appended, so this only has work to do if the blockchain was modified directly.
+func SaveBlockchain() {
+	if Store == nil {
+		store, err := OpenBlockStore(BlockStoreDir)
+		if err != nil {
+			panic(err)
+		}
+		Store = store
+	}
+	height := 0
+	for height < len(Blockchain) {
+		if _, ok := storedBlock(Store, Blockchain, height); !ok && height >= PrunedHeight {
+			break
+		}
+		height++
+	}
+	if err := Store.Truncate(height); err != nil {
+		panic(err)
+	}
+	if HeaderStore != nil {
+		if err := HeaderStore.Truncate(height); err != nil {
+			panic(err)
+		}
+	}
+	for ; height < len(Blockchain); height++ {
+		if err := storeBlock(Blockchain[height], height); err != nil {
+			panic(err)
+		}
+		Blockchain[height] = BlockHeader(Blockchain[height])
+	}
+}
+
+// BlockHashAt returns the hash of the block at the given height.
+//
+// Blocks in the block store are hashed when they are stored, so their hashes are read from the store index. This is
+// also the only way to get the hashes of pruned blocks, which can't be hashed because their transactions are gone.
+func BlockHashAt(height int) [64]byte {
+	if Store != nil {
+		if hash, ok := Store.HashAt(height); ok {
+			if _, stored := storedBlock(Store, Blockchain, height); stored || height < PrunedHeight {
+				return hash
+			}
+		}
+	}
+	return HashBlock(Blockchain[height], height)
+}
+
+// ChainCursor records how much of the blockchain an incrementally maintained index has consumed.
+//
+// Indexes compare their cursor against the blockchain before use, so they notice when the chain was truncated
+// or replaced underneath them (for example, by code that assigns to Blockchain directly).
+type ChainCursor struct {
+	Height int
+	tip    Block
+}
+
+// NewChainCursor returns a cursor that has consumed the first `height` blocks of the blockchain.
+func NewChainCursor(height int) ChainCursor {
+	if height == 0 {
+		return ChainCursor{}
+	}
+	return ChainCursor{
+		Height: height,
+		tip:    Blockchain[height-1],
+	}
+}
+
+// Valid reports whether the blocks consumed by the cursor are still a prefix of the blockchain.
+func (c ChainCursor) Valid() bool {
+	if c.Height > len(Blockchain) {
+		return false
+	}
+	if c.Height == 0 {
+		return true
+	}
+	return SameBlock(Blockchain[c.Height-1], c.tip)
+}
+
+// Advance moves the cursor past the next block in the blockchain.
+func (c *ChainCursor) Advance() {
+	c.tip = Blockchain[c.Height]
+	c.Height++
+}
+
+// SameBlock cheaply checks whether two blocks are the same block without hashing them.
+func SameBlock(a Block, b Block) bool {
+	return a.Nonce == b.Nonce &&
+		a.Difficulty == b.Difficulty &&
+		a.MiningTime == b.MiningTime &&
+		a.PreviousBlockHash == b.PreviousBlockHash &&
+		a.Timestamp.Equal(b.Timestamp) &&
+		bytes.Equal(a.Miner.Y, b.Miner.Y)
 }
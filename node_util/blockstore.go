@@ -0,0 +1,481 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Overview
+// Blocks are stored in an append-only log split into segment files (blocks/segment_00000.dat, ...).
+// Each record in a segment is laid out as:
+//   - length: uint32, the length of the payload
+//   - checksum: uint32, the CRC-32 (IEEE) of the payload
+//   - payload: the JSON encoding of the block
+// The index file (blocks/index.dat) holds one fixed-size entry per block, in height order:
+//   - segment: uint32
+//   - offset: uint64, the offset of the record within the segment
+//   - length: uint32, the length of the payload
+//   - hash: [64]byte, the block hash
+// Records are always written and synced before their index entry, so a crash can leave at most
+// one unindexed (or partially written) record at the end of the log. It is recovered or truncated
+// when the store is opened. A header can't be hashed once its transactions have been stripped, so
+// a header store recovers its records with the hashes of the full blocks instead (see OpenHeaderStore).
+// The node only keeps block headers in memory, read from a second store of headers (blocks/headers). Full blocks are
+// read from disk when they are needed, and the blockCacheSize most recently read blocks are cached.
+
+const BlockStoreDir = "blocks"
+const DefaultSegmentSize = 64 * 1024 * 1024
+const blockRecordHeaderSize = 8
+const blockIndexEntrySize = 80
+const blockCacheSize = 256
+
+var Store *BlockStore
+
+var ErrBlockPruned = errors.New("block has been pruned")
+
+type BlockLocation struct {
+	Segment uint32
+	Offset  uint64
+	Length  uint32
+	Hash    [64]byte
+}
+
+type BlockStore struct {
+	Dir           string
+	SegmentSize   int64
+	locations     []BlockLocation
+	hashes        map[[64]byte]int
+	cache         map[int]Block
+	cacheOrder    []int
+	index         *os.File
+	active        *os.File
+	activeSegment uint32
+	activeSize    int64
+	mutex         sync.Mutex
+}
+
+func segmentPath(dir string, segment uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("segment_%05d.dat", segment))
+}
+
+// OpenBlockStore opens the block store in the given directory, creating it if it does not exist.
+//
+// The index is loaded into memory, but blocks are only read from disk when they are requested.
+// Any record left behind by an interrupted append is either indexed (if it is complete) or truncated.
+func OpenBlockStore(dir string) (*BlockStore, error) {
+	return openBlockStore(dir, func(block Block, height int) ([64]byte, bool) {
+		return HashBlock(block, height), true
+	})
+}
+
+// OpenHeaderStore opens a store of block headers in the given directory, creating it if it does not exist.
+//
+// A complete header left behind by an interrupted append is indexed under the hash hashAt gives for its height, or
+// truncated if hashAt has none.
+func OpenHeaderStore(dir string, hashAt func(height int) ([64]byte, bool)) (*BlockStore, error) {
+	return openBlockStore(dir, func(_ Block, height int) ([64]byte, bool) {
+		return hashAt(height)
+	})
+}
+
+// openBlockStore opens a store, recovering unindexed records with the hashes given by hash.
+func openBlockStore(dir string, hash func(block Block, height int) ([64]byte, bool)) (*BlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &BlockStore{
+		Dir:         dir,
+		SegmentSize: DefaultSegmentSize,
+		hashes:      make(map[[64]byte]int),
+		cache:       make(map[int]Block),
+	}
+	index, err := os.OpenFile(filepath.Join(dir, "index.dat"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.index = index
+	if err = s.loadIndex(); err != nil {
+		_ = index.Close()
+		return nil, err
+	}
+	if err = s.recover(hash); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BlockStore) loadIndex() error {
+	indexBytes, err := io.ReadAll(s.index)
+	if err != nil {
+		return err
+	}
+	count := len(indexBytes) / blockIndexEntrySize
+	for i := 0; i < count; i++ {
+		entry := indexBytes[i*blockIndexEntrySize : (i+1)*blockIndexEntrySize]
+		var location BlockLocation
+		location.Segment = binary.BigEndian.Uint32(entry[0:4])
+		location.Offset = binary.BigEndian.Uint64(entry[4:12])
+		location.Length = binary.BigEndian.Uint32(entry[12:16])
+		copy(location.Hash[:], entry[16:80])
+		s.locations = append(s.locations, location)
+	}
+	// Drop entries pointing past the end of their segment (the segment was truncated externally).
+	for len(s.locations) > 0 {
+		last := s.locations[len(s.locations)-1]
+		info, err := os.Stat(segmentPath(s.Dir, last.Segment))
+		if err == nil && uint64(info.Size()) >= last.Offset+blockRecordHeaderSize+uint64(last.Length) {
+			break
+		}
+		Warn(fmt.Sprintf("Block store index entry %d points to a missing record. Dropping it.", len(s.locations)-1))
+		s.locations = s.locations[:len(s.locations)-1]
+	}
+	for height, location := range s.locations {
+		s.hashes[location.Hash] = height
+	}
+	return s.index.Truncate(int64(len(s.locations) * blockIndexEntrySize))
+}
+
+// recover scans the log past the last indexed record, indexing complete records under the hashes given by hash, and
+// truncating partial ones and those without a hash.
+func (s *BlockStore) recover(hash func(block Block, height int) ([64]byte, bool)) error {
+	segment := uint32(0)
+	offset := int64(0)
+	if len(s.locations) > 0 {
+		last := s.locations[len(s.locations)-1]
+		segment = last.Segment
+		offset = int64(last.Offset) + blockRecordHeaderSize + int64(last.Length)
+	}
+	for {
+		file, err := os.OpenFile(segmentPath(s.Dir, segment), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		for {
+			payload, err := readBlockRecord(file, offset)
+			if err != nil {
+				break
+			}
+			var block Block
+			if err = json.Unmarshal(payload, &block); err != nil {
+				break
+			}
+			blockHash, ok := hash(block, len(s.locations))
+			if !ok {
+				break
+			}
+			Log(fmt.Sprintf("Recovered unindexed block %d from the block store.", len(s.locations)), false)
+			if err = s.writeIndexEntry(BlockLocation{
+				Segment: segment,
+				Offset:  uint64(offset),
+				Length:  uint32(len(payload)),
+				Hash:    blockHash,
+			}); err != nil {
+				return err
+			}
+			offset += blockRecordHeaderSize + int64(len(payload))
+		}
+		if err = file.Truncate(offset); err != nil {
+			return err
+		}
+		if err = file.Sync(); err != nil {
+			return err
+		}
+		if _, err = os.Stat(segmentPath(s.Dir, segment+1)); err != nil {
+			s.active = file
+			s.activeSegment = segment
+			s.activeSize = offset
+			return nil
+		}
+		// A newer segment exists, so the current one was sealed before the crash.
+		if err = file.Close(); err != nil {
+			return err
+		}
+		segment++
+		offset = 0
+	}
+}
+
+func readBlockRecord(file *os.File, offset int64) ([]byte, error) {
+	header := make([]byte, blockRecordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, offset+blockRecordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("block record checksum mismatch")
+	}
+	return payload, nil
+}
+
+func (s *BlockStore) writeIndexEntry(location BlockLocation) error {
+	entry := make([]byte, blockIndexEntrySize)
+	binary.BigEndian.PutUint32(entry[0:4], location.Segment)
+	binary.BigEndian.PutUint64(entry[4:12], location.Offset)
+	binary.BigEndian.PutUint32(entry[12:16], location.Length)
+	copy(entry[16:80], location.Hash[:])
+	if _, err := s.index.WriteAt(entry, int64(len(s.locations)*blockIndexEntrySize)); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	s.hashes[location.Hash] = len(s.locations)
+	s.locations = append(s.locations, location)
+	return nil
+}
+
+// Append writes a block to the end of the store.
+//
+// The block must be at the height directly after the current last block.
+// The record is synced to disk before it is indexed, so the block is either fully stored or not stored at all.
+func (s *BlockStore) Append(block Block, height int) error {
+	return s.AppendWithHash(block, height, HashBlock(block, height))
+}
+
+// AppendWithHash writes a block to the end of the store, indexing it under the given hash.
+//
+// This is used to store block headers, which can't be hashed once their transactions have been stripped.
+func (s *BlockStore) AppendWithHash(block Block, height int, hash [64]byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if height != len(s.locations) {
+		return fmt.Errorf("cannot append block at height %d to a store of length %d", height, len(s.locations))
+	}
+	payload, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	if s.activeSize > 0 && s.activeSize+blockRecordHeaderSize+int64(len(payload)) > s.SegmentSize {
+		if err = s.active.Close(); err != nil {
+			return err
+		}
+		s.activeSegment++
+		s.activeSize = 0
+		s.active, err = os.OpenFile(segmentPath(s.Dir, s.activeSegment), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	record := make([]byte, blockRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[blockRecordHeaderSize:], payload)
+	if _, err = s.active.WriteAt(record, s.activeSize); err != nil {
+		return err
+	}
+	if err = s.active.Sync(); err != nil {
+		return err
+	}
+	err = s.writeIndexEntry(BlockLocation{
+		Segment: s.activeSegment,
+		Offset:  uint64(s.activeSize),
+		Length:  uint32(len(payload)),
+		Hash:    hash,
+	})
+	if err != nil {
+		return err
+	}
+	s.activeSize += int64(len(record))
+	return nil
+}
+
+// Get reads the block at the given height from disk, or from the cache of recently read blocks.
+func (s *BlockStore) Get(height int) (Block, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if height < 0 || height >= len(s.locations) {
+		return Block{}, fmt.Errorf("block %d is not in the store", height)
+	}
+	if block, ok := s.cache[height]; ok {
+		return block, nil
+	}
+	location := s.locations[height]
+	file, err := os.Open(segmentPath(s.Dir, location.Segment))
+	if errors.Is(err, os.ErrNotExist) {
+		return Block{}, ErrBlockPruned
+	}
+	if err != nil {
+		return Block{}, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			panic(err)
+		}
+	}(file)
+	payload, err := readBlockRecord(file, int64(location.Offset))
+	if err != nil {
+		return Block{}, err
+	}
+	var block Block
+	if err = json.Unmarshal(payload, &block); err != nil {
+		return Block{}, err
+	}
+	if len(s.cacheOrder) >= blockCacheSize {
+		delete(s.cache, s.cacheOrder[0])
+		s.cacheOrder = s.cacheOrder[1:]
+	}
+	s.cache[height] = block
+	s.cacheOrder = append(s.cacheOrder, height)
+	return block, nil
+}
+
+// GetByHash looks up a block by its hash, returning the block and its height.
+func (s *BlockStore) GetByHash(hash [64]byte) (Block, int, error) {
+	s.mutex.Lock()
+	height, ok := s.hashes[hash]
+	s.mutex.Unlock()
+	if !ok {
+		return Block{}, -1, errors.New("block not found")
+	}
+	block, err := s.Get(height)
+	return block, height, err
+}
+
+// HashAt returns the indexed hash of the block at the given height without reading the block.
+func (s *BlockStore) HashAt(height int) ([64]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if height < 0 || height >= len(s.locations) {
+		return [64]byte{}, false
+	}
+	return s.locations[height].Hash, true
+}
+
+// HeightOf returns the height of the block with the given hash.
+func (s *BlockStore) HeightOf(hash [64]byte) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	height, ok := s.hashes[hash]
+	return height, ok
+}
+
+func (s *BlockStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.locations)
+}
+
+// Truncate removes every block at or above the given height.
+func (s *BlockStore) Truncate(height int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if height < 0 || height >= len(s.locations) {
+		return nil
+	}
+	first := s.locations[height]
+	if err := s.index.Truncate(int64(height * blockIndexEntrySize)); err != nil {
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	for segment := s.activeSegment; segment > first.Segment; segment-- {
+		if err := os.Remove(segmentPath(s.Dir, segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if s.activeSegment != first.Segment {
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+		active, err := os.OpenFile(segmentPath(s.Dir, first.Segment), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		s.active = active
+		s.activeSegment = first.Segment
+	}
+	if err := s.active.Truncate(int64(first.Offset)); err != nil {
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	s.activeSize = int64(first.Offset)
+	for i := height; i < len(s.locations); i++ {
+		delete(s.hashes, s.locations[i].Hash)
+		delete(s.cache, i)
+	}
+	s.locations = s.locations[:height]
+	return nil
+}
+
+// DropSegmentsBelow deletes every sealed segment that only holds blocks below the given height.
+//
+// The blocks stay in the index, so their hashes can still be looked up, but reading them returns ErrBlockPruned.
+func (s *BlockStore) DropSegmentsBelow(height int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lastHeights := make(map[uint32]int)
+	for i, location := range s.locations {
+		lastHeights[location.Segment] = i
+	}
+	for segment, lastHeight := range lastHeights {
+		if segment == s.activeSegment || lastHeight >= height {
+			continue
+		}
+		if err := os.Remove(segmentPath(s.Dir, segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for i := range s.locations {
+			if s.locations[i].Segment == segment {
+				delete(s.cache, i)
+			}
+		}
+	}
+	return nil
+}
+
+// ImportJSON appends every block in a legacy blockchain.json file to an empty store.
+func (s *BlockStore) ImportJSON(path string) error {
+	if s.Len() != 0 {
+		return errors.New("block store is not empty")
+	}
+	blockchainJson, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var blocks []Block
+	if err = json.Unmarshal(blockchainJson, &blocks); err != nil {
+		return err
+	}
+	for height, block := range blocks {
+		if err = s.Append(block, height); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BlockStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+	}
+	return s.index.Close()
+}
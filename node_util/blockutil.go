@@ -9,16 +9,13 @@ You should have received a copy of the GNU General Public License along with thi
 package node_util
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -45,14 +42,14 @@ func GetKey(path string) PrivateKey {
 
 // SyncBlockchain synchronizes the blockchain with other peers.
 //
-// It iterates over each peer, sends a GET request to the peer's blockchain endpoint,
-// and receives the response. It then parses the response body into a slice of Block
-// structs. It checks the validity of the received blockchain by verifying the previous
-// block hash and proof of work. If the blockchain is valid, it updates the longest blockchain
-// if it is longer than the current blockchain.
+// It downloads each peer's headers after the last block they share with the blockchain (see header_sync.go), and
+// checks their previous block hashes, proof of work and difficulty. Peers that don't serve headers send their whole
+// blockchain instead, which is checked the same way. Headers only claim their work, so the chains are tried from the
+// most claimed work down: only the blocks that differ from the blockchain are downloaded, and the first chain whose
+// blocks match its headers and have more cumulative work than the blockchain replaces it (see fork_choice.go).
 //
 // The function takes an integer parameter `finalityBlockHeight` which represents the
-// minimum block height required for a blockchain to be considered final.
+// minimum block height required for a blockchain that replaces existing blocks to be considered final.
 //
 // If the blockchain is successfully synced, it logs a success message. If there is an
 // error with any peer, it logs an error message.
@@ -63,160 +60,58 @@ func GetKey(path string) PrivateKey {
 //
 // Return type: None.
 func SyncBlockchain(finalityBlockHeight int) {
-	longestLength := 0
-	var longestBlockchain []Block
-	errCount := 0
-	for _, peer := range GetPeers() {
-		res, err := http.Get(fmt.Sprintf("%s/blockchain", peer))
-		if err != nil {
+	peers := SyncPeers()
+	candidates := fetchSyncCandidates(peers)
+	errCount := len(peers) - len(candidates)
+	var eligible []syncCandidate
+	for _, candidate := range candidates {
+		if candidate.Start < len(Blockchain) && candidate.Start+len(candidate.Headers) < finalityBlockHeight {
+			// Require finality
+			Log("Ignoring blockchain received from peer due to lack of finality.", false)
 			errCount++
 			continue
 		}
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			panic(err)
-		}
-		var peerBlockchain []Block
-		err = json.Unmarshal(body, &peerBlockchain)
-		if err != nil {
-			panic(err)
-		}
-		length := len(peerBlockchain)
-		// Check to ensure proof of work is valid
-		createsFork := false
-		for i, block := range peerBlockchain {
-			if i == 0 {
-				continue
-			}
-			previousBlockHash := HashBlock(peerBlockchain[i-1], i-1)
-			if !bytes.Equal(block.PreviousBlockHash[:], previousBlockHash[:]) {
-				Log("Invalid blockchain received from peer: incorrect previous block hash", true)
-				fmt.Println(block.PreviousBlockHash)
-				fmt.Println(previousBlockHash)
-				goto INVALID
-			}
-			blockHash := HashBlock(block, i)
-			if binary.BigEndian.Uint64(blockHash[:]) > MaximumUint64/block.Difficulty {
-				Log("Invalid blockchain received from peer: proof of work", false)
-				fmt.Println("Failed at block", i)
-				goto INVALID
-			}
-			if i < len(Blockchain)-1 {
-				if blockHash != HashBlock(Blockchain[i], i) {
-					createsFork = true
-				}
-			}
-			// Get the correct difficulty for the block
-			var lastMinedBlock Block
-			lastMinedBlock.Difficulty = MaximumUint64
-			j := i - 1
-			for j >= 0 {
-				prevBlock := peerBlockchain[j]
-				if bytes.Equal(prevBlock.Miner.Y, block.Miner.Y) {
-					lastMinedBlock = prevBlock
-					break
-				}
-				j--
-			}
-			var lastTime time.Duration
-			var lastDifficulty uint64
-			if i == 1 || lastMinedBlock.Difficulty == MaximumUint64 {
-				lastTime = time.Minute
-				lastDifficulty = MinimumBlockDifficulty
-			} else {
-				lastTime = lastMinedBlock.MiningTime
-				lastDifficulty = lastMinedBlock.Difficulty
-			}
-			correctDifficulty := GetDifficulty(lastTime, lastDifficulty, len(ExtractTransactions(block)), i)
-			if block.Difficulty != correctDifficulty {
-				fmt.Println(correctDifficulty)
-				fmt.Println(lastTime)
-				fmt.Println(lastDifficulty)
-				Log("Invalid blockchain received from peer: incorrect difficulty", false)
-				goto INVALID
-			}
-		}
-		if createsFork {
-			// Require finality
-			if length < finalityBlockHeight {
-				Log("Ignoring blockchain received from peer due to lack of finality.", false)
-				goto INVALID
-			}
+		eligible = append(eligible, candidate)
+	}
+	if errCount >= len(peers) {
+		Log("Failed to sync blockchain with any peers.", true)
+		return
+	}
+	Log(fmt.Sprintf("%d out of %d peers responded.", len(peers)-errCount, len(peers)), false)
+	// Try the chains that claim the most work first, falling back to the next one if a chain's blocks can't be
+	// downloaded
+	sort.SliceStable(eligible, func(i, j int) bool {
+		return eligible[i].ClaimedWork.Cmp(eligible[j].ClaimedWork) > 0
+	})
+	synced := true
+	for _, candidate := range eligible {
+		if candidate.ClaimedWork.Cmp(ChainWork(Blockchain)) <= 0 {
+			break
 		}
-		if length > longestLength {
-			longestLength = length
-			longestBlockchain = peerBlockchain
+		if err := syncFrom(candidate, candidates); err != nil {
+			Log(fmt.Sprintf("Failed to sync blockchain from peer %s: %s", candidate.Peer, err), true)
+			synced = false
+			continue
 		}
+		synced = true
 		break
-	INVALID:
-		errCount++
 	}
-	if errCount >= len(GetPeers()) {
+	if !synced {
 		Log("Failed to sync blockchain with any peers.", true)
 		return
 	}
 	Log("Blockchain successfully synced!", false)
-	Log(fmt.Sprintf("%d out of %d peers responded.", len(GetPeers())-errCount, len(GetPeers())), false)
-	if longestLength > len(Blockchain) {
-		Blockchain = longestBlockchain
-	}
 }
 
+// GetBalance returns the balance of a public key.
+//
+// Balances are read from the account ledger, which is updated incrementally as blocks are appended.
 func GetBalance(key []byte) float64 {
-	total := 0.0
-	miningTotal := 0.0
-	isGenesis := true
-	blocksMined := 0
-	for i, block := range Blockchain {
-		if isGenesis {
-			isGenesis = false
-			continue
-		}
-		for _, transaction := range ExtractTransactions(block) {
-			if bytes.Equal(transaction.Sender.Y, key) {
-				total -= transaction.Amount
-				if i > 50 { // Fees start after 50 blocks
-					fee := TransactionFee + (BodyFeePerByte * float64(len(transaction.Body)))
-					for _, contract := range transaction.Contracts {
-						fee += GasPrice * contract.GasUsed
-					}
-					total -= fee
-				}
-			} else if bytes.Equal(transaction.Recipient.Y, key) {
-				total += transaction.Amount
-			}
-		}
-		if bytes.Equal(block.Miner.Y, key) {
-			lastBlock := Blockchain[i-1]
-			miningTotal += float64(len(block.TimeVerifiers)-len(lastBlock.TimeVerifiers)) * 0.1
-			if i > 50 { // Fees start after 50 blocks
-				fees := 0.0
-				for _, transaction := range ExtractTransactions(block) {
-					fees += TransactionFee
-					fees += BodyFeePerByte * float64(len(transaction.Body))
-					for _, contract := range transaction.Contracts {
-						fees += GasPrice * contract.GasUsed
-					}
-				}
-				miningTotal += fees
-			}
-			// Get number of miners at the time of mining
-			minerCount := GetMinerCount(i)
-			reward := CalculateBlockReward(minerCount, i)
-			miningTotal += reward
-			blocksMined++
-		}
-	}
-	if blocksMined > BlocksBeforeReward && len(Blockchain) > 50 {
-		total += miningTotal - float64(BlocksBeforeReward)
-	} else if len(Blockchain) < 50 {
-		total += miningTotal
-	}
-	return total
+	return AccountLedger.Balance(key)
 }
 
 func SendRequest(req *http.Request) {
-	_, err := http.DefaultClient.Do(req)
+	_, err := PeerClient.Do(req)
 	if err != nil {
 		Wg.Done()
 		return
@@ -224,11 +119,29 @@ func SendRequest(req *http.Request) {
 	Wg.Done()
 }
 
-func Send(receiver string, amount string, transactionBody []byte) {
+// Send signs a transaction and sends it to peers to be mined. A non-zero validUntil sets when the transaction expires
+// (see expiry.go), and the tip is paid to the miner so the transaction is mined sooner (see fee_market.go).
+func Send(receiver string, amount string, transactionBody []byte, validUntil int64, tip float64) {
 	key := GetKey("")
 	sender := key.PublicKey.Y
 	timestamp := time.Now().UnixNano()
-	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%s:%d", sender, receiver, amount, timestamp)))
+	nonce := uint64(0)
+	if NoncesActive(len(Blockchain)) {
+		nonce = FetchNextNonce(sender)
+	}
+	amountFloat, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		panic(err)
+	}
+	hash := TransactionSigningHash(Transaction{
+		Sender:     PublicKey{Y: sender},
+		Recipient:  PublicKey{Y: []byte(receiver)},
+		Amount:     amountFloat,
+		Timestamp:  time.Unix(0, timestamp),
+		Nonce:      nonce,
+		Tip:        tip,
+		ValidUntil: validUntil,
+	})
 	sigBytes, err := key.X.Sign(hash[:])
 	sig := Signature{
 		S: sigBytes,
@@ -249,7 +162,7 @@ func Send(receiver string, amount string, transactionBody []byte) {
 		if err != nil {
 			panic(err)
 		}
-		body := strings.NewReader(fmt.Sprintf("%s$%s$%s$%s$%d$%s$%s$[]", senderStr, receiverStr, amount, sigStr, timestamp, contractsStr, string(transactionBodyMarshaled)))
+		body := strings.NewReader(fmt.Sprintf("%s$%s$%s$%s$%d$%s$%s$[]", senderStr, receiverStr, amount, sigStr, timestamp, contractsStr, string(transactionBodyMarshaled)) + extensionFields(Transaction{Nonce: nonce, Tip: tip, ValidUntil: validUntil}))
 		req, err := http.NewRequest(http.MethodGet, peer+"/mine", body)
 		if err != nil {
 			panic(err)
@@ -259,6 +172,15 @@ func Send(receiver string, amount string, transactionBody []byte) {
 	}
 }
 
+// extensionFields returns the extension fields of a mine request, which are left out for transactions without them.
+func extensionFields(transaction Transaction) string {
+	fields := ""
+	for _, field := range TransactionExtensions(transaction) {
+		fields += "$" + field
+	}
+	return fields
+}
+
 func DeploySmartContract(contractPath string, contractLocation string) ([32]byte, error) {
 	if contractPath == "" && contractLocation == "" {
 		return [32]byte{}, errors.New("must provide contract path or location")
@@ -309,8 +231,16 @@ func DeploySmartContract(contractPath string, contractLocation string) ([32]byte
 	}
 	amount := "0"
 	timestamp := time.Now().UnixNano()
-	transactionString := fmt.Sprintf("%s:%s:%s:%d", deployer.Y, deployer.Y, amount, timestamp)
-	hash := sha256.Sum256([]byte(transactionString))
+	nonce := uint64(0)
+	if NoncesActive(len(Blockchain)) {
+		nonce = FetchNextNonce(deployer.Y)
+	}
+	hash := TransactionSigningHash(Transaction{
+		Sender:    deployer,
+		Recipient: deployer,
+		Timestamp: time.Unix(0, timestamp),
+		Nonce:     nonce,
+	})
 	sigBytes, err := key.X.Sign(hash[:])
 	sig := Signature{
 		S: sigBytes,
@@ -322,7 +252,7 @@ func DeploySmartContract(contractPath string, contractLocation string) ([32]byte
 	if err != nil {
 		panic(err)
 	}
-	body := strings.NewReader(fmt.Sprintf("%s$%s$%s$%s$%d$%s$[]$[]", deployerStr, deployerStr, amount, sigStr, timestamp, contractsStr))
+	body := strings.NewReader(fmt.Sprintf("%s$%s$%s$%s$%d$%s$[]$[]", deployerStr, deployerStr, amount, sigStr, timestamp, contractsStr) + extensionFields(Transaction{Nonce: nonce}))
 	for _, peer := range GetPeers() {
 		Log("Sending smart contract to peer: "+peer, false)
 		req, err := http.NewRequest(http.MethodGet, peer+"/mine", body)
@@ -336,56 +266,21 @@ func DeploySmartContract(contractPath string, contractLocation string) ([32]byte
 }
 
 func GetLastMinedBlock(key []byte) (Block, bool) {
-	for i := len(Blockchain) - 1; i > 0; i-- {
-		block := Blockchain[i]
-		if bytes.Equal(block.Miner.Y, key) {
-			return block, true
-		}
+	account, _ := AccountLedger.Account(key)
+	if account.LastMined <= 0 || account.LastMined >= len(Blockchain) {
+		return Block{}, false
 	}
-	return Block{}, false
+	return BlockAt(account.LastMined), true
 }
 
 func IsNewMiner(miner PublicKey, maxBlockPosition int) bool {
-	isGenesis := true
-	for i, block := range Blockchain {
-		if isGenesis {
-			isGenesis = false
-			continue
-		}
-		if i > maxBlockPosition {
-			break
-		}
-		if bytes.Equal(block.Miner.Y, miner.Y) {
-			return false
-		}
-	}
-	return true
+	return AccountLedger.IsNewMiner(miner.Y, maxBlockPosition)
 }
 
 func GetMinerCount(maxBlockPosition int) int64 {
-	var result int64
-	result = 0
-	isGenesis := true
-	for i, block := range Blockchain {
-		if i > maxBlockPosition {
-			break
-		}
-		if isGenesis {
-			isGenesis = false
-			continue
-		}
-		if IsNewMiner(block.Miner, i-1) {
-			result++
-		}
-	}
-	return result
+	return AccountLedger.MinerCount(maxBlockPosition)
 }
 
 func GetMaxMiners() int64 {
-	x := float64(len(Blockchain))
-	res := int64(math.Ceil(x / 20.0))
-	if res > 0 {
-		return res
-	}
-	return 1
+	return MaxMiners(len(Blockchain))
 }
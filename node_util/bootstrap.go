@@ -23,7 +23,7 @@ func Bootstrap() {
 		if err != nil {
 			panic(err)
 		}
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := PeerClient.Do(req)
 		if err != nil {
 			Log("Peer is down.", true)
 			continue
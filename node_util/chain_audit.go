@@ -0,0 +1,88 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Overview
+// Block verification reads the blockchain, state and account ledger, so it only checks a block against the tip of
+// the chain. To audit blocks that are already on the chain, AuditChain replays the chain from the genesis block into
+// fresh copies of those structures, verifying each block against the chain as it was just before the block was
+// added. The blocks are appended whether or not they are valid, so every failure in the range is reported. The
+// replay doesn't touch the block store or the mempool, and the original chain is restored when it finishes.
+
+var ErrAuditPruned = errors.New("can't audit a pruned blockchain")
+
+// BlockFailure is a block that failed verification during an audit.
+type BlockFailure struct {
+	Height  int
+	Reasons []*ValidationError
+}
+
+func (f BlockFailure) String() string {
+	result := fmt.Sprintf("Block %d:", f.Height)
+	for i, reason := range f.Reasons {
+		if i > 0 {
+			result += ";"
+		}
+		result += " " + reason.Error()
+	}
+	return result
+}
+
+// AuditChain replays the blockchain from the genesis block and verifies every block with a height from `from` up to,
+// but not including, `to` at its own height. It returns the blocks that failed.
+//
+// The audit replaces the blockchain while it runs, so nothing else may use the blockchain until it returns.
+func AuditChain(from int, to int) ([]BlockFailure, error) {
+	if PrunedHeight > 0 {
+		return nil, ErrAuditPruned
+	}
+	if to > len(Blockchain) {
+		to = len(Blockchain)
+	}
+	if from < 0 || from > to {
+		return nil, fmt.Errorf("invalid range %d-%d", from, to)
+	}
+	chain := Blockchain
+	chainState, accountLedger, txIndex, pool := ChainState, AccountLedger, TxIndex, Pool
+	store, journal, pruneMode := Store, Journal, PruneMode
+	defer func() {
+		Blockchain = chain
+		ChainState, AccountLedger, TxIndex, Pool = chainState, accountLedger, txIndex, pool
+		Store, Journal, PruneMode = store, journal, pruneMode
+	}()
+	Blockchain = nil
+	ChainState, AccountLedger, TxIndex, Pool = NewStateCache(), NewLedger(), NewTransactionIndex(), NewMempool()
+	Store, Journal, PruneMode = nil, nil, false
+	var failures []BlockFailure
+	for height := 0; height < to; height++ {
+		block := readBlock(store, chain, height)
+		if height >= from {
+			var reasons []*ValidationError
+			if height == 0 {
+				if HashBlock(block, 0) != HashBlock(GenesisBlock(), 0) {
+					reasons = []*ValidationError{NewValidationError(ReasonBadGenesis, "invalid genesis block")}
+				}
+			} else {
+				reasons = BlockProblems(block, height)
+			}
+			if len(reasons) > 0 {
+				failures = append(failures, BlockFailure{Height: height, Reasons: reasons})
+			}
+		}
+		if err := Append(block); err != nil {
+			return nil, err
+		}
+	}
+	return failures, nil
+}
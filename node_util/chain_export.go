@@ -0,0 +1,748 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// Overview
+// Chain exports use a versioned binary format instead of the JSON used on the wire:
+//   - magic: [4]byte, "PCSH"
+//   - version: uint16, ChainExportVersion
+//   - header record: the network, the upgrade heights and the number of blocks
+//   - one block record per block, in height order
+// Each record is laid out as:
+//   - length: uint32, the length of the payload
+//   - checksum: uint32, the CRC-32 (IEEE) of the payload
+//   - payload
+// Version 2 added transaction nonces, 3 added tips and replaced hashes, and 4 added validity windows, each at the end of
+// the transaction. Older versions are still read, and decode to transactions without those fields.
+// All integers are big-endian. Byte strings, strings, slices and maps are prefixed with their length plus one
+// as a uint32, where zero means nil, so blocks decode to exactly the values that were encoded (and hash the same).
+// Map entries are written in key order, so exporting the same chain always produces the same file.
+
+const ChainExportMagic = "PCSH"
+const ChainExportVersion = 4
+const maxChainRecordSize = 256 * 1024 * 1024
+
+// ChainExportHeader records the rules the exported chain was built under.
+type ChainExportHeader struct {
+	Network    string
+	Upgrades   map[string]int // Keyed by the upgrade's name in env.json
+	BlockCount uint64
+}
+
+// chainEncoder appends binary-encoded values to a buffer.
+type chainEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *chainEncoder) uint32(v uint32) {
+	_ = binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *chainEncoder) uint64(v uint64) {
+	_ = binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *chainEncoder) int64(v int64) {
+	e.uint64(uint64(v))
+}
+
+func (e *chainEncoder) float64(v float64) {
+	e.uint64(math.Float64bits(v))
+}
+
+func (e *chainEncoder) bool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+// length writes the length prefix of a value that may be nil.
+func (e *chainEncoder) length(n int, isNil bool) {
+	if isNil {
+		e.uint32(0)
+	} else {
+		e.uint32(uint32(n) + 1)
+	}
+}
+
+func (e *chainEncoder) bytes(v []byte) {
+	e.length(len(v), v == nil)
+	e.buf.Write(v)
+}
+
+func (e *chainEncoder) string(v string) {
+	e.uint32(uint32(len(v)))
+	e.buf.WriteString(v)
+}
+
+func (e *chainEncoder) time(v time.Time) {
+	timeBytes, err := v.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	e.bytes(timeBytes)
+}
+
+func (e *chainEncoder) publicKey(v PublicKey) {
+	e.bytes(v.Y)
+}
+
+func (e *chainEncoder) signature(v Signature) {
+	e.bytes(v.S)
+}
+
+func (e *chainEncoder) publicKeys(v []PublicKey) {
+	e.length(len(v), v == nil)
+	for _, key := range v {
+		e.publicKey(key)
+	}
+}
+
+func (e *chainEncoder) signatures(v []Signature) {
+	e.length(len(v), v == nil)
+	for _, signature := range v {
+		e.signature(signature)
+	}
+}
+
+func (e *chainEncoder) contract(v Contract) {
+	e.string(v.Contents)
+	e.length(len(v.Parties), v.Parties == nil)
+	for _, party := range v.Parties {
+		e.signature(party.Signature)
+		e.publicKey(party.PublicKey)
+	}
+	e.float64(v.GasUsed)
+	e.uint64(v.Location)
+	e.bool(v.Loaded)
+}
+
+func (e *chainEncoder) merkleNodes(v []MerkleNode) {
+	e.length(len(v), v == nil)
+	for _, node := range v {
+		e.bytes(node.Data)
+		e.length(len(node.Children), node.Children == nil)
+		keys := make([]int, 0, len(node.Children))
+		for key := range node.Children {
+			keys = append(keys, int(key))
+		}
+		sort.Ints(keys)
+		for _, key := range keys {
+			e.buf.WriteByte(byte(key))
+			e.int64(int64(node.Children[byte(key)]))
+		}
+		e.int64(int64(node.Parent))
+		e.string(node.Hash)
+		e.string(node.Key)
+	}
+}
+
+func (e *chainEncoder) transaction(v Transaction) {
+	e.publicKey(v.Sender)
+	e.publicKey(v.Recipient)
+	e.float64(v.Amount)
+	e.signature(v.SenderSignature)
+	e.time(v.Timestamp)
+	e.length(len(v.Contracts), v.Contracts == nil)
+	for _, contract := range v.Contracts {
+		e.contract(contract)
+	}
+	e.bool(v.FromSmartContract)
+	e.bytes(v.Body)
+	e.signatures(v.BodySignatures)
+	e.uint64(v.Nonce)
+	e.float64(v.Tip)
+	e.bytes(v.Replaces[:])
+	e.int64(v.ValidAfter)
+	e.int64(v.ValidUntil)
+}
+
+func (e *chainEncoder) transition(v StateTransition) {
+	e.length(len(v.LegacyUpdatedData), v.LegacyUpdatedData == nil)
+	dataKeys := make([]string, 0, len(v.LegacyUpdatedData))
+	for key := range v.LegacyUpdatedData {
+		dataKeys = append(dataKeys, key)
+	}
+	sort.Strings(dataKeys)
+	for _, key := range dataKeys {
+		e.string(key)
+		e.bytes(v.LegacyUpdatedData[key])
+	}
+	e.length(len(v.LegacyNewContracts), v.LegacyNewContracts == nil)
+	contractKeys := make([]uint64, 0, len(v.LegacyNewContracts))
+	for key := range v.LegacyNewContracts {
+		contractKeys = append(contractKeys, key)
+	}
+	sort.Slice(contractKeys, func(i, j int) bool { return contractKeys[i] < contractKeys[j] })
+	for _, key := range contractKeys {
+		e.uint64(key)
+		e.contract(v.LegacyNewContracts[key])
+	}
+	e.merkleNodes(v.ZenUpdatedData)
+	e.merkleNodes(v.ZenNewContracts)
+}
+
+func (e *chainEncoder) block(v Block) {
+	e.length(len(v.LegacyTransactions), v.LegacyTransactions == nil)
+	for _, transaction := range v.LegacyTransactions {
+		e.transaction(transaction)
+	}
+	e.merkleNodes(v.ZenTransactions)
+	e.publicKey(v.Miner)
+	e.int64(v.Nonce)
+	e.int64(int64(v.MiningTime))
+	e.uint64(v.Difficulty)
+	e.buf.Write(v.PreviousBlockHash[:])
+	e.time(v.Timestamp)
+	e.signatures(v.PreMiningTimeVerifierSignatures)
+	e.publicKeys(v.PreMiningTimeVerifiers)
+	e.signatures(v.TimeVerifierSignatures)
+	e.publicKeys(v.TimeVerifiers)
+	e.transition(v.Transition)
+	e.bytes(v.ZenProof)
+}
+
+// chainDecoder reads binary-encoded values from a payload.
+//
+// The first error is kept, and every read after it returns a zero value, so callers only need to check err once.
+type chainDecoder struct {
+	data    []byte
+	version uint16 // Format version of the data, which decides which transaction fields are present
+	err     error
+}
+
+func (d *chainDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = errors.New("unexpected end of record")
+		return nil
+	}
+	result := d.data[:n]
+	d.data = d.data[n:]
+	return result
+}
+
+func (d *chainDecoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *chainDecoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *chainDecoder) int64() int64 {
+	return int64(d.uint64())
+}
+
+func (d *chainDecoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+func (d *chainDecoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *chainDecoder) bool() bool {
+	return d.byte() != 0
+}
+
+// length reads a length prefix, returning -1 for nil.
+func (d *chainDecoder) length() int {
+	n := int(d.uint32()) - 1
+	if n > len(d.data) {
+		// Every element takes at least one byte, so this can only be a corrupt length.
+		d.err = errors.New("length is longer than the record")
+		return -1
+	}
+	return n
+}
+
+func (d *chainDecoder) bytes() []byte {
+	n := d.length()
+	if n < 0 {
+		return nil
+	}
+	return append([]byte{}, d.next(n)...)
+}
+
+func (d *chainDecoder) string() string {
+	return string(d.next(int(d.uint32())))
+}
+
+func (d *chainDecoder) time() time.Time {
+	var result time.Time
+	timeBytes := d.bytes()
+	if d.err == nil {
+		d.err = result.UnmarshalBinary(timeBytes)
+	}
+	return result
+}
+
+func (d *chainDecoder) publicKey() PublicKey {
+	return PublicKey{Y: d.bytes()}
+}
+
+func (d *chainDecoder) signature() Signature {
+	return Signature{S: d.bytes()}
+}
+
+func (d *chainDecoder) publicKeys() []PublicKey {
+	n := d.length()
+	if n < 0 {
+		return nil
+	}
+	result := make([]PublicKey, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		result = append(result, d.publicKey())
+	}
+	return result
+}
+
+func (d *chainDecoder) signatures() []Signature {
+	n := d.length()
+	if n < 0 {
+		return nil
+	}
+	result := make([]Signature, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		result = append(result, d.signature())
+	}
+	return result
+}
+
+func (d *chainDecoder) contract() Contract {
+	var result Contract
+	result.Contents = d.string()
+	if n := d.length(); n >= 0 {
+		result.Parties = make([]ContractParty, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			result.Parties = append(result.Parties, ContractParty{
+				Signature: d.signature(),
+				PublicKey: d.publicKey(),
+			})
+		}
+	}
+	result.GasUsed = d.float64()
+	result.Location = d.uint64()
+	result.Loaded = d.bool()
+	return result
+}
+
+func (d *chainDecoder) merkleNodes() []MerkleNode {
+	n := d.length()
+	if n < 0 {
+		return nil
+	}
+	result := make([]MerkleNode, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		var node MerkleNode
+		node.Data = d.bytes()
+		if children := d.length(); children >= 0 {
+			node.Children = make(map[byte]int, children)
+			for j := 0; j < children && d.err == nil; j++ {
+				key := d.byte()
+				node.Children[key] = int(d.int64())
+			}
+		}
+		node.Parent = int(d.int64())
+		node.Hash = d.string()
+		node.Key = d.string()
+		result = append(result, node)
+	}
+	return result
+}
+
+func (d *chainDecoder) transaction() Transaction {
+	var result Transaction
+	result.Sender = d.publicKey()
+	result.Recipient = d.publicKey()
+	result.Amount = d.float64()
+	result.SenderSignature = d.signature()
+	result.Timestamp = d.time()
+	if n := d.length(); n >= 0 {
+		result.Contracts = make([]Contract, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			result.Contracts = append(result.Contracts, d.contract())
+		}
+	}
+	result.FromSmartContract = d.bool()
+	result.Body = d.bytes()
+	result.BodySignatures = d.signatures()
+	if d.version >= 2 {
+		result.Nonce = d.uint64()
+	}
+	if d.version >= 3 {
+		result.Tip = d.float64()
+		copy(result.Replaces[:], d.bytes())
+	}
+	if d.version >= 4 {
+		result.ValidAfter = d.int64()
+		result.ValidUntil = d.int64()
+	}
+	return result
+}
+
+func (d *chainDecoder) transition() StateTransition {
+	var result StateTransition
+	if n := d.length(); n >= 0 {
+		result.LegacyUpdatedData = make(map[string][]byte, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := d.string()
+			result.LegacyUpdatedData[key] = d.bytes()
+		}
+	}
+	if n := d.length(); n >= 0 {
+		result.LegacyNewContracts = make(map[uint64]Contract, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			key := d.uint64()
+			result.LegacyNewContracts[key] = d.contract()
+		}
+	}
+	result.ZenUpdatedData = d.merkleNodes()
+	result.ZenNewContracts = d.merkleNodes()
+	return result
+}
+
+func (d *chainDecoder) block() Block {
+	var result Block
+	if n := d.length(); n >= 0 {
+		result.LegacyTransactions = make([]Transaction, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			result.LegacyTransactions = append(result.LegacyTransactions, d.transaction())
+		}
+	}
+	result.ZenTransactions = d.merkleNodes()
+	result.Miner = d.publicKey()
+	result.Nonce = d.int64()
+	result.MiningTime = time.Duration(d.int64())
+	result.Difficulty = d.uint64()
+	copy(result.PreviousBlockHash[:], d.next(64))
+	result.Timestamp = d.time()
+	result.PreMiningTimeVerifierSignatures = d.signatures()
+	result.PreMiningTimeVerifiers = d.publicKeys()
+	result.TimeVerifierSignatures = d.signatures()
+	result.TimeVerifiers = d.publicKeys()
+	result.Transition = d.transition()
+	result.ZenProof = d.bytes()
+	return result
+}
+
+// EncodeBlock encodes a block in the binary chain export format.
+func EncodeBlock(block Block) []byte {
+	e := chainEncoder{}
+	e.block(block)
+	return e.buf.Bytes()
+}
+
+// DecodeBlock decodes a block encoded by EncodeBlock.
+func DecodeBlock(data []byte) (Block, error) {
+	d := chainDecoder{data: data, version: ChainExportVersion}
+	block := d.block()
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("trailing data after block")
+	}
+	return block, d.err
+}
+
+// EncodeTransaction encodes a transaction in the binary chain export format.
+func EncodeTransaction(transaction Transaction) []byte {
+	e := chainEncoder{}
+	e.transaction(transaction)
+	return e.buf.Bytes()
+}
+
+// DecodeTransaction decodes a transaction encoded by EncodeTransaction.
+func DecodeTransaction(data []byte) (Transaction, error) {
+	d := chainDecoder{data: data, version: ChainExportVersion}
+	transaction := d.transaction()
+	if d.err == nil && len(d.data) != 0 {
+		d.err = errors.New("trailing data after transaction")
+	}
+	return transaction, d.err
+}
+
+// upgradesMatch reports whether a chain export's blocks were built under the same upgrades as this node would apply
+// to them. Upgrades only one side knows about (such as upgrades added since an older export was made), and upgrades
+// whose heights differ, are only allowed if they don't activate within the exported chain.
+func upgradesMatch(header ChainExportHeader) bool {
+	inChain := func(height int) bool {
+		return height >= 0 && uint64(height) < header.BlockCount
+	}
+	heights := UpgradeHeights(Env.Upgrades)
+	for name, height := range heights {
+		exported, ok := header.Upgrades[name]
+		if !ok {
+			exported = -1
+		}
+		if exported != height && (inChain(exported) || inChain(height)) {
+			return false
+		}
+	}
+	for name, exported := range header.Upgrades {
+		if _, ok := heights[name]; !ok && inChain(exported) {
+			return false
+		}
+	}
+	return true
+}
+
+// UpgradeHeights returns the activation height of every registered network upgrade, keyed by its name in env.json.
+// Disabled upgrades have a height of -1.
+func UpgradeHeights(upgrades NetworkUpgrades) map[string]int {
+	heights := make(map[string]int)
+	for _, upgrade := range UpgradeRegistry {
+		height, ok := upgrades[upgrade.Name]
+		if !ok || height < 0 {
+			height = -1
+		}
+		heights[string(upgrade.Name)] = height
+	}
+	return heights
+}
+
+func encodeChainHeader(header ChainExportHeader) []byte {
+	e := chainEncoder{}
+	e.string(header.Network)
+	names := make([]string, 0, len(header.Upgrades))
+	for name := range header.Upgrades {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e.uint32(uint32(len(names)))
+	for _, name := range names {
+		e.string(name)
+		e.int64(int64(header.Upgrades[name]))
+	}
+	e.uint64(header.BlockCount)
+	return e.buf.Bytes()
+}
+
+func decodeChainHeader(data []byte) (ChainExportHeader, error) {
+	d := chainDecoder{data: data, version: ChainExportVersion}
+	header := ChainExportHeader{
+		Network:  d.string(),
+		Upgrades: make(map[string]int),
+	}
+	count := int(d.uint32())
+	for i := 0; i < count && d.err == nil; i++ {
+		name := d.string()
+		header.Upgrades[name] = int(d.int64())
+	}
+	header.BlockCount = d.uint64()
+	return header, d.err
+}
+
+func writeChainRecord(w io.Writer, payload []byte) error {
+	recordHeader := make([]byte, 8)
+	binary.BigEndian.PutUint32(recordHeader[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(recordHeader[4:8], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(recordHeader); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readChainRecord(r io.Reader) ([]byte, error) {
+	recordHeader := make([]byte, 8)
+	if _, err := io.ReadFull(r, recordHeader); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(recordHeader[0:4])
+	if length > maxChainRecordSize {
+		return nil, fmt.Errorf("record length %d is too large", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(recordHeader[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// ExportChain writes the blockchain to a file in the binary chain export format.
+//
+// A pruned node can only export its blockchain if nothing has been pruned yet.
+func ExportChain(path string) error {
+	if PrunedHeight > 0 {
+		return fmt.Errorf("blocks below height %d have been pruned", PrunedHeight)
+	}
+	return WriteFileAtomicFunc(path, 0644, func(writer io.Writer) error {
+		if _, err := io.WriteString(writer, ChainExportMagic); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.BigEndian, uint16(ChainExportVersion)); err != nil {
+			return err
+		}
+		header := ChainExportHeader{
+			Network:    Env.Network,
+			Upgrades:   UpgradeHeights(Env.Upgrades),
+			BlockCount: uint64(len(Blockchain)),
+		}
+		if err := writeChainRecord(writer, encodeChainHeader(header)); err != nil {
+			return err
+		}
+		for height := range Blockchain {
+			e := chainEncoder{}
+			e.uint64(uint64(height))
+			e.block(BlockAt(height))
+			if err := writeChainRecord(writer, e.buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ReadChainExport reads every block from a chain export, checking the format, the checksums and the header.
+// Exports made with older versions of the format are also read.
+//
+// The header must match this node's network and upgrade heights, since the chain would otherwise be
+// verified under different rules than it was built with.
+func ReadChainExport(path string) ([]Block, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			panic(err)
+		}
+	}(file)
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(ChainExportMagic))
+	if _, err = io.ReadFull(reader, magic); err != nil || string(magic) != ChainExportMagic {
+		return nil, errors.New("not a chain export")
+	}
+	var version uint16
+	if err = binary.Read(reader, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version == 0 || version > ChainExportVersion {
+		return nil, fmt.Errorf("unsupported chain export version %d", version)
+	}
+	headerBytes, err := readChainRecord(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	header, err := decodeChainHeader(headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Network != Env.Network {
+		return nil, fmt.Errorf("chain export is for network %q, not %q", header.Network, Env.Network)
+	}
+	if !upgradesMatch(header) {
+		return nil, errors.New("chain export was made with different upgrade heights")
+	}
+	var blocks []Block
+	for height := uint64(0); height < header.BlockCount; height++ {
+		payload, err := readChainRecord(reader)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block %d: %w", height, err)
+		}
+		d := chainDecoder{data: payload, version: version}
+		if d.uint64() != height {
+			return nil, fmt.Errorf("block %d is out of order", height)
+		}
+		block := d.block()
+		if d.err == nil && len(d.data) != 0 {
+			d.err = errors.New("trailing data after block")
+		}
+		if d.err != nil {
+			return nil, fmt.Errorf("invalid block %d: %w", height, d.err)
+		}
+		blocks = append(blocks, block)
+	}
+	if _, err = reader.ReadByte(); err != io.EOF {
+		return nil, errors.New("trailing data after the last block")
+	}
+	return blocks, nil
+}
+
+// ImportChain replaces the blockchain with the chain in an export file, verifying every block as it is added. Chains
+// that conflict with a checkpoint are rejected, and in fast-sync mode blocks up to the latest checkpoint in the chain
+// skip their signature and proof checks.
+//
+// If any block is invalid, the original blockchain is restored and an error is returned.
+func ImportChain(path string) error {
+	if PrunedHeight > 0 {
+		return errors.New("cannot import a chain into a pruned node")
+	}
+	blocks, err := ReadChainExport(path)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 {
+		return errors.New("chain export is empty")
+	}
+	if HashBlock(blocks[0], 0) != HashBlock(GenesisBlock(), 0) {
+		return errors.New("chain export has an invalid genesis block")
+	}
+	trusted, err := trustCheckpoints(blocks)
+	if err != nil {
+		return err
+	}
+	trustedHeight = trusted
+	defer func() {
+		trustedHeight = -1
+	}()
+	original := BlocksAt(0, len(Blockchain))
+	if len(Blockchain) == 0 {
+		if err = Append(blocks[0]); err != nil {
+			return err
+		}
+	} else {
+		TruncateBlockchain(1)
+	}
+	for height := 1; height < len(blocks); height++ {
+		if !VerifyBlock(blocks[height], height) {
+			ReplaceBlockchain(original)
+			return fmt.Errorf("block %d is invalid", height)
+		}
+		if err = Append(blocks[height]); err != nil {
+			ReplaceBlockchain(original)
+			return err
+		}
+	}
+	return nil
+}
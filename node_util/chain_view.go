@@ -0,0 +1,147 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bytes"
+	"math"
+)
+
+// Overview
+// Block and transaction validation reads the chain and state through two interfaces rather than the package globals.
+// A ChainView is a read-only chain of blocks, and a StateView is the accounts and contract state at its tip. Neither
+// includes the mempool, so a block is valid or invalid on every node alike. The Validate functions in verify.go take
+// these views, so consensus rules can be checked against fork candidates, simulated chains or test fixtures, from
+// several goroutines at once. The Verify functions are the same checks against the node's own blockchain, through
+// NodeChain and NodeState.
+// Contract execution before the Zen upgrade and ZK proof verification run in the VM, which only has the node's own
+// state, so they are the exception.
+
+// ChainView is a read-only view of a chain of blocks.
+type ChainView interface {
+	Height() int                                        // Number of blocks in the chain
+	Block(height int) Block                             // Block at a height below Height
+	BlockHash(height int) [64]byte                      // Hash of the block at a height below Height
+	LastMinedBlock(miner []byte) (Block, bool)          // Most recent block mined by a public key, after the genesis block
+	IsNewMiner(miner []byte, maxBlockPosition int) bool // Whether a public key mined none of blocks 1 through maxBlockPosition
+	MinerCount(maxBlockPosition int) int64              // Number of distinct miners of blocks 1 through maxBlockPosition
+	BaseFee(height int) float64                         // Base fee of the block at a height, up to Height
+}
+
+// StateView is a read-only view of the state at the tip of a ChainView.
+type StateView interface {
+	Balance(key []byte) float64
+	Nonce(key []byte) uint64 // Nonce of the last mined transaction from a public key
+	State() State
+}
+
+type nodeChainView struct{}
+
+// NodeChain is the node's own blockchain.
+var NodeChain ChainView = nodeChainView{}
+
+func (nodeChainView) Height() int {
+	return len(Blockchain)
+}
+
+func (nodeChainView) Block(height int) Block {
+	return BlockAt(height)
+}
+
+func (nodeChainView) BlockHash(height int) [64]byte {
+	return BlockHashAt(height)
+}
+
+func (nodeChainView) LastMinedBlock(miner []byte) (Block, bool) {
+	return GetLastMinedBlock(miner)
+}
+
+func (nodeChainView) IsNewMiner(miner []byte, maxBlockPosition int) bool {
+	return AccountLedger.IsNewMiner(miner, maxBlockPosition)
+}
+
+func (nodeChainView) MinerCount(maxBlockPosition int) int64 {
+	return AccountLedger.MinerCount(maxBlockPosition)
+}
+
+func (nodeChainView) BaseFee(height int) float64 {
+	return AccountLedger.BaseFee(height)
+}
+
+type nodeStateView struct{}
+
+// NodeState is the state at the tip of the node's blockchain.
+var NodeState StateView = nodeStateView{}
+
+func (nodeStateView) Balance(key []byte) float64 {
+	return GetBalance(key)
+}
+
+func (nodeStateView) Nonce(key []byte) uint64 {
+	return AccountNonce(key)
+}
+
+func (nodeStateView) State() State {
+	return CalculateCurrentState()
+}
+
+// BlocksView is a ChainView of a slice of blocks, such as a fork candidate. Miner lookups scan the blocks, so it
+// is meant for short chains.
+type BlocksView []Block
+
+func (b BlocksView) Height() int {
+	return len(b)
+}
+
+func (b BlocksView) Block(height int) Block {
+	return b[height]
+}
+
+func (b BlocksView) BlockHash(height int) [64]byte {
+	return HashBlock(b[height], height)
+}
+
+func (b BlocksView) LastMinedBlock(miner []byte) (Block, bool) {
+	for height := len(b) - 1; height > 0; height-- {
+		if bytes.Equal(b[height].Miner.Y, miner) {
+			return b[height], true
+		}
+	}
+	return Block{}, false
+}
+
+func (b BlocksView) IsNewMiner(miner []byte, maxBlockPosition int) bool {
+	for height := 1; height < len(b) && height <= maxBlockPosition; height++ {
+		if bytes.Equal(b[height].Miner.Y, miner) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b BlocksView) MinerCount(maxBlockPosition int) int64 {
+	miners := make(map[string]bool)
+	for height := 1; height < len(b) && height <= maxBlockPosition; height++ {
+		miners[string(b[height].Miner.Y)] = true
+	}
+	return int64(len(miners))
+}
+
+func (b BlocksView) BaseFee(height int) float64 {
+	return ChainBaseFee(b, height)
+}
+
+// MaxMiners returns the maximum number of distinct miners a chain of the given height may have.
+func MaxMiners(height int) int64 {
+	res := int64(math.Ceil(float64(height) / 20.0))
+	if res > 0 {
+		return res
+	}
+	return 1
+}
@@ -0,0 +1,136 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Overview
+// Checkpoints are known-good blocks, listed per network in env.json as (height, hash) pairs. A chain with a different
+// block at a checkpoint's height is rejected when syncing, importing or reorganizing, so the blockchain can never be
+// reorganized below a checkpoint.
+// Since a checkpoint's hash commits to every block before it, blocks at or below the latest checkpoint don't need
+// their signatures and proofs checked again. In fast-sync mode (the "-fastsync" flag), syncing from peers and importing
+// a chain skip the transaction signature, time verifier and ZK proof checks for those blocks, once the chain is known
+// to contain the checkpoint.
+
+var ErrCheckpointConflict = errors.New("chain conflicts with a checkpoint")
+
+// Checkpoint is a known-good block on a network.
+type Checkpoint struct {
+	Height int    `json:"height"`
+	Hash   string `json:"hash"` // Hex encoded
+}
+
+var FastSync = false
+var trustedHeight = -1 // Blocks at or below this height are known to lead to a checkpoint
+
+// NetworkCheckpoints returns the checkpoints of the current network, in height order.
+func NetworkCheckpoints() []Checkpoint {
+	checkpoints := append([]Checkpoint{}, Env.Checkpoints[Env.Network]...)
+	sort.Slice(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Height < checkpoints[j].Height
+	})
+	return checkpoints
+}
+
+// LatestCheckpoint returns the highest checkpoint of the current network.
+func LatestCheckpoint() (Checkpoint, bool) {
+	checkpoints := NetworkCheckpoints()
+	if len(checkpoints) == 0 {
+		return Checkpoint{}, false
+	}
+	return checkpoints[len(checkpoints)-1], true
+}
+
+// verifyCheckpointList checks that checkpoints have valid heights and hashes.
+func verifyCheckpointList(network string, checkpoints []Checkpoint) error {
+	for _, checkpoint := range checkpoints {
+		hash, err := hex.DecodeString(checkpoint.Hash)
+		if err != nil || len(hash) != 64 || checkpoint.Height < 0 {
+			return fmt.Errorf("invalid %s checkpoint at height %d", network, checkpoint.Height)
+		}
+	}
+	return nil
+}
+
+// MatchesCheckpoint reports whether a block hash at the given height agrees with the checkpoints. Heights without a
+// checkpoint always match.
+func MatchesCheckpoint(height int, hash [64]byte) bool {
+	for _, checkpoint := range NetworkCheckpoints() {
+		if checkpoint.Height == height && checkpoint.Hash != hex.EncodeToString(hash[:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyBranchCheckpoints checks that replacing the blocks at and above forkHeight with the given blocks doesn't
+// conflict with a checkpoint: the new blocks must match the checkpoints they reach, and can't drop a checkpointed
+// block without replacing it.
+func VerifyBranchCheckpoints(forkHeight int, blocks []Block) error {
+	for _, checkpoint := range NetworkCheckpoints() {
+		if checkpoint.Height < forkHeight {
+			continue
+		}
+		if checkpoint.Height < forkHeight+len(blocks) {
+			if !MatchesCheckpoint(checkpoint.Height, HashBlock(blocks[checkpoint.Height-forkHeight], checkpoint.Height)) {
+				return fmt.Errorf("%w at height %d", ErrCheckpointConflict, checkpoint.Height)
+			}
+		} else if checkpoint.Height < len(Blockchain) {
+			return fmt.Errorf("%w: the branch would remove the block at height %d", ErrCheckpointConflict, checkpoint.Height)
+		}
+	}
+	return nil
+}
+
+// trustCheckpoints checks a whole chain against the checkpoints, and returns the height of the latest checkpoint it
+// contains, or -1 if it doesn't reach any.
+func trustCheckpoints(blocks []Block) (int, error) {
+	trusted := -1
+	for _, checkpoint := range NetworkCheckpoints() {
+		if checkpoint.Height >= len(blocks) {
+			break
+		}
+		if !MatchesCheckpoint(checkpoint.Height, HashBlock(blocks[checkpoint.Height], checkpoint.Height)) {
+			return -1, fmt.Errorf("%w at height %d", ErrCheckpointConflict, checkpoint.Height)
+		}
+		trusted = checkpoint.Height
+	}
+	return trusted, nil
+}
+
+// trustBranch checks a branch replacing the blocks at and above forkHeight against the checkpoints, and returns the
+// height of the latest checkpoint the resulting chain contains, or -1 if it doesn't reach any.
+func trustBranch(forkHeight int, blocks []Block) (int, error) {
+	if err := VerifyBranchCheckpoints(forkHeight, blocks); err != nil {
+		return -1, err
+	}
+	trusted := -1
+	for _, checkpoint := range NetworkCheckpoints() {
+		if checkpoint.Height >= forkHeight+len(blocks) {
+			break
+		}
+		if checkpoint.Height < forkHeight && !MatchesCheckpoint(checkpoint.Height, BlockHashAt(checkpoint.Height)) {
+			return -1, fmt.Errorf("%w at height %d", ErrCheckpointConflict, checkpoint.Height)
+		}
+		trusted = checkpoint.Height
+	}
+	return trusted, nil
+}
+
+// SkipFullVerification reports whether a block's signatures and proofs can be skipped, because fast sync is enabled
+// and the block is known to lead to a checkpoint.
+func SkipFullVerification(height int) bool {
+	return FastSync && height <= trustedHeight
+}
@@ -8,19 +8,55 @@ You should have received a copy of the GNU General Public License along with thi
 */
 package node_util
 
-// Difficulty
+import "time"
+
+// Difficulty (set by the network's params.json)
 var InitialBlockDifficulty = uint64(50000)
 var MinimumBlockDifficulty = uint64(50000)
 var MaximumUint64 = ^uint64(0)
 
 // Finality
 const BlocksUntilFinality = 3
+const MaxReorgDepth = LedgerUndoDepth // Competing branches that fork deeper than this below the tip are ignored
+
+// Sync
+const MaxHeadersPerRequest = 2000
+const MaxBodiesPerRequest = 100
+const MaxParallelDownloads = 8        // Peers that blocks are downloaded from at once
+const InvalidDataPenalty = 10         // Penalty for serving headers or blocks that don't verify
+const FailedRequestPenalty = 1        // Penalty for failing to answer a sync request
+const PeerBanScore = 30               // Peers are left out of syncs once their penalties reach this
+const PeerBanDuration = 1 * time.Hour // How long a peer is left out of syncs
+
+// State
+const StateSnapshotInterval = 100
+const MaxStateSnapshots = 50
+
+// Ledger
+const LedgerUndoDepth = 100
+
+// Pruning
+const PruneMargin = 10                   // Full blocks kept beyond BlocksUntilFinality
+const PruneInterval = 100                // Blocks between prunes
+const PruneSegmentSize = 4 * 1024 * 1024 // Smaller segments, so pruned blocks are freed sooner
+
+// Mempool
+const MaxMempoolTransactions = 10000
+const MaxMempoolBytes = 32 * 1024 * 1024
+const ReplacementFeeBump = 1.1 // A replacement transaction must pay at least this many times the fee of the one it replaces
+
+// Block limits, enforced from the Lagos upgrade (set by the network's params.json)
+var MaxBlockBytes = 1024 * 1024
+var MaxBlockGas = 10000000.0
+var MaxBlockTransactions = 1000 // Before Lagos, the miner still puts at most this many transactions in a block
 
-// Rewards
+// Rewards and fees (set by the network's params.json)
 var BlocksBeforeReward = 3
 var TransactionFee = 0.0001
 var BodyFeePerByte = 0.000001
 var GasPrice = 0.000001
+var TargetBlockFullness = 0.5        // The base fee rises when blocks are fuller than this, from the Oslo upgrade
+var BaseFeeDestination = BaseFeeBurn // What happens to base fees, from the Oslo upgrade
 
 // Mining power is measured in difficulty points per minute (DPM).
 const Dpm = 1
@@ -141,7 +141,7 @@ func (c Contract) Execute(maxGas float64, sender PublicKey) ([]Transaction, Stat
 						Warn("Error decoding state change:")
 					}
 					fmt.Println("Applying state change:", address, valueBytes)
-					if Env.Upgrades.Zen <= len(Blockchain) {
+					if IsActive(Zen, len(Blockchain)) {
 						// Zen insert
 						transition.ZenUpdatedData = InsertValue(transition.ZenUpdatedData, address, valueBytes)
 					} else {
@@ -204,7 +204,7 @@ func (c Contract) Execute(maxGas float64, sender PublicKey) ([]Transaction, Stat
 		transactions = append(transactions, transaction)
 	}
 	if c.IsNewContract() {
-		if Env.Upgrades.Zen <= len(Blockchain) && Env.Upgrades.Zen != -1 {
+		if IsActive(Zen, len(Blockchain)) {
 			// Zen update
 			InsertValue(transition.ZenUpdatedData, strconv.FormatUint(c.Location, 10), []byte(c.Contents))
 		} else {
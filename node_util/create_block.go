@@ -9,7 +9,6 @@ You should have received a copy of the GNU General Public License along with thi
 package node_util
 
 import (
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -17,14 +16,19 @@ import (
 	"time"
 )
 
-// TransactionHashes is a map of transaction hashes to their current status. 0 means the transaction is unmined, 1 means the transaction is being mined, and 2 means the transaction has been mined.
-var TransactionHashes = make(map[[32]byte]int)
-var MiningTransactions []Transaction
-
+// CreateBlock mines a block containing the highest-priority transactions in the mempool, up to the block limits.
+//
+// If the mempool or the blockchain changes while mining, the transactions are selected again.
 func CreateBlock() (Block, error) {
-	if len(MiningTransactions) == 0 {
+	Pool.RemoveExpired(len(Blockchain), time.Now())
+	PruneJournal()
+	timestamp := time.Now()
+	version, height := Pool.Version(), len(Blockchain)
+	entries := selectBlockEntries(timestamp)
+	if len(entries) == 0 {
 		return Block{}, errors.New("pool dry")
 	}
+	transactions, transition := blockContents(entries)
 	start := time.Now()
 	previousBlock, previousBlockFound := GetLastMinedBlock(GetKey("").PublicKey.Y)
 	if !previousBlockFound {
@@ -35,99 +39,53 @@ func CreateBlock() (Block, error) {
 		Miner:                           GetKey("").PublicKey,
 		Nonce:                           0,
 		MiningTime:                      0,
-		Difficulty:                      GetDifficulty(previousBlock.MiningTime, previousBlock.Difficulty, len(MiningTransactions), len(Blockchain)),
-		Timestamp:                       time.Now(),
+		Difficulty:                      GetDifficulty(previousBlock.MiningTime, previousBlock.Difficulty, len(transactions), len(Blockchain)),
+		Timestamp:                       timestamp,
 		PreMiningTimeVerifierSignatures: []Signature{},
 		PreMiningTimeVerifiers:          []PublicKey{},
 		TimeVerifierSignatures:          []Signature{},
 		TimeVerifiers:                   []PublicKey{},
-		Transition:                      StateTransition{},
-	}
-	if Env.Upgrades.Zen < len(Blockchain) && Env.Upgrades.Zen != -1 {
-		block.ZenTransactions = []MerkleNode{}
-		for _, tx := range MiningTransactions {
-			serialized, err := json.Marshal(tx)
-			if err != nil {
-				panic(err)
-			}
-			block.ZenTransactions = InsertValue(block.ZenTransactions, "", serialized)
-		}
-	} else {
-		block.LegacyTransactions = MiningTransactions
+		Transition:                      transition,
 	}
+	setBlockTransactions(&block, transactions)
 
 	if len(Blockchain) > 0 {
-		block.PreviousBlockHash = HashBlock(Blockchain[len(Blockchain)-1], len(Blockchain)-1)
+		block.PreviousBlockHash = BlockHashAt(len(Blockchain) - 1)
 	} else {
 		block.PreviousBlockHash = [64]byte{}
 	}
 	hashBytes := HashBlock(block, len(Blockchain))
 	hash := binary.BigEndian.Uint64(hashBytes[:]) // Take the last 64 bits-- we won't ever need more than 64 zeroes.
 	// Request time verifiers
-	block.PreMiningTimeVerifierSignatures, block.PreMiningTimeVerifiers = RequestTimeVerification(block)
+	if !Regtest {
+		block.PreMiningTimeVerifierSignatures, block.PreMiningTimeVerifiers = RequestTimeVerification(block)
+	}
 	Log(fmt.Sprintf("Mining block with difficulty %d", block.Difficulty), false)
 	for hash > MaximumUint64/block.Difficulty {
-		block.Transition = StateTransition{
-			LegacyUpdatedData:  make(map[string][]byte),
-			LegacyNewContracts: make(map[uint64]Contract),
-		}
-		for _, PartialStateTransition := range NextTransitions {
-			for address, data := range PartialStateTransition.LegacyUpdatedData {
-				block.Transition.LegacyUpdatedData[address] = data
-			}
-			for address, contract := range PartialStateTransition.LegacyNewContracts {
-				block.Transition.LegacyNewContracts[address] = contract
-			}
-			block.Transition.ZenUpdatedData = Merge(block.Transition.ZenUpdatedData, PartialStateTransition.ZenUpdatedData)
-			block.Transition.ZenNewContracts = Merge(block.Transition.ZenNewContracts, PartialStateTransition.ZenNewContracts)
-		}
-		i := 0
-		for _, transaction := range MiningTransactions {
-			transactionString := fmt.Sprintf("%s:%s:%f:%d", EncodePublicKey(transaction.Sender), EncodePublicKey(transaction.Recipient), transaction.Amount, transaction.Timestamp.UnixNano())
-			transactionBytes := []byte(transactionString)
-			hash := sha256.Sum256(transactionBytes)
-			if TransactionHashes[hash] > 1 {
-				if i > len(MiningTransactions)-1 {
-					Error("Transaction index out of range.", false)
-					return Block{}, errors.New("transaction index out of range")
-				}
-				MiningTransactions[i] = MiningTransactions[len(MiningTransactions)-1]
-				MiningTransactions = MiningTransactions[:len(MiningTransactions)-1]
-				i--
+		if Pool.Version() != version || len(Blockchain) != height {
+			version, height = Pool.Version(), len(Blockchain)
+			entries = selectBlockEntries(block.Timestamp)
+			if len(entries) == 0 {
+				Log("Pool dry.", false)
+				return Block{}, errors.New("pool dry")
 			}
-			i++
-		}
-		if len(MiningTransactions) > 0 {
+			transactions, block.Transition = blockContents(entries)
 			previousBlock, previousBlockFound = GetLastMinedBlock(GetKey("").PublicKey.Y)
 			if !previousBlockFound {
 				previousBlock.Difficulty = InitialBlockDifficulty
 				previousBlock.MiningTime = time.Minute
 			}
 			if len(Blockchain) > 0 {
-				block.PreviousBlockHash = HashBlock(Blockchain[len(Blockchain)-1], len(Blockchain)-1)
+				block.PreviousBlockHash = BlockHashAt(len(Blockchain) - 1)
 			} else {
 				block.PreviousBlockHash = [64]byte{}
 			}
-			block.Difficulty = GetDifficulty(previousBlock.MiningTime, previousBlock.Difficulty, len(MiningTransactions), len(Blockchain))
-			if Env.Upgrades.Zen < len(Blockchain) && Env.Upgrades.Zen != -1 {
-				block.ZenTransactions = []MerkleNode{}
-				for _, tx := range MiningTransactions {
-					serialized, err := json.Marshal(tx)
-					if err != nil {
-						panic(err)
-					}
-					block.ZenTransactions = InsertValue(block.ZenTransactions, "", serialized)
-				}
-			} else {
-				block.LegacyTransactions = MiningTransactions
-			}
-			block.Nonce++
-			hashBytes = HashBlock(block, len(Blockchain))
-			hash = binary.BigEndian.Uint64(hashBytes[:])
-		} else {
-			Log("Pool dry.", false)
-			return Block{}, errors.New("pool dry")
+			block.Difficulty = GetDifficulty(previousBlock.MiningTime, previousBlock.Difficulty, len(transactions), len(Blockchain))
+			setBlockTransactions(&block, transactions)
 		}
+		block.Nonce++
+		hashBytes = HashBlock(block, len(Blockchain))
+		hash = binary.BigEndian.Uint64(hashBytes[:])
 	}
 	// Generate ZK proof
 	var contracts []Contract
@@ -141,18 +99,68 @@ func CreateBlock() (Block, error) {
 	_, receipt := ZkProve(contracts, gasLimits, senders, CalculateCurrentState())
 	block.ZenProof = receipt
 	timeVerificationTimestamp := time.Now()
-	if Env.Upgrades.Yangon <= len(Blockchain) && Env.Upgrades.Yangon != -1 {
+	if Regtest {
+		// Regtest blocks are mined instantly, and nobody verifies their time
+		block.MiningTime = RegtestMiningTime
+	} else if IsActive(Yangon, len(Blockchain)) {
 		block.MiningTime = timeVerificationTimestamp.Sub(previousBlock.Timestamp.Add(previousBlock.MiningTime))
 	} else {
 		block.MiningTime = time.Since(start)
 	}
-	// Ask for time verifiers
-	block.TimeVerifierSignatures, block.TimeVerifiers = RequestTimeVerification(block)
-	if int64(len(block.TimeVerifiers)) < GetMinerCount(len(Blockchain))/5 {
-		Warn("Not enough time verifiers.")
-		return Block{}, errors.New("lost block")
+	if !Regtest {
+		// Ask for time verifiers
+		block.TimeVerifierSignatures, block.TimeVerifiers = RequestTimeVerification(block)
+		if int64(len(block.TimeVerifiers)) < GetMinerCount(len(Blockchain))/5 {
+			Warn("Not enough time verifiers.")
+			return Block{}, errors.New("lost block")
+		}
 	}
-	MiningTransactions = nil
-	NextTransitions = nil
 	return block, nil
 }
+
+// selectBlockEntries chooses the mempool entries for the next block.
+func selectBlockEntries(timestamp time.Time) []MempoolEntry {
+	if BlockLimitsActive(len(Blockchain)) {
+		return Pool.Pack(BlockLimits(len(Blockchain)), timestamp)
+	}
+	return Pool.Select(MaxBlockTransactions, timestamp)
+}
+
+// blockContents flattens mempool entries into the transactions to mine, with each transaction followed by the
+// transactions its smart contracts created, and merges their state transitions in the same order.
+func blockContents(entries []MempoolEntry) ([]Transaction, StateTransition) {
+	var transactions []Transaction
+	transition := StateTransition{
+		LegacyUpdatedData:  make(map[string][]byte),
+		LegacyNewContracts: make(map[uint64]Contract),
+	}
+	for _, entry := range entries {
+		transactions = append(transactions, entry.Transaction)
+		transactions = append(transactions, entry.Generated...)
+		for address, data := range entry.Transition.LegacyUpdatedData {
+			transition.LegacyUpdatedData[address] = data
+		}
+		for address, contract := range entry.Transition.LegacyNewContracts {
+			transition.LegacyNewContracts[address] = contract
+		}
+		transition.ZenUpdatedData = Merge(transition.ZenUpdatedData, entry.Transition.ZenUpdatedData)
+		transition.ZenNewContracts = Merge(transition.ZenNewContracts, entry.Transition.ZenNewContracts)
+	}
+	return transactions, transition
+}
+
+func setBlockTransactions(block *Block, transactions []Transaction) {
+	// The Zen block format starts with the block after the upgrade's height
+	if IsActive(Zen, len(Blockchain)-1) {
+		block.ZenTransactions = []MerkleNode{}
+		for _, tx := range transactions {
+			serialized, err := json.Marshal(tx)
+			if err != nil {
+				panic(err)
+			}
+			block.ZenTransactions = InsertValue(block.ZenTransactions, "", serialized)
+		}
+	} else {
+		block.LegacyTransactions = transactions
+	}
+}
@@ -24,13 +24,13 @@ func GetDifficulty(lastTime time.Duration, lastDifficulty uint64, transactionCou
 	difficultyBeforeAdjustment := lastDifficulty * uint64(60) / uint64(lastTime.Seconds())
 	x := lastTime.Minutes() * float64(lastDifficulty)
 	var adjustment float64
-	if Env.Upgrades.Dalian <= len(Blockchain) {
+	if IsActive(Dalian, blockchainLen) {
 		adjustment = (1 / (1 + math.Pow(math.E, -(1/(100*Kdpm))*(x-(100*Kdpm))))) + 0.5
 	} else {
 		adjustment = (1 / (1 + math.Pow(math.E, -(1/Mdpm)*(x-Mdpm)))) + 0.5
 	}
 	difficultyAfterAdjustment := float64(difficultyBeforeAdjustment) / adjustment
-	if Env.Upgrades.Qingdao <= blockchainLen {
+	if IsActive(Qingdao, blockchainLen) {
 		difficultyAfterAdjustment /= float64(transactionCount)
 	}
 	difficultyUint64 := uint64(difficultyAfterAdjustment)
@@ -50,7 +50,7 @@ func EncryptKey(password string) {
 		panic(err)
 	}
 	cipherText := gcm.Seal(nonce, nonce, plaintext, nil)
-	err = os.WriteFile("key.json", cipherText, 0644)
+	err = WriteFileAtomic("key.json", cipherText, 0600)
 	if err != nil {
 		panic(err)
 	}
@@ -75,7 +75,7 @@ func DecryptKey(password string) {
 	if err != nil {
 		panic(err)
 	}
-	err = os.WriteFile("key.json", plaintext, 0644)
+	err = WriteFileAtomic("key.json", plaintext, 0600)
 	if err != nil {
 		panic(err)
 	}
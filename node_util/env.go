@@ -14,20 +14,10 @@ import (
 	"os"
 )
 
-type NetworkUpgrades struct {
-	Guadalajara int `json:"guadalajara"`
-	Jinan       int `json:"jinan"`
-	Alexandria  int `json:"alexandria"`
-	Yangon      int `json:"yangon"`
-	Washington  int `json:"washington"`
-	Dalian      int `json:"dalian"`
-	Qingdao     int `json:"qingdao"`
-	Zen         int `json:"zen"`
-}
-
 type Environment struct {
-	Network  string          `json:"network"`
-	Upgrades NetworkUpgrades `json:"upgrades"`
+	Network     string                  `json:"network"`
+	Upgrades    NetworkUpgrades         `json:"upgrades"`
+	Checkpoints map[string][]Checkpoint `json:"checkpoints"` // Keyed by network
 }
 
 var Env Environment
@@ -36,7 +26,8 @@ var Env Environment
 //
 // It opens the file, reads its contents, and unmarshals the JSON data into the Env variable.
 // If there is an error opening or reading the file, it panics.
-// If there is an error unmarshaling the JSON data, it panics.
+// If there is an error unmarshaling the JSON data, an upgrade is unknown, or a checkpoint is invalid, it panics.
+// It then loads the parameters of the network it names (see network.go), panicking if they can't be loaded.
 func LoadEnv() {
 	envFile, err := os.Open("env.json")
 	if err != nil {
@@ -49,8 +40,20 @@ func LoadEnv() {
 		}
 	}(envFile)
 	jsonBytes, _ := io.ReadAll(envFile)
+	Env = Environment{}
 	err = json.Unmarshal(jsonBytes, &Env)
 	if err != nil {
 		panic(err)
 	}
+	if err = verifyUpgrades(Env.Upgrades); err != nil {
+		panic(err)
+	}
+	for network, checkpoints := range Env.Checkpoints {
+		if err = verifyCheckpointList(network, checkpoints); err != nil {
+			panic(err)
+		}
+	}
+	if err = LoadNetwork(Env.Network); err != nil {
+		panic(err)
+	}
 }
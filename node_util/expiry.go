@@ -0,0 +1,75 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"fmt"
+	"time"
+)
+
+// Overview
+// A transaction can limit when it is mined with ValidAfter and ValidUntil. Each bound is either a block height or a
+// Unix time in seconds: bounds below ExpiryTimeThreshold are heights, and bounds at or above it are times, which are
+// compared with the timestamp of the block the transaction is mined in. A bound of 0 isn't set.
+// A transaction that can no longer be mined is expired, and is dropped from the mempool. A transaction that can't be
+// mined yet waits in the mempool, holding back the sender's later transactions.
+// Validity windows were added by the Kyoto upgrade, along with nonces.
+
+const ExpiryTimeThreshold = 500000000
+
+// windowPosition returns the height or time a bound is compared with.
+func windowPosition(bound int64, height int, timestamp time.Time) int64 {
+	if bound < ExpiryTimeThreshold {
+		return int64(height)
+	}
+	return timestamp.Unix()
+}
+
+// TransactionStarted reports whether a transaction's ValidAfter bound allows it in a block at the given height and time.
+func TransactionStarted(transaction Transaction, height int, timestamp time.Time) bool {
+	return transaction.ValidAfter == 0 || windowPosition(transaction.ValidAfter, height, timestamp) >= transaction.ValidAfter
+}
+
+// TransactionExpired reports whether a transaction's ValidUntil bound rules it out of a block at the given height and time.
+func TransactionExpired(transaction Transaction, height int, timestamp time.Time) bool {
+	return transaction.ValidUntil != 0 && windowPosition(transaction.ValidUntil, height, timestamp) > transaction.ValidUntil
+}
+
+// ExpiryAfter returns the ValidUntil bound for a transaction that expires after the given duration.
+func ExpiryAfter(duration time.Duration) int64 {
+	return time.Now().Add(duration).Unix()
+}
+
+// VerifyExpiry checks that every transaction in a block at the given height and time is within its validity window,
+// and that validity windows aren't used before the Kyoto upgrade.
+func VerifyExpiry(transactions []Transaction, height int, timestamp time.Time) bool {
+	active := NoncesActive(height)
+	for _, transaction := range transactions {
+		if transaction.ValidAfter == 0 && transaction.ValidUntil == 0 {
+			continue
+		}
+		if !active {
+			Log("Transaction has a validity window before the Kyoto upgrade.", true)
+			return false
+		}
+		if transaction.ValidAfter < 0 || transaction.ValidUntil < 0 {
+			Log("Transaction has a negative validity bound.", true)
+			return false
+		}
+		if !TransactionStarted(transaction, height, timestamp) {
+			Log(fmt.Sprintf("Transaction isn't valid until %d.", transaction.ValidAfter), true)
+			return false
+		}
+		if TransactionExpired(transaction, height, timestamp) {
+			Log(fmt.Sprintf("Transaction expired at %d.", transaction.ValidUntil), true)
+			return false
+		}
+	}
+	return true
+}
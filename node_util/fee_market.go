@@ -0,0 +1,145 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Overview
+// Before the Oslo upgrade, every transaction pays the fixed TransactionFee, BodyFeePerByte and GasPrice, and the
+// miner keeps them. From Oslo, the fees follow a base fee that adjusts with demand. The base fee is the fee a plain
+// transaction pays, and the body and gas fees are scaled by the same factor. After each block, the base fee moves
+// towards keeping blocks TargetBlockFullness full: by up to BaseFeeMaxChange up when the block is completely full,
+// and down when it is empty. A block's fullness is the largest fraction of any of the block limits it uses. The base
+// fee never drops below TransactionFee.
+// The base fee isn't paid to the miner. Depending on the network's params.json, it is either burned, or split
+// between the block's time verifiers (and burned if there are none). Miners earn the tips instead, so they order
+// transactions by tip, and users raise their tip to have transactions mined sooner under load.
+// The base fee of each block is kept by the account ledger, alongside the miner counts.
+
+const BaseFeeMaxChange = 0.125 // Most the base fee changes by from one block to the next, as a fraction
+const FeeEstimateBlocks = 20   // Recent blocks whose tips are used to recommend tips
+
+// Where base fees go (set by the network's params.json)
+const (
+	BaseFeeBurn         = "burn"
+	BaseFeeRedistribute = "redistribute" // Split between the block's time verifiers
+)
+
+// FeeMarketActive reports whether a block at a height pays the base fee.
+func FeeMarketActive(height int) bool {
+	return IsActive(Oslo, height)
+}
+
+// BlockFullness returns the largest fraction of any of its limits that a block at a height uses.
+func BlockFullness(block Block, height int) float64 {
+	usage, limits := MeasureTransactions(ExtractTransactions(block)), BlockLimits(height)
+	fullness := math.Max(float64(usage.Bytes)/float64(limits.Bytes), usage.Gas/limits.Gas)
+	fullness = math.Max(fullness, float64(usage.Transactions)/float64(limits.Transactions))
+	return math.Min(fullness, 1)
+}
+
+// NextBaseFee returns the base fee of the block at a height, from the base fee and contents of the block before it.
+func NextBaseFee(baseFee float64, previous Block, height int) float64 {
+	if !FeeMarketActive(height) || !FeeMarketActive(height-1) {
+		// The base fee starts at TransactionFee
+		return TransactionFee
+	}
+	baseFee *= 1 + BaseFeeMaxChange*(BlockFullness(previous, height-1)-TargetBlockFullness)/TargetBlockFullness
+	return math.Max(baseFee, TransactionFee)
+}
+
+// ChainBaseFee calculates the base fee of the block at a height on a chain, up to the block after its tip, from its
+// blocks.
+func ChainBaseFee(chain ChainView, height int) float64 {
+	baseFee := TransactionFee
+	for h := 1; h <= height && h <= chain.Height(); h++ {
+		baseFee = NextBaseFee(baseFee, chain.Block(h-1), h)
+	}
+	return baseFee
+}
+
+// BaseFee returns the base fee of the block at a height on the node's blockchain, up to the next block.
+func BaseFee(height int) float64 {
+	return AccountLedger.BaseFee(height)
+}
+
+// BaseFees returns the fees a transaction pays in a block with the given base fee, not counting its tip.
+func BaseFees(transaction Transaction, baseFee float64) float64 {
+	fees := TransactionFees(transaction)
+	if baseFee == TransactionFee {
+		return fees
+	}
+	return fees * (baseFee / TransactionFee)
+}
+
+// MinerFees returns what a transaction pays the miner of a block at a height once fees are active: its fees and tip
+// before the Oslo upgrade, and only its tip after.
+func MinerFees(transaction Transaction, height int) float64 {
+	if FeeMarketActive(height) {
+		return transaction.Tip
+	}
+	return TransactionFees(transaction) + transaction.Tip
+}
+
+// FeeEstimate recommends tips for the next block, as tokens per byte of transaction.
+type FeeEstimate struct {
+	BaseFee         float64 `json:"baseFee"`         // Base fee of the next block
+	TransactionSize int     `json:"transactionSize"` // Median size of recent transactions, in bytes
+	Slow            float64 `json:"slow"`            // 25th percentile of recent tips
+	Standard        float64 `json:"standard"`        // Median of recent tips
+	Fast            float64 `json:"fast"`            // 90th percentile of recent tips, or enough to get into a full next block
+}
+
+// Tip returns the tips recommended for a transaction of a given size.
+func (e FeeEstimate) Tip(size int) (slow float64, standard float64, fast float64) {
+	roundUp := func(tip float64) float64 {
+		return math.Ceil(tip*float64(size)*1e8) / 1e8
+	}
+	return roundUp(e.Slow), roundUp(e.Standard), roundUp(e.Fast)
+}
+
+// EstimateFees recommends tips from the tips paid in the last FeeEstimateBlocks blocks, and from the mempool when it
+// holds more than the next block can.
+func EstimateFees() FeeEstimate {
+	estimate := FeeEstimate{BaseFee: BaseFee(len(Blockchain))}
+	var tipRates []float64
+	var sizes []int
+	for height := max(len(Blockchain)-FeeEstimateBlocks, 1); height < len(Blockchain); height++ {
+		for _, transaction := range ExtractTransactions(BlockAt(height)) {
+			if transaction.FromSmartContract {
+				continue
+			}
+			size := len(EncodeTransaction(transaction))
+			tipRates = append(tipRates, transaction.Tip/float64(size))
+			sizes = append(sizes, size)
+		}
+	}
+	if len(tipRates) > 0 {
+		sort.Float64s(tipRates)
+		sort.Ints(sizes)
+		percentile := func(p float64) float64 {
+			return tipRates[int(p*float64(len(tipRates)-1))]
+		}
+		estimate.Slow, estimate.Standard, estimate.Fast = percentile(0.25), percentile(0.5), percentile(0.9)
+		estimate.TransactionSize = sizes[len(sizes)/2]
+	}
+	if entries := Pool.Pack(BlockLimits(len(Blockchain)), time.Now()); len(entries) > 0 && len(entries) < Pool.Len() {
+		// The next block is full, so a transaction has to beat the lowest tip that makes it in
+		cutoff := entries[0].FeeRate()
+		for _, entry := range entries {
+			cutoff = math.Min(cutoff, entry.FeeRate())
+		}
+		estimate.Fast = math.Max(estimate.Fast, cutoff*ReplacementFeeBump)
+	}
+	return estimate
+}
@@ -0,0 +1,236 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// Overview
+// The main chain is the chain with the most cumulative work, where a block's work is its difficulty.
+// Blocks that don't extend the tip of the main chain are kept in the fork tracker as side branches. Once a side branch
+// has more cumulative work than the main chain, the node reorganizes: it rolls the blockchain back to the block the
+// branch forks from (undoing the state, ledger and transaction index), and appends the branch's blocks. Transactions
+// from the abandoned blocks go back to the mempool, and listeners registered with OnReorg are told about the reorg.
+// Branches forking more than MaxReorgDepth blocks below the tip are ignored.
+
+var ErrUnknownParent = errors.New("block's parent is unknown")
+var ErrForkTooDeep = errors.New("block forks too far below the tip")
+var ErrInvalidProofOfWork = errors.New("block has invalid proof of work")
+
+// ReorgEvent describes a reorganization of the blockchain.
+type ReorgEvent struct {
+	ForkHeight int        // Height of the first block that was replaced
+	Depth      int        // Number of blocks removed from the main chain
+	Removed    [][64]byte // Hashes of the removed blocks, in height order
+	Added      [][64]byte // Hashes of the blocks that replaced them, in height order
+}
+
+var reorgListeners []func(ReorgEvent)
+var reorgListenersMutex sync.Mutex
+
+// OnReorg registers a function to be called after every reorganization.
+func OnReorg(listener func(ReorgEvent)) {
+	reorgListenersMutex.Lock()
+	defer reorgListenersMutex.Unlock()
+	reorgListeners = append(reorgListeners, listener)
+}
+
+func emitReorg(event ReorgEvent) {
+	Warn(fmt.Sprintf("Reorganized the blockchain at height %d: replaced %d block(s) with %d.", event.ForkHeight, event.Depth, len(event.Added)))
+	reorgListenersMutex.Lock()
+	listeners := append([]func(ReorgEvent){}, reorgListeners...)
+	reorgListenersMutex.Unlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// BlockWork returns the work done to mine a block, which is its difficulty.
+func BlockWork(block Block) *big.Int {
+	return new(big.Int).SetUint64(block.Difficulty)
+}
+
+// ChainWork returns the cumulative work of a chain of blocks.
+func ChainWork(blocks []Block) *big.Int {
+	work := new(big.Int)
+	for _, block := range blocks {
+		work.Add(work, BlockWork(block))
+	}
+	return work
+}
+
+// VerifyProofOfWork checks that a block's hash at the given height meets its difficulty.
+func VerifyProofOfWork(block Block, height int) bool {
+	if block.Difficulty == 0 {
+		return height == 0
+	}
+	hash := HashBlock(block, height)
+	return binary.BigEndian.Uint64(hash[:]) <= MaximumUint64/block.Difficulty
+}
+
+// Reorganize replaces the blocks at and above forkHeight with the given blocks, and tells listeners about it.
+//
+// If verify is set, every new block is verified with VerifyBlock before it is appended; otherwise the caller must
+// have verified them. If a new block is invalid, the original blocks are restored and an error is returned.
+func Reorganize(forkHeight int, blocks []Block, verify bool) (ReorgEvent, error) {
+	if forkHeight < PrunedHeight {
+		return ReorgEvent{}, fmt.Errorf("can't reorganize at height %d, below the pruned height %d", forkHeight, PrunedHeight)
+	}
+	if forkHeight > len(Blockchain) {
+		return ReorgEvent{}, ErrUnknownParent
+	}
+	if err := VerifyBranchCheckpoints(forkHeight, blocks); err != nil {
+		return ReorgEvent{}, err
+	}
+	event := ReorgEvent{ForkHeight: forkHeight, Depth: len(Blockchain) - forkHeight}
+	for height := forkHeight; height < len(Blockchain); height++ {
+		event.Removed = append(event.Removed, BlockHashAt(height))
+	}
+	original := BlocksAt(forkHeight, len(Blockchain))
+	restore := func(err error) (ReorgEvent, error) {
+		TruncateBlockchain(forkHeight)
+		for _, block := range original {
+			if restoreErr := Append(block); restoreErr != nil {
+				return ReorgEvent{}, errors.Join(err, restoreErr)
+			}
+		}
+		return ReorgEvent{}, err
+	}
+	TruncateBlockchain(forkHeight)
+	for _, block := range blocks {
+		height := len(Blockchain)
+		if verify {
+			if problems := BlockProblems(block, height); len(problems) > 0 {
+				return restore(fmt.Errorf("block %d of the new branch is invalid: %w", height, problems[0]))
+			}
+		}
+		if err := Append(block); err != nil {
+			return restore(err)
+		}
+		event.Added = append(event.Added, BlockHashAt(height))
+	}
+	if event.Depth > 0 {
+		emitReorg(event)
+	}
+	return event, nil
+}
+
+// sideBlock is a block that isn't on the main chain.
+type sideBlock struct {
+	Block  Block
+	Height int
+	Work   *big.Int // Cumulative work of the branch, up to and including this block
+}
+
+// ForkTracker keeps the blocks of competing branches, and switches to a branch once it has more work than the main chain.
+type ForkTracker struct {
+	blocks map[[64]byte]sideBlock
+	mutex  sync.Mutex
+}
+
+var Forks = NewForkTracker()
+
+func NewForkTracker() *ForkTracker {
+	return &ForkTracker{blocks: make(map[[64]byte]sideBlock)}
+}
+
+// Len returns the number of side-branch blocks being tracked.
+func (f *ForkTracker) Len() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.blocks)
+}
+
+// mainChainHeight returns the height of a block on the main chain, searching no further than MaxReorgDepth below the tip.
+func mainChainHeight(hash [64]byte) (int, bool) {
+	for height := len(Blockchain) - 1; height >= 0 && height >= len(Blockchain)-1-MaxReorgDepth; height-- {
+		if BlockHashAt(height) == hash {
+			return height, true
+		}
+	}
+	return 0, false
+}
+
+// AddBlock adds a block that doesn't extend the tip of the main chain, and reorganizes if its branch now has the
+// most work. It reports whether the blockchain was reorganized.
+func (f *ForkTracker) AddBlock(block Block) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var height int
+	parentWork := new(big.Int)
+	if parentHeight, ok := mainChainHeight(block.PreviousBlockHash); ok {
+		height = parentHeight + 1
+		parentWork = ChainWork(Blockchain[:height])
+	} else if parent, ok := f.blocks[block.PreviousBlockHash]; ok {
+		height = parent.Height + 1
+		parentWork = parent.Work
+	} else {
+		return false, ErrUnknownParent
+	}
+	if height <= len(Blockchain)-MaxReorgDepth || height <= PrunedHeight {
+		return false, ErrForkTooDeep
+	}
+	if !VerifyProofOfWork(block, height) {
+		return false, ErrInvalidProofOfWork
+	}
+	hash := HashBlock(block, height)
+	if !MatchesCheckpoint(height, hash) {
+		return false, ErrCheckpointConflict
+	}
+	side := sideBlock{Block: block, Height: height, Work: new(big.Int).Add(parentWork, BlockWork(block))}
+	f.blocks[hash] = side
+	f.prune()
+	if side.Work.Cmp(ChainWork(Blockchain)) <= 0 {
+		Log(fmt.Sprintf("Tracking competing branch at height %d.", height), true)
+		return false, nil
+	}
+	// Collect the branch, back to where it leaves the main chain
+	branch := []Block{block}
+	forkHeight := height
+	for {
+		if _, ok := mainChainHeight(branch[0].PreviousBlockHash); ok {
+			break
+		}
+		parent, ok := f.blocks[branch[0].PreviousBlockHash]
+		if !ok {
+			return false, ErrForkTooDeep
+		}
+		branch = append([]Block{parent.Block}, branch...)
+		forkHeight = parent.Height
+	}
+	replaced := BlocksAt(forkHeight, len(Blockchain))
+	if _, err := Reorganize(forkHeight, branch, true); err != nil {
+		delete(f.blocks, hash)
+		return false, err
+	}
+	// The branch is now the main chain, and the blocks it replaced become a side branch
+	for i, block := range branch {
+		delete(f.blocks, HashBlock(block, forkHeight+i))
+	}
+	work := ChainWork(Blockchain[:forkHeight])
+	for i, block := range replaced {
+		work = new(big.Int).Add(work, BlockWork(block))
+		f.blocks[HashBlock(block, forkHeight+i)] = sideBlock{Block: block, Height: forkHeight + i, Work: work}
+	}
+	return true, nil
+}
+
+// prune forgets side-branch blocks that are too far below the tip to cause a reorg.
+func (f *ForkTracker) prune() {
+	for hash, side := range f.blocks {
+		if side.Height <= len(Blockchain)-MaxReorgDepth {
+			delete(f.blocks, hash)
+		}
+	}
+}
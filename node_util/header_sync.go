@@ -0,0 +1,420 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Overview
+// Nodes sync headers first. A node sends a peer its block locator: the hashes of its last few blocks, then of blocks
+// exponentially further apart, down to the genesis block. The peer answers with the headers after the highest block
+// in the locator that is on its own chain. Headers carry the block's hash and transaction count, so the chain of
+// headers, its proof of work and its difficulties can all be checked before any block bodies are downloaded.
+// A peer can send any hash with its headers, so their work is only claimed. Starting with the peer that claims the most
+// work, only the bodies of blocks the node doesn't have are downloaded, and each body is checked against its header's
+// hash. A chain's work only counts once its bodies have been checked, and every block is fully validated as it is
+// added, so the next peer is tried if any of its bodies can't be downloaded or are invalid.
+// Both "/headers" and "/bodies" also accept a plain height range in the "from" and "to" query parameters.
+
+var ErrNoCommonBlock = errors.New("no block in the locator is on this chain")
+var ErrHeadersUnsupported = errors.New("peer doesn't support headers-first sync")
+var ErrInvalidSyncData = errors.New("peer served invalid data")
+
+// LocatorEntry identifies a block on the requesting node's chain.
+type LocatorEntry struct {
+	Height int    `json:"height"`
+	Hash   string `json:"hash"` // Hex encoded
+}
+
+// HeaderRecord is a block header, as served by the "/headers" endpoint.
+type HeaderRecord struct {
+	Header       Block    `json:"header"` // The block without its transactions, state transition and proof
+	Hash         [64]byte `json:"hash"`
+	Transactions int      `json:"transactions"` // The block's difficulty depends on its number of transactions (-1 if pruned)
+}
+
+// HeadersResponse is served by the "/headers" endpoint.
+type HeadersResponse struct {
+	Start   int            `json:"start"` // Height of the first header
+	Headers []HeaderRecord `json:"headers"`
+}
+
+// BodiesResponse is served by the "/bodies" endpoint.
+type BodiesResponse struct {
+	Start  int     `json:"start"` // Height of the first block
+	Blocks []Block `json:"blocks"`
+}
+
+// BlockLocator returns the locator for the blockchain: the last 10 blocks, then blocks exponentially further apart,
+// ending with the genesis block.
+func BlockLocator() []LocatorEntry {
+	var locator []LocatorEntry
+	step := 1
+	for height := len(Blockchain) - 1; height >= 0; height -= step {
+		hash := BlockHashAt(height)
+		locator = append(locator, LocatorEntry{Height: height, Hash: hex.EncodeToString(hash[:])})
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if len(locator) > 0 && locator[len(locator)-1].Height != 0 {
+		hash := BlockHashAt(0)
+		locator = append(locator, LocatorEntry{Height: 0, Hash: hex.EncodeToString(hash[:])})
+	}
+	return locator
+}
+
+// LocatorStart returns the height after the highest locator block that is on the blockchain.
+//
+// An empty locator (from a node without any blocks) starts at the genesis block.
+func LocatorStart(locator []LocatorEntry) (int, error) {
+	if len(locator) == 0 {
+		return 0, nil
+	}
+	for _, entry := range locator {
+		if entry.Height < 0 || entry.Height >= len(Blockchain) {
+			continue
+		}
+		hash := BlockHashAt(entry.Height)
+		if hex.EncodeToString(hash[:]) == entry.Hash {
+			return entry.Height + 1, nil
+		}
+	}
+	return 0, ErrNoCommonBlock
+}
+
+// syncRange returns the range of heights a "/headers" or "/bodies" request asks for, at most `limit` blocks long.
+func syncRange(req *http.Request, limit int) (int, int, error) {
+	from := -1
+	var err error
+	query := req.URL.Query()
+	if fromStr := query.Get("from"); fromStr != "" {
+		if from, err = strconv.Atoi(fromStr); err != nil {
+			return 0, 0, err
+		}
+	} else {
+		bodyBytes, err := io.ReadAll(req.Body)
+		if err != nil {
+			return 0, 0, err
+		}
+		var locator []LocatorEntry
+		if len(bytes.TrimSpace(bodyBytes)) > 0 {
+			if err = json.Unmarshal(bodyBytes, &locator); err != nil {
+				return 0, 0, err
+			}
+		}
+		if from, err = LocatorStart(locator); err != nil {
+			return 0, 0, err
+		}
+	}
+	to := from + limit
+	if toStr := query.Get("to"); toStr != "" {
+		if to, err = strconv.Atoi(toStr); err != nil {
+			return 0, 0, err
+		}
+	}
+	if to > from+limit {
+		to = from + limit
+	}
+	if to > len(Blockchain) {
+		to = len(Blockchain)
+	}
+	if from < 0 || from > to {
+		return 0, 0, fmt.Errorf("invalid range %d-%d", from, to)
+	}
+	return from, to, nil
+}
+
+// Headers returns the header records of the blocks in a range of heights.
+func Headers(from int, to int) []HeaderRecord {
+	headers := make([]HeaderRecord, 0, to-from)
+	for height := from; height < to; height++ {
+		block := BlockAt(height)
+		transactions := len(ExtractTransactions(block))
+		if height < PrunedHeight {
+			transactions = -1 // Pruned blocks are kept without their transactions
+		}
+		headers = append(headers, HeaderRecord{
+			Header:       BlockHeader(block),
+			Hash:         BlockHashAt(height),
+			Transactions: transactions,
+		})
+	}
+	return headers
+}
+
+// ExpectedDifficulty returns the difficulty a block at the given height must have, given the chain before it.
+func ExpectedDifficulty(chain []Block, block Block, transactions int, height int) uint64 {
+	var lastMinedBlock Block
+	lastMinedBlock.Difficulty = MaximumUint64
+	for j := height - 1; j >= 0; j-- {
+		if bytes.Equal(chain[j].Miner.Y, block.Miner.Y) {
+			lastMinedBlock = chain[j]
+			break
+		}
+	}
+	var lastTime time.Duration
+	var lastDifficulty uint64
+	if height == 1 || lastMinedBlock.Difficulty == MaximumUint64 {
+		lastTime = time.Minute
+		lastDifficulty = MinimumBlockDifficulty
+	} else {
+		lastTime = lastMinedBlock.MiningTime
+		lastDifficulty = lastMinedBlock.Difficulty
+	}
+	return GetDifficulty(lastTime, lastDifficulty, transactions, height)
+}
+
+// VerifyHeaders checks that headers starting at the given height link onto the blockchain below that height, and
+// that each has valid proof of work and the correct difficulty.
+func VerifyHeaders(start int, headers []HeaderRecord) error {
+	if start > len(Blockchain) {
+		return ErrUnknownParent
+	}
+	chain := append(make([]Block, 0, start+len(headers)), Blockchain[:start]...)
+	var previousHash [64]byte
+	if start > 0 {
+		previousHash = BlockHashAt(start - 1)
+	}
+	for i, record := range headers {
+		height := start + i
+		header := record.Header
+		if height == 0 {
+			if record.Hash != HashBlock(GenesisBlock(), 0) {
+				return errors.New("invalid genesis block")
+			}
+		} else {
+			if header.PreviousBlockHash != previousHash {
+				return fmt.Errorf("header %d has an incorrect previous block hash", height)
+			}
+			if header.Difficulty == 0 || binary.BigEndian.Uint64(record.Hash[:]) > MaximumUint64/header.Difficulty {
+				return fmt.Errorf("header %d has invalid proof of work", height)
+			}
+			// Pruned blocks' transaction counts are unknown, so only their proof of work can be checked
+			if record.Transactions >= 0 {
+				if expected := ExpectedDifficulty(chain, header, record.Transactions, height); header.Difficulty != expected {
+					return fmt.Errorf("header %d has difficulty %d, expected %d", height, header.Difficulty, expected)
+				}
+			}
+		}
+		if !MatchesCheckpoint(height, record.Hash) {
+			return fmt.Errorf("header %d conflicts with a checkpoint", height)
+		}
+		chain = append(chain, header)
+		previousHash = record.Hash
+	}
+	return nil
+}
+
+// VerifyBody checks that a downloaded block matches its header.
+func VerifyBody(block Block, record HeaderRecord, height int) bool {
+	return HashBlock(block, height) == record.Hash && len(ExtractTransactions(block)) == record.Transactions
+}
+
+// FetchHeaders downloads a peer's headers after the highest block they share with the blockchain.
+func FetchHeaders(peer string) (int, []HeaderRecord, error) {
+	locatorBytes, err := json.Marshal(BlockLocator())
+	if err != nil {
+		panic(err)
+	}
+	start := -1
+	var headers []HeaderRecord
+	for {
+		var req *http.Request
+		if start == -1 {
+			req, err = http.NewRequest(http.MethodGet, peer+"/headers", strings.NewReader(string(locatorBytes)))
+		} else {
+			req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/headers?from=%d", peer, start+len(headers)), nil)
+		}
+		if err != nil {
+			panic(err)
+		}
+		res, err := PeerClient.Do(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		bodyBytes, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			return 0, nil, err
+		}
+		if res.StatusCode == http.StatusNotFound {
+			return 0, nil, ErrHeadersUnsupported
+		}
+		if res.StatusCode != http.StatusOK {
+			return 0, nil, fmt.Errorf("peer refused to serve headers: %s", strings.TrimSpace(string(bodyBytes)))
+		}
+		var response HeadersResponse
+		if err = json.Unmarshal(bodyBytes, &response); err != nil {
+			return 0, nil, err
+		}
+		if start == -1 {
+			start = response.Start
+		}
+		headers = append(headers, response.Headers...)
+		if len(response.Headers) < MaxHeadersPerRequest {
+			return start, headers, nil
+		}
+	}
+}
+
+// FetchBodies downloads the blocks in a range of heights from a peer, checking each against its header.
+func FetchBodies(peer string, start int, headers []HeaderRecord) ([]Block, error) {
+	blocks := make([]Block, 0, len(headers))
+	for len(blocks) < len(headers) {
+		from := start + len(blocks)
+		to := from + MaxBodiesPerRequest
+		if to > start+len(headers) {
+			to = start + len(headers)
+		}
+		res, err := PeerClient.Get(fmt.Sprintf("%s/bodies?from=%d&to=%d", peer, from, to))
+		if err != nil {
+			return nil, err
+		}
+		bodyBytes, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("peer refused to serve blocks %d-%d: %s", from, to, strings.TrimSpace(string(bodyBytes)))
+		}
+		var response BodiesResponse
+		if err = json.Unmarshal(bodyBytes, &response); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSyncData, err)
+		}
+		if response.Start != from || len(response.Blocks) == 0 {
+			return nil, fmt.Errorf("%w: wrong blocks for %d-%d", ErrInvalidSyncData, from, to)
+		}
+		for _, block := range response.Blocks {
+			height := start + len(blocks)
+			if height >= start+len(headers) || !VerifyBody(block, headers[height-start], height) {
+				return nil, fmt.Errorf("%w: block %d doesn't match its header", ErrInvalidSyncData, height)
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks, nil
+}
+
+// fetchLegacyChain downloads a peer's whole blockchain, for peers that don't support headers-first sync, and returns
+// it in the same form as FetchHeaders.
+func fetchLegacyChain(peer string) (int, []HeaderRecord, []Block, error) {
+	res, err := PeerClient.Get(fmt.Sprintf("%s/blockchain", peer))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	body, err := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		// Pruned peers can't serve the whole blockchain.
+		return 0, nil, nil, fmt.Errorf("peer refused to serve the blockchain: %s", res.Status)
+	}
+	var blocks []Block
+	if err = json.Unmarshal(body, &blocks); err != nil {
+		return 0, nil, nil, err
+	}
+	headers := make([]HeaderRecord, 0, len(blocks))
+	for height, block := range blocks {
+		headers = append(headers, HeaderRecord{
+			Header:       BlockHeader(block),
+			Hash:         HashBlock(block, height),
+			Transactions: len(ExtractTransactions(block)),
+		})
+	}
+	// Skip the blocks we already have
+	start := 0
+	for start < len(headers) && start < len(Blockchain) && headers[start].Hash == BlockHashAt(start) {
+		start++
+	}
+	return start, headers[start:], blocks[start:], nil
+}
+
+// syncCandidate is a peer's chain, as far as it differs from the blockchain.
+type syncCandidate struct {
+	Peer    string
+	Start   int            // Height of the first block that differs from the blockchain
+	Headers []HeaderRecord // Headers from Start onwards
+	Blocks  []Block        // Blocks from Start onwards, if they were already downloaded
+	// Cumulative work of the whole chain according to its headers, which only counts once the blocks are checked
+	ClaimedWork *big.Int
+}
+
+// fetchSyncCandidate downloads and verifies a peer's headers.
+func fetchSyncCandidate(peer string) (syncCandidate, error) {
+	candidate := syncCandidate{Peer: peer}
+	var err error
+	candidate.Start, candidate.Headers, err = FetchHeaders(peer)
+	if errors.Is(err, ErrHeadersUnsupported) {
+		candidate.Start, candidate.Headers, candidate.Blocks, err = fetchLegacyChain(peer)
+	}
+	if err != nil {
+		return candidate, err
+	}
+	if err = VerifyHeaders(candidate.Start, candidate.Headers); err != nil {
+		return candidate, fmt.Errorf("%w: %s", ErrInvalidSyncData, err)
+	}
+	candidate.ClaimedWork = ChainWork(Blockchain[:candidate.Start])
+	for _, record := range candidate.Headers {
+		candidate.ClaimedWork.Add(candidate.ClaimedWork, BlockWork(record.Header))
+	}
+	return candidate, nil
+}
+
+// syncFrom downloads the blocks of a candidate's chain that weren't downloaded with its headers, and switches to the
+// chain if the blocks have more work than the blockchain and are all valid. The other candidates may serve blocks on
+// the same chain. In fast-sync mode, blocks up to the latest checkpoint on the chain skip their signature and proof
+// checks.
+func syncFrom(candidate syncCandidate, candidates []syncCandidate) error {
+	blocks := candidate.Blocks
+	if blocks == nil {
+		sources := bodySources(candidate, candidates)
+		Log(fmt.Sprintf("Downloading %d blocks from %d peer(s)...", len(candidate.Headers), len(sources)), false)
+		var err error
+		if blocks, err = DownloadBodies(sources, candidate.Start, candidate.Headers); err != nil {
+			return err
+		}
+	}
+	// Count the work of the blocks themselves, not of their headers
+	work := ChainWork(Blockchain[:candidate.Start])
+	for i, block := range blocks {
+		if !VerifyProofOfWork(block, candidate.Start+i) {
+			return fmt.Errorf("%w: block %d has invalid proof of work", ErrInvalidSyncData, candidate.Start+i)
+		}
+		work.Add(work, BlockWork(block))
+	}
+	if work.Cmp(ChainWork(Blockchain)) <= 0 {
+		return fmt.Errorf("%w: blocks have less work than the blockchain", ErrInvalidSyncData)
+	}
+	trusted, err := trustBranch(candidate.Start, blocks)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSyncData, err)
+	}
+	trustedHeight = trusted
+	defer func() {
+		trustedHeight = -1
+	}()
+	_, err = Reorganize(candidate.Start, blocks, true)
+	return err
+}
@@ -15,17 +15,26 @@ import (
 )
 
 func DecodePublicKey(keyString string) PublicKey {
+	key, err := ParsePublicKey(keyString)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// ParsePublicKey decodes a public key encoded by EncodePublicKey, returning an error if it is malformed.
+func ParsePublicKey(keyString string) (PublicKey, error) {
 	key := PublicKey{
 		Y: []byte(""),
 	}
 	for _, ps := range strings.Split(strings.Trim(keyString, "[]"), " ") {
 		pi, err := strconv.ParseUint(ps, 10, 8)
 		if err != nil {
-			panic(err)
+			return PublicKey{}, err
 		}
 		key.Y = append(key.Y, byte(pi))
 	}
-	return key
+	return key, nil
 }
 
 func EncodePublicKey(key PublicKey) string {
@@ -0,0 +1,354 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Account holds the running totals GetBalance needs for a single public key.
+type Account struct {
+	Total       float64 // Amounts received and base fees redistributed, minus amounts sent, fees and tips paid
+	MiningTotal float64 // Block rewards, time verifier bonuses, fees and tips earned
+	BlocksMined int
+	FirstMined  int    // Height of the first block mined by the account
+	LastMined   int    // Height of the last block mined by the account
+	Nonce       uint64 // Nonce of the last transaction sent by the account
+}
+
+// ledgerUndo records what a block changed in the ledger, so the block can be rolled back exactly.
+type ledgerUndo struct {
+	cursor   ChainCursor         // The cursor before the block was applied
+	accounts map[string]*Account // The accounts before the block was applied (nil if the account didn't exist)
+}
+
+// ledgerBase is the ledger at the height a pruned node was pruned to.
+type ledgerBase struct {
+	cursor      ChainCursor
+	accounts    map[string]Account
+	minerCounts []int64
+	baseFees    []float64
+}
+
+// Ledger is an index of accounts keyed by public key, maintained incrementally as blocks are appended.
+//
+// The last LedgerUndoDepth blocks can be rolled back without rebuilding the ledger.
+// Deeper rollbacks rebuild it from the genesis block, or from the base snapshot on a pruned node.
+type Ledger struct {
+	cursor      ChainCursor
+	accounts    map[string]*Account
+	minerCounts []int64   // minerCounts[i] is the number of distinct miners of blocks 1 through i
+	baseFees    []float64 // baseFees[i] is the base fee of block i, up to the block after the last one applied
+	undo        []ledgerUndo
+	base        *ledgerBase
+	mutex       sync.Mutex
+}
+
+var AccountLedger = NewLedger()
+
+func NewLedger() *Ledger {
+	return &Ledger{
+		accounts: make(map[string]*Account),
+	}
+}
+
+func (l *Ledger) reset() {
+	l.cursor = ChainCursor{}
+	l.accounts = make(map[string]*Account)
+	l.minerCounts = nil
+	l.baseFees = nil
+	l.undo = nil
+	if l.base != nil && l.base.cursor.Valid() {
+		l.cursor = l.base.cursor
+		for key, account := range l.base.accounts {
+			account := account
+			l.accounts[key] = &account
+		}
+		l.minerCounts = append([]int64{}, l.base.minerCounts...)
+		l.baseFees = append([]float64{}, l.base.baseFees...)
+	}
+}
+
+// touch returns an account for modification, saving its previous value in the undo record.
+func (l *Ledger) touch(undo *ledgerUndo, key []byte) *Account {
+	account, ok := l.accounts[string(key)]
+	if _, saved := undo.accounts[string(key)]; !saved {
+		if ok {
+			previous := *account
+			undo.accounts[string(key)] = &previous
+		} else {
+			undo.accounts[string(key)] = nil
+		}
+	}
+	if !ok {
+		account = &Account{
+			FirstMined: -1,
+			LastMined:  -1,
+		}
+		l.accounts[string(key)] = account
+	}
+	return account
+}
+
+// apply adds the next block in the blockchain to the ledger.
+func (l *Ledger) apply() {
+	i := l.cursor.Height
+	block := BlockAt(i)
+	undo := ledgerUndo{
+		cursor:   l.cursor,
+		accounts: make(map[string]*Account),
+	}
+	if i == 0 {
+		// The genesis block has no miner, and its only transactions are the network's initial allocations.
+		l.minerCounts = append(l.minerCounts, 0)
+		l.baseFees = append(l.baseFees, TransactionFee)
+		for _, allocation := range ExtractTransactions(block) {
+			recipient := l.touch(&undo, allocation.Recipient.Y)
+			recipient.Total += allocation.Amount
+		}
+	} else {
+		minerCount := l.minerCounts[i-1]
+		if !l.mined(block.Miner.Y, i-1) {
+			minerCount++
+		}
+		l.minerCounts = append(l.minerCounts, minerCount)
+		baseFee := l.baseFees[i]
+		var transactions []Transaction // Transactions that were applied, which the miner earns fees for
+		for _, transaction := range ExtractTransactions(block) {
+			sender := l.touch(&undo, transaction.Sender.Y)
+			if NoncesActive(i) && !transaction.FromSmartContract {
+				if transaction.Nonce != sender.Nonce+1 {
+					continue // A replayed or out of order transaction doesn't move any funds
+				}
+				sender.Nonce = transaction.Nonce
+			}
+			transactions = append(transactions, transaction)
+			sender.Total -= transaction.Amount + transaction.Tip
+			if i > 50 { // Fees start after 50 blocks
+				sender.Total -= BaseFees(transaction, baseFee)
+			}
+			if !bytes.Equal(transaction.Sender.Y, transaction.Recipient.Y) {
+				recipient := l.touch(&undo, transaction.Recipient.Y)
+				recipient.Total += transaction.Amount
+			}
+		}
+		miner := l.touch(&undo, block.Miner.Y)
+		lastBlock := Blockchain[i-1]
+		miner.MiningTotal += float64(len(block.TimeVerifiers)-len(lastBlock.TimeVerifiers)) * 0.1
+		if i > 50 { // Fees start after 50 blocks
+			fees := 0.0
+			for _, transaction := range transactions {
+				fees += BaseFees(transaction, baseFee)
+			}
+			if !FeeMarketActive(i) {
+				miner.MiningTotal += fees
+			} else if BaseFeeDestination == BaseFeeRedistribute && len(block.TimeVerifiers) > 0 {
+				share := fees / float64(len(block.TimeVerifiers))
+				for _, verifier := range block.TimeVerifiers {
+					l.touch(&undo, verifier.Y).Total += share
+				}
+			} // Otherwise the base fees are burned
+		}
+		for _, transaction := range transactions {
+			miner.MiningTotal += transaction.Tip // Tips are paid even before fees start
+		}
+		miner.MiningTotal += CalculateBlockReward(minerCount, i)
+		miner.BlocksMined++
+		if miner.FirstMined == -1 {
+			miner.FirstMined = i
+		}
+		miner.LastMined = i
+	}
+	l.baseFees = append(l.baseFees, NextBaseFee(l.baseFees[i], block, i+1))
+	l.cursor.Advance()
+	l.undo = append(l.undo, undo)
+	if len(l.undo) > LedgerUndoDepth {
+		l.undo = l.undo[1:]
+	}
+}
+
+// revert rolls back the last block applied to the ledger. It returns false if there is no undo record left.
+func (l *Ledger) revert() bool {
+	if len(l.undo) == 0 {
+		return false
+	}
+	undo := l.undo[len(l.undo)-1]
+	l.undo = l.undo[:len(l.undo)-1]
+	for key, account := range undo.accounts {
+		if account == nil {
+			delete(l.accounts, key)
+		} else {
+			l.accounts[key] = account
+		}
+	}
+	l.minerCounts = l.minerCounts[:undo.cursor.Height]
+	if undo.cursor.Height == 0 {
+		l.baseFees = nil
+	} else {
+		l.baseFees = l.baseFees[:undo.cursor.Height+1]
+	}
+	l.cursor = undo.cursor
+	return true
+}
+
+func (l *Ledger) update() {
+	for !l.cursor.Valid() {
+		if !l.revert() {
+			l.reset()
+		}
+	}
+	for l.cursor.Height < len(Blockchain) {
+		l.apply()
+	}
+}
+
+// Update applies any blocks appended since the last update, rolling back first if the blockchain was rewritten.
+func (l *Ledger) Update() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.update()
+}
+
+// Rollback removes blocks at or above the given height from the ledger.
+func (l *Ledger) Rollback(height int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.cursor.Height > height {
+		if !l.revert() {
+			l.reset()
+		}
+	}
+}
+
+// Account returns a copy of the account for a public key, and whether the account exists.
+func (l *Ledger) Account(key []byte) (Account, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.update()
+	account, ok := l.accounts[string(key)]
+	if !ok {
+		return Account{FirstMined: -1, LastMined: -1}, false
+	}
+	return *account, true
+}
+
+// Balance calculates the balance of a public key, giving the same result as scanning the whole blockchain.
+func (l *Ledger) Balance(key []byte) float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.update()
+	account, ok := l.accounts[string(key)]
+	if !ok {
+		return 0
+	}
+	total := account.Total
+	if account.BlocksMined > BlocksBeforeReward && l.cursor.Height > 50 {
+		total += account.MiningTotal - float64(BlocksBeforeReward)
+	} else if l.cursor.Height < 50 {
+		total += account.MiningTotal
+	}
+	return total
+}
+
+// mined reports whether a public key mined any of blocks 1 through maxBlockPosition.
+func (l *Ledger) mined(key []byte, maxBlockPosition int) bool {
+	account, ok := l.accounts[string(key)]
+	return ok && account.FirstMined != -1 && account.FirstMined <= maxBlockPosition
+}
+
+// IsNewMiner reports whether a public key has not mined any of blocks 1 through maxBlockPosition.
+func (l *Ledger) IsNewMiner(key []byte, maxBlockPosition int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.update()
+	return !l.mined(key, maxBlockPosition)
+}
+
+// MinerCount returns the number of distinct miners of blocks 1 through maxBlockPosition.
+func (l *Ledger) MinerCount(maxBlockPosition int) int64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.update()
+	if len(l.minerCounts) == 0 || maxBlockPosition < 0 {
+		return 0
+	}
+	if maxBlockPosition >= len(l.minerCounts) {
+		maxBlockPosition = len(l.minerCounts) - 1
+	}
+	return l.minerCounts[maxBlockPosition]
+}
+
+// BaseFee returns the base fee of the block at a height, up to the block after the last one in the blockchain.
+func (l *Ledger) BaseFee(height int) float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.update()
+	if len(l.baseFees) == 0 || height < 0 {
+		return TransactionFee
+	}
+	if height >= len(l.baseFees) {
+		height = len(l.baseFees) - 1
+	}
+	return l.baseFees[height]
+}
+
+// Prune makes the ledger at the given height the base snapshot, so blocks below it no longer need their transactions.
+//
+// The height must be within the last LedgerUndoDepth blocks. The accounts, miner counts and base fees at that height
+// are returned, so they can be persisted alongside the pruned block store.
+func (l *Ledger) Prune(height int) (map[string]Account, []int64, []float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.update()
+	if height > l.cursor.Height || height < l.cursor.Height-len(l.undo) {
+		panic(fmt.Sprintf("cannot prune the ledger at height %d", height))
+	}
+	accounts := make(map[string]Account)
+	for key, account := range l.accounts {
+		accounts[key] = *account
+	}
+	i := len(l.undo) - 1
+	for ; i >= 0 && l.undo[i].cursor.Height >= height; i-- {
+		for key, account := range l.undo[i].accounts {
+			if account == nil {
+				delete(accounts, key)
+			} else {
+				accounts[key] = *account
+			}
+		}
+	}
+	l.undo = l.undo[i+1:]
+	l.base = &ledgerBase{
+		cursor:      NewChainCursor(height),
+		accounts:    accounts,
+		minerCounts: append([]int64{}, l.minerCounts[:height]...),
+		baseFees:    append([]float64{}, l.baseFees[:height+1]...),
+	}
+	return accounts, l.base.minerCounts, l.base.baseFees
+}
+
+// SetBase installs a base snapshot loaded from disk. The blockchain must already contain the snapshot's height.
+func (l *Ledger) SetBase(height int, accounts map[string]Account, minerCounts []int64, baseFees []float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for len(baseFees) < height+1 {
+		// Snapshots from before the fee market don't have base fees
+		baseFees = append(baseFees, TransactionFee)
+	}
+	l.base = &ledgerBase{
+		cursor:      NewChainCursor(height),
+		accounts:    accounts,
+		minerCounts: minerCounts,
+		baseFees:    baseFees,
+	}
+	l.reset()
+	l.update()
+}
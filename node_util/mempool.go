@@ -0,0 +1,488 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MempoolEntry is a pending transaction, along with everything needed to mine it.
+type MempoolEntry struct {
+	Transaction Transaction
+	Hash        [32]byte
+	Generated   []Transaction   // Transactions created by the transaction's smart contracts, mined alongside it
+	Transition  StateTransition // State changes made by the transaction's smart contracts
+	Fee         float64         // Fees and tip paid to the miner (only the tip from the Oslo upgrade)
+	BaseFees    float64         // Base fees paid from the Oslo upgrade, which don't go to the miner
+	Size        int             // Size of the transaction and its generated transactions, in bytes
+	Gas         float64         // Gas used by the transaction's smart contracts
+	sequence    uint64          // Arrival order
+}
+
+// FeeRate is the fee paid per byte, which decides the entry's priority.
+func (e *MempoolEntry) FeeRate() float64 {
+	if e.Size == 0 {
+		return e.Fee
+	}
+	return e.Fee / float64(e.Size)
+}
+
+// higherPriority reports whether entry a should be mined before entry b (ignoring sender ordering).
+func higherPriority(a *MempoolEntry, b *MempoolEntry) bool {
+	if a.FeeRate() != b.FeeRate() {
+		return a.FeeRate() > b.FeeRate()
+	}
+	if !a.Transaction.Timestamp.Equal(b.Transaction.Timestamp) {
+		return a.Transaction.Timestamp.Before(b.Transaction.Timestamp)
+	}
+	return bytes.Compare(a.Hash[:], b.Hash[:]) < 0
+}
+
+// senderOrder reports whether entry a must be mined before entry b, where both are from the same sender.
+func senderOrder(a *MempoolEntry, b *MempoolEntry) bool {
+	if a.Transaction.Nonce != b.Transaction.Nonce {
+		return a.Transaction.Nonce < b.Transaction.Nonce
+	}
+	if !a.Transaction.Timestamp.Equal(b.Transaction.Timestamp) {
+		return a.Transaction.Timestamp.Before(b.Transaction.Timestamp)
+	}
+	return bytes.Compare(a.Hash[:], b.Hash[:]) < 0
+}
+
+var ErrMempoolDuplicate = errors.New("transaction is already in the mempool")
+var ErrMempoolFull = errors.New("mempool is full and the transaction's fee rate is too low")
+var ErrReplacementUnderpriced = errors.New("a pending transaction with this nonce pays a fee the replacement doesn't beat by enough")
+var ErrTransactionMined = errors.New("transaction has already been mined")
+var ErrTransactionExpired = errors.New("transaction has expired")
+var ErrStaleNonce = errors.New("transaction nonce has already been used")
+var ErrInvalidTransaction = errors.New("transaction signature is invalid or the sender can't afford it")
+
+// Mempool holds the transactions waiting to be mined.
+//
+// Entries are kept in per-sender queues, sorted by nonce, so a sender's transactions are always mined in order.
+// The pool is bounded by MaxTransactions and MaxBytes; when it is full, the lowest-priority
+// entry at the end of a sender's queue is evicted to make room for a higher-priority one.
+// It is safe to use from the HTTP handlers and the miner at the same time.
+type Mempool struct {
+	MaxTransactions int
+	MaxBytes        int
+	entries         map[[32]byte]*MempoolEntry
+	bySender        map[string][]*MempoolEntry
+	size            int
+	sequence        uint64
+	version         uint64
+	mutex           sync.Mutex
+}
+
+var Pool = NewMempool()
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		MaxTransactions: MaxMempoolTransactions,
+		MaxBytes:        MaxMempoolBytes,
+		entries:         make(map[[32]byte]*MempoolEntry),
+		bySender:        make(map[string][]*MempoolEntry),
+	}
+}
+
+// NewMempoolEntry creates an entry for a transaction, along with the transactions and state changes created by its
+// smart contracts (see PrepareTransaction).
+func NewMempoolEntry(transaction Transaction, generated []Transaction, transition StateTransition) *MempoolEntry {
+	entry := &MempoolEntry{
+		Transaction: transaction,
+		Hash:        TransactionHash(transaction),
+		Generated:   generated,
+		Transition:  transition,
+		Fee:         MinerFees(transaction, len(Blockchain)),
+	}
+	if FeeMarketActive(len(Blockchain)) {
+		entry.BaseFees = BaseFees(transaction, BaseFee(len(Blockchain)))
+	}
+	usage := MeasureTransactions(append([]Transaction{transaction}, generated...))
+	entry.Size, entry.Gas = usage.Bytes, usage.Gas
+	return entry
+}
+
+// TotalFee is everything the sender pays to have the transaction mined, which decides whether it can be replaced.
+func (e *MempoolEntry) TotalFee() float64 {
+	return e.Fee + e.BaseFees
+}
+
+// Usage returns how much of a block the entry takes up.
+func (e *MempoolEntry) Usage() BlockUsage {
+	return BlockUsage{Bytes: e.Size, Gas: e.Gas, Transactions: 1 + len(e.Generated)}
+}
+
+// TransactionFees returns the fees paid by a transaction once fees are active, not counting its tip.
+func TransactionFees(transaction Transaction) float64 {
+	fee := TransactionFee + BodyFeePerByte*float64(len(transaction.Body))
+	for _, contract := range transaction.Contracts {
+		fee += GasPrice * contract.GasUsed
+	}
+	return fee
+}
+
+// Add adds an entry to the pool, evicting lower-priority entries if the pool is full.
+//
+// An entry that replaces a pending transaction (see ReplacesTransaction) evicts it, as long as it pays at least
+// ReplacementFeeBump times its total fee.
+func (m *Mempool) Add(entry *MempoolEntry) error {
+	return m.add(entry, nil)
+}
+
+// add adds an entry to the pool like Add. If affordable isn't nil, it is given what the sender's other pending
+// transactions spend, and the entry is only added if it returns true. Both happen under the pool's lock, so concurrent
+// transactions from one sender can't overspend together.
+func (m *Mempool) add(entry *MempoolEntry, affordable func(spent float64) bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.entries[entry.Hash]; ok {
+		return ErrMempoolDuplicate
+	}
+	var replaced []*MempoolEntry
+	var spent float64
+	for _, queued := range m.bySender[string(entry.Transaction.Sender.Y)] {
+		if ReplacesTransaction(entry.Transaction, queued.Transaction) {
+			if entry.TotalFee() < queued.TotalFee()*ReplacementFeeBump {
+				return ErrReplacementUnderpriced
+			}
+			replaced = append(replaced, queued)
+			continue
+		}
+		spent += transactionCost(NodeChain, queued.Transaction)
+	}
+	if affordable != nil && !affordable(spent) {
+		return &ValidationError{Code: ReasonDoubleSpend, Message: "sender can't afford the transaction with their pending transactions", Err: ErrInvalidTransaction}
+	}
+	for _, queued := range replaced {
+		m.remove(queued.Hash)
+	}
+	for len(m.entries) >= m.MaxTransactions || m.size+entry.Size > m.MaxBytes {
+		victim := m.lowestPriorityTail()
+		if victim == nil || !higherPriority(entry, victim) {
+			for _, queued := range replaced {
+				m.insert(queued)
+			}
+			return ErrMempoolFull
+		}
+		Log("Evicting low-priority transaction from the mempool.", true)
+		m.remove(victim.Hash)
+	}
+	if len(replaced) > 0 {
+		Log(fmt.Sprintf("Replacing %d pending transaction(s) with a higher-fee transaction.", len(replaced)), true)
+	}
+	m.sequence++
+	entry.sequence = m.sequence
+	m.insert(entry)
+	return nil
+}
+
+func (m *Mempool) insert(entry *MempoolEntry) {
+	m.entries[entry.Hash] = entry
+	sender := string(entry.Transaction.Sender.Y)
+	queue := append(m.bySender[sender], entry)
+	sort.SliceStable(queue, func(i, j int) bool { return senderOrder(queue[i], queue[j]) })
+	m.bySender[sender] = queue
+	m.size += entry.Size
+	m.version++
+}
+
+// lowestPriorityTail finds the lowest-priority entry that is last in its sender's queue, so evicting it
+// doesn't leave a gap in the sender's transactions.
+func (m *Mempool) lowestPriorityTail() *MempoolEntry {
+	var victim *MempoolEntry
+	for _, queue := range m.bySender {
+		tail := queue[len(queue)-1]
+		if victim == nil || higherPriority(victim, tail) {
+			victim = tail
+		}
+	}
+	return victim
+}
+
+func (m *Mempool) remove(hash [32]byte) bool {
+	entry, ok := m.entries[hash]
+	if !ok {
+		return false
+	}
+	delete(m.entries, hash)
+	sender := string(entry.Transaction.Sender.Y)
+	queue := m.bySender[sender]
+	for i, queued := range queue {
+		if queued == entry {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(m.bySender, sender)
+	} else {
+		m.bySender[sender] = queue
+	}
+	m.size -= entry.Size
+	m.version++
+	return true
+}
+
+// Remove removes a transaction from the pool, reporting whether it was there.
+func (m *Mempool) Remove(hash [32]byte) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.remove(hash)
+}
+
+// RemoveIncluded removes every transaction in a block from the pool, since they no longer need to be mined.
+//
+// Pending transactions from the block's senders whose nonces have now been used are removed too.
+func (m *Mempool) RemoveIncluded(block Block) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	senders := make(map[string]bool)
+	for _, transaction := range ExtractTransactions(block) {
+		m.remove(TransactionHash(transaction))
+		senders[string(transaction.Sender.Y)] = true
+	}
+	for sender := range senders {
+		queue := m.bySender[sender]
+		if len(queue) == 0 {
+			continue
+		}
+		nonce := AccountNonce([]byte(sender))
+		for _, entry := range queue {
+			if entry.Transaction.Nonce != 0 && entry.Transaction.Nonce <= nonce {
+				m.remove(entry.Hash)
+			}
+		}
+	}
+}
+
+// RemoveExpired removes every transaction that can no longer be mined in a block at the given height and time.
+func (m *Mempool) RemoveExpired(height int, timestamp time.Time) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	removed := 0
+	for hash, entry := range m.entries {
+		if TransactionExpired(entry.Transaction, height, timestamp) {
+			m.remove(hash)
+			removed++
+		}
+	}
+	if removed > 0 {
+		Log(fmt.Sprintf("Dropped %d expired transaction(s) from the mempool.", removed), true)
+	}
+	return removed
+}
+
+// Contains reports whether a transaction is in the pool.
+func (m *Mempool) Contains(hash [32]byte) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.entries[hash]
+	return ok
+}
+
+// Get returns the pool entry for a transaction.
+func (m *Mempool) Get(hash [32]byte) (MempoolEntry, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry, ok := m.entries[hash]
+	if !ok {
+		return MempoolEntry{}, false
+	}
+	return *entry, true
+}
+
+// Len returns the number of transactions in the pool.
+func (m *Mempool) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.entries)
+}
+
+// Version changes every time the pool's contents change, so the miner can tell when to rebuild its block.
+func (m *Mempool) Version() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.version
+}
+
+// SenderTransactions returns the pending transactions from a sender, in the order they will be mined.
+func (m *Mempool) SenderTransactions(sender []byte) []Transaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var transactions []Transaction
+	for _, entry := range m.bySender[string(sender)] {
+		transactions = append(transactions, entry.Transaction)
+	}
+	return transactions
+}
+
+// PendingTransitions returns the state changes made by every pending transaction, in arrival order.
+func (m *Mempool) PendingTransitions() []StateTransition {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entries := make([]*MempoolEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].sequence < entries[j].sequence })
+	transitions := make([]StateTransition, 0, len(entries))
+	for _, entry := range entries {
+		transitions = append(transitions, entry.Transition)
+	}
+	return transitions
+}
+
+// Select chooses up to `limit` entries to mine, highest fee rate first, keeping each sender's transactions in order.
+// Only transactions within their validity window for the next block, with the given timestamp, are chosen.
+//
+// The selection only depends on the pool's contents and the timestamp, so the same pool always produces the same block.
+func (m *Mempool) Select(limit int, timestamp time.Time) []MempoolEntry {
+	return m.selectEntries(limit, nil, timestamp)
+}
+
+// Pack chooses entries to mine as Select does, until the block is full. An entry that would take the block past any
+// of the limits is left in the pool, along with the rest of its sender's transactions, and smaller entries from other
+// senders are chosen instead.
+func (m *Mempool) Pack(limits BlockUsage, timestamp time.Time) []MempoolEntry {
+	return m.selectEntries(limits.Transactions, &limits, timestamp)
+}
+
+func (m *Mempool) selectEntries(limit int, limits *BlockUsage, timestamp time.Time) []MempoolEntry {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	positions := make(map[string]int)
+	nonces := make(map[string]uint64)
+	full := make(map[string]bool) // Senders whose next transaction doesn't fit in the block
+	var usage BlockUsage
+	var selected []MempoolEntry
+	for len(selected) < limit {
+		// Pick the highest-priority entry at the front of any sender's remaining queue.
+		var best *MempoolEntry
+		for sender, queue := range m.bySender {
+			if positions[sender] >= len(queue) || full[sender] {
+				continue
+			}
+			head := queue[positions[sender]]
+			if !TransactionStarted(head.Transaction, len(Blockchain), timestamp) || TransactionExpired(head.Transaction, len(Blockchain), timestamp) {
+				continue // A sender's transactions wait behind one that is outside its validity window
+			}
+			if limits != nil && !usage.Add(head.Usage()).Within(*limits) {
+				full[sender] = true // The block only gets fuller, so the transaction won't fit later either
+				continue
+			}
+			if head.Transaction.Nonce != 0 {
+				// A sender's transactions can only be mined once every earlier nonce has been.
+				if _, ok := nonces[sender]; !ok {
+					nonces[sender] = AccountNonce([]byte(sender))
+				}
+				if head.Transaction.Nonce != nonces[sender]+1 {
+					continue
+				}
+			}
+			if best == nil || higherPriority(head, best) {
+				best = head
+			}
+		}
+		if best == nil {
+			break
+		}
+		sender := string(best.Transaction.Sender.Y)
+		positions[sender]++
+		usage = usage.Add(best.Usage())
+		if best.Transaction.Nonce != 0 {
+			nonces[sender] = best.Transaction.Nonce
+		}
+		selected = append(selected, *best)
+	}
+	return selected
+}
+
+// Reinject puts transactions from blocks that were removed from the blockchain back into the pool.
+//
+// Transactions created by smart contracts are skipped, since they are recreated when their parent is executed again.
+// Transactions that are no longer valid are dropped.
+func (m *Mempool) Reinject(transactions []Transaction) {
+	for _, transaction := range transactions {
+		if transaction.FromSmartContract {
+			continue
+		}
+		if m.Contains(TransactionHash(transaction)) {
+			continue
+		}
+		if err := m.Accept(transaction); err != nil {
+			Log("Dropping reorged transaction: "+err.Error(), true)
+		}
+	}
+}
+
+// Accept checks a signed transaction against the blockchain, and that its sender can afford it on top of their other
+// pending transactions, then executes its smart contracts and adds it to the pool, journaling it if the journal is open.
+func (m *Mempool) Accept(transaction Transaction) error {
+	hash := TransactionHash(transaction)
+	if _, ok := TxIndex.Lookup(hash); ok {
+		return ErrTransactionMined
+	}
+	if !VerifyPendingNonce(transaction) {
+		return ErrStaleNonce
+	}
+	if !VerifyTips([]Transaction{transaction}, len(Blockchain)) {
+		return &ValidationError{Code: ReasonBadTip, Message: "invalid tip", Err: ErrInvalidTransaction}
+	}
+	if (transaction.ValidAfter != 0 || transaction.ValidUntil != 0) && !NoncesActive(len(Blockchain)) {
+		return &ValidationError{Code: ReasonOutsideValidityWindow, Message: "validity windows aren't active yet", Err: ErrInvalidTransaction}
+	}
+	if TransactionExpired(transaction, len(Blockchain), time.Now()) {
+		return ErrTransactionExpired
+	}
+	if err := CheckTransaction(NodeChain, NodeState, transaction); err != nil {
+		return err
+	}
+	entry := PrepareTransaction(transaction)
+	if BlockLimitsActive(len(Blockchain)) && !entry.Usage().Within(BlockLimits(len(Blockchain))) {
+		return &ValidationError{Code: ReasonExceedsBlockLimits, Message: "transaction can't fit in a block", Err: ErrInvalidTransaction}
+	}
+	affordable := func(spent float64) bool {
+		return validateTransactionBalance(NodeChain, NodeState, transaction, spent)
+	}
+	if err := m.add(entry, affordable); err != nil {
+		return err
+	}
+	if err := JournalTransaction(entry.Transaction); err != nil {
+		m.Remove(hash)
+		return fmt.Errorf("could not journal the transaction: %w", err)
+	}
+	// Drop any transactions the new one replaced or evicted from the journal
+	PruneJournal()
+	return nil
+}
+
+// PrepareTransaction executes a transaction's smart contracts and creates its mempool entry.
+func PrepareTransaction(transaction Transaction) *MempoolEntry {
+	var generated []Transaction
+	transition := StateTransition{}
+	for i, contract := range transaction.Contracts {
+		executeResult, contractTransition, gasUsed, err := contract.Execute(GetBalance(transaction.Sender.Y)/GasPrice, transaction.Sender)
+		transition = contractTransition
+		if err != nil {
+			Warn("Error executing contract: " + err.Error())
+			continue
+		}
+		if executeResult != nil {
+			generated = append(generated, executeResult...)
+		}
+		transaction.Contracts[i].GasUsed = gasUsed
+	}
+	return NewMempoolEntry(transaction, generated, transition)
+}
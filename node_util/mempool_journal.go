@@ -0,0 +1,258 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Overview
+// A mining node journals every transaction it accepts into its mempool, so pending transactions survive a restart.
+// Each transaction is appended to the journal as a chain export record ([length][crc32][transaction]) and synced
+// before the mine request returns, so a transaction that can't be journaled is refused. Whenever transactions leave
+// the mempool (because they were mined, replaced, evicted or expired), the journal is rewritten without them.
+// On startup, the journal is replayed into the mempool. Transactions that have since been mined or are no longer
+// valid are dropped, as is a record cut off by a crash.
+
+const MempoolJournalFile = "mempool.journal"
+
+var Journal *MempoolJournal
+
+// MempoolJournal is an append-only file of the transactions waiting to be mined.
+type MempoolJournal struct {
+	path         string
+	file         *os.File
+	transactions map[[32]byte]Transaction
+	order        [][32]byte
+	mutex        sync.Mutex
+}
+
+// OpenMempoolJournal opens a journal for appending, creating it if it doesn't exist.
+//
+// The journal starts out empty in memory; LoadMempoolJournal replays what is already on disk.
+func OpenMempoolJournal(path string) (*MempoolJournal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &MempoolJournal{
+		path:         path,
+		file:         file,
+		transactions: make(map[[32]byte]Transaction),
+	}, nil
+}
+
+// Append journals a transaction, syncing it to disk before returning.
+func (j *MempoolJournal) Append(transaction Transaction) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	hash := TransactionHash(transaction)
+	if _, ok := j.transactions[hash]; ok {
+		return nil
+	}
+	if err := writeChainRecord(j.file, EncodeTransaction(transaction)); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.transactions[hash] = transaction
+	j.order = append(j.order, hash)
+	return nil
+}
+
+// Retain drops the transactions that keep rejects from the journal, rewriting it if any were dropped.
+func (j *MempoolJournal) Retain(keep func(hash [32]byte) bool) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	var order [][32]byte
+	for _, hash := range j.order {
+		if keep(hash) {
+			order = append(order, hash)
+		} else {
+			delete(j.transactions, hash)
+		}
+	}
+	if len(order) == len(j.order) {
+		return nil
+	}
+	j.order = order
+	return j.rewrite()
+}
+
+// Reset replaces the journal's contents with the given transactions.
+func (j *MempoolJournal) Reset(transactions []Transaction) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.transactions = make(map[[32]byte]Transaction)
+	j.order = nil
+	for _, transaction := range transactions {
+		hash := TransactionHash(transaction)
+		if _, ok := j.transactions[hash]; ok {
+			continue
+		}
+		j.transactions[hash] = transaction
+		j.order = append(j.order, hash)
+	}
+	return j.rewrite()
+}
+
+// Len returns the number of transactions in the journal.
+func (j *MempoolJournal) Len() int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return len(j.order)
+}
+
+func (j *MempoolJournal) rewrite() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	err := WriteFileAtomicFunc(j.path, 0600, func(w io.Writer) error {
+		for _, hash := range j.order {
+			if err := writeChainRecord(w, EncodeTransaction(j.transactions[hash])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	// Reopen the journal even if the rewrite failed, since the original is left untouched.
+	file, openErr := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if openErr != nil {
+		return openErr
+	}
+	j.file = file
+	return err
+}
+
+// Close closes the journal file.
+func (j *MempoolJournal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.file.Close()
+}
+
+// ReadMempoolJournal reads the transactions in a journal file.
+//
+// Reading stops at the first incomplete or corrupt record, since that is where a crash interrupted a write.
+func ReadMempoolJournal(path string) ([]Transaction, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			panic(err)
+		}
+	}(file)
+	reader := bufio.NewReader(file)
+	var transactions []Transaction
+	for {
+		payload, err := readChainRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return transactions, nil
+		}
+		if err != nil {
+			Warn(fmt.Sprintf("Ignoring the rest of %s after an interrupted write: %s", path, err.Error()))
+			return transactions, nil
+		}
+		transaction, err := DecodeTransaction(payload)
+		if err != nil {
+			Warn(fmt.Sprintf("Ignoring the rest of %s after an interrupted write: %s", path, err.Error()))
+			return transactions, nil
+		}
+		transactions = append(transactions, transaction)
+	}
+}
+
+// repairJournal keeps the records of the mempool journal up to the first incomplete or corrupt one.
+func repairJournal(data []byte) ([]byte, bool) {
+	reader := bytes.NewReader(data)
+	valid := 0
+	for {
+		payload, err := readChainRecord(reader)
+		if err != nil {
+			break
+		}
+		if _, err = DecodeTransaction(payload); err != nil {
+			break
+		}
+		valid = len(data) - reader.Len()
+	}
+	return data[:valid], true
+}
+
+// JournalTransaction journals a transaction accepted into the mempool, if the journal is open.
+func JournalTransaction(transaction Transaction) error {
+	if Journal == nil {
+		return nil
+	}
+	return Journal.Append(transaction)
+}
+
+// PruneJournal drops the transactions that are no longer in the mempool from the journal, if the journal is open.
+func PruneJournal() {
+	if Journal == nil {
+		return
+	}
+	if err := Journal.Retain(Pool.Contains); err != nil {
+		// Transactions left in the journal are checked again when it is replayed
+		Warn("Could not update the mempool journal: " + err.Error())
+	}
+}
+
+// LoadMempoolJournal opens the mempool journal and replays it into the mempool.
+//
+// Each transaction is checked again against the current blockchain. The journal is then rewritten with only the
+// transactions that made it back into the mempool.
+func LoadMempoolJournal() {
+	transactions, err := ReadMempoolJournal(MempoolJournalFile)
+	if err != nil {
+		panic(err)
+	}
+	for _, transaction := range transactions {
+		if Pool.Contains(TransactionHash(transaction)) {
+			continue
+		}
+		if err = Pool.Accept(transaction); err != nil {
+			Log("Dropping journaled transaction: "+err.Error(), true)
+		}
+	}
+	// Transactions replaced by later journaled transactions are no longer in the pool
+	var restored []Transaction
+	for _, transaction := range transactions {
+		if Pool.Contains(TransactionHash(transaction)) {
+			restored = append(restored, transaction)
+		}
+	}
+	// The journal is opened after replaying, so replayed transactions aren't journaled twice.
+	if Journal == nil {
+		journal, err := OpenMempoolJournal(MempoolJournalFile)
+		if err != nil {
+			panic(err)
+		}
+		Journal = journal
+	}
+	if err = Journal.Reset(restored); err != nil {
+		panic(err)
+	}
+	if len(restored) > 0 {
+		Log(fmt.Sprintf("Restored %d pending transactions from the mempool journal.", len(restored)), false)
+	}
+}
@@ -91,3 +91,19 @@ func Merge(initial []MerkleNode, delta []MerkleNode) []MerkleNode {
 	}
 	return initial
 }
+
+// CloneTree returns a deep copy of a merkle tree.
+func CloneTree(tree []MerkleNode) []MerkleNode {
+	res := make([]MerkleNode, len(tree))
+	for i, node := range tree {
+		res[i] = node
+		if node.Data != nil {
+			res[i].Data = append([]byte{}, node.Data...)
+		}
+		res[i].Children = make(map[byte]int, len(node.Children))
+		for key, child := range node.Children {
+			res[i].Children[key] = child
+		}
+	}
+	return res
+}
@@ -14,8 +14,6 @@ import (
 	"strings"
 )
 
-var NextTransitions = make(map[[32]byte]StateTransition)
-
 // Mine mines a block by creating a new block and broadcasting it to peers.
 //
 // This function continuously mines blocks by calling the CreateBlock function.
@@ -33,22 +31,27 @@ func Mine() {
 			continue
 		}
 		Log("Block mined successfully!", false)
-		Log("Broadcasting block to peers...", true)
-		bodyChars, err := json.Marshal(&block)
+		BroadcastBlock(block)
+		Log("All done!", false)
+	}
+}
+
+// BroadcastBlock sends a block to every peer's "/block" endpoint.
+func BroadcastBlock(block Block) {
+	Log("Broadcasting block to peers...", true)
+	bodyChars, err := json.Marshal(&block)
+	if err != nil {
+		panic(err)
+	}
+	for _, peer := range GetPeers() {
+		body := strings.NewReader(string(bodyChars))
+		req, err := http.NewRequest(http.MethodGet, peer+"/block", body)
 		if err != nil {
 			panic(err)
 		}
-		for _, peer := range GetPeers() {
-			body := strings.NewReader(string(bodyChars))
-			req, err := http.NewRequest(http.MethodGet, peer+"/block", body)
-			if err != nil {
-				panic(err)
-			}
-			_, err = http.DefaultClient.Do(req)
-			if err != nil {
-				Log("Peer down.", true)
-			}
+		_, err = PeerClient.Do(req)
+		if err != nil {
+			Log("Peer down.", true)
 		}
-		Log("All done!", false)
 	}
 }
@@ -0,0 +1,245 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Overview
+// Each network (testnet, devnet, regtest) has its own chain parameters and genesis block, in the networks/<name>
+// directory. params.json sets the fee constants and fee market, the difficulty floor, the block limits and the seed
+// peers, and genesis.json sets the genesis block's timestamp and the initial allocations of tokens. LoadEnv loads the
+// network named in env.json, and copies its parameters into the package globals the rest of the node reads.
+// Networks with a history (testnet) take their upgrade heights from env.json, so an upgrade can be scheduled ahead of
+// the chain. Networks started after the upgrades (devnet, regtest) fix them under `upgrades` in params.json instead,
+// which replaces env.json's.
+//
+// A node's network ID is the network's name followed by its genesis block hash. Every request between nodes carries
+// the sender's network ID in the NetworkHeader header, and every response carries the server's. Nodes refuse requests
+// and responses from other networks, so nodes on different networks never sync, mine or verify time for each other.
+// Nodes from before networks were introduced don't send a network ID. Their requests are still served, like those of
+// tools such as curl, but their responses are only accepted once their "/info" shows the same genesis block. Nodes
+// from before "/info" showed the genesis block were all on LegacyNetwork, so their responses are accepted by nodes on
+// it and refused by the rest. Only requests to other nodes, which are sent with PeerClient, carry the network ID.
+
+var ErrWrongNetwork = errors.New("peer is on a different network")
+
+const NetworkHeader = "X-Network-Id"
+const LegacyNetwork = "testnet" // The network every node was on before networks were introduced
+
+// PeerClient is the HTTP client for requests to other nodes. LoadNetwork gives it a transport that sends the node's
+// network ID and refuses responses from other networks.
+var PeerClient = &http.Client{}
+
+// Allocation gives tokens to a public key in the genesis block.
+type Allocation struct {
+	Key    string  `json:"key"` // Hex public key
+	Amount float64 `json:"amount"`
+}
+
+// Genesis defines a network's genesis block.
+type Genesis struct {
+	Timestamp   time.Time    `json:"timestamp"`
+	Allocations []Allocation `json:"allocations"`
+}
+
+// NetworkParams are the chain parameters of a network.
+type NetworkParams struct {
+	Name                   string          `json:"-"`
+	TransactionFee         float64         `json:"transactionFee"`
+	BodyFeePerByte         float64         `json:"bodyFeePerByte"`
+	GasPrice               float64         `json:"gasPrice"`
+	BlocksBeforeReward     int             `json:"blocksBeforeReward"`
+	InitialBlockDifficulty uint64          `json:"initialBlockDifficulty"`
+	MinimumBlockDifficulty uint64          `json:"minimumBlockDifficulty"`
+	MaxBlockBytes          int             `json:"maxBlockBytes"`
+	MaxBlockGas            float64         `json:"maxBlockGas"`
+	MaxBlockTransactions   int             `json:"maxBlockTransactions"`
+	TargetBlockFullness    float64         `json:"targetBlockFullness"`
+	BaseFeeDestination     string          `json:"baseFeeDestination"` // "burn" or "redistribute"
+	SeedPeers              []string        `json:"seedPeers"`          // Peers to connect to when peers.txt is empty
+	Upgrades               NetworkUpgrades `json:"upgrades"`           // Replace env.json's heights when set
+	Genesis                Genesis         `json:"-"`
+}
+
+// Network is the parameters of the network the node is on.
+var Network NetworkParams
+
+// networkID is cached by LoadNetwork, since it is sent with every request.
+var networkID string
+
+// LoadNetwork loads the parameters and genesis block of a network from the networks directory, and applies them.
+func LoadNetwork(name string) error {
+	dir := filepath.Join("networks", name)
+	params := NetworkParams{}
+	if err := readJSONFile(filepath.Join(dir, "params.json"), &params); err != nil {
+		return fmt.Errorf("loading network %q: %w", name, err)
+	}
+	if err := readJSONFile(filepath.Join(dir, "genesis.json"), &params.Genesis); err != nil {
+		return fmt.Errorf("loading network %q: %w", name, err)
+	}
+	params.Name = name
+	if params.MinimumBlockDifficulty == 0 || params.InitialBlockDifficulty < params.MinimumBlockDifficulty {
+		return fmt.Errorf("network %q has an invalid difficulty floor", name)
+	}
+	if params.MaxBlockBytes <= 0 || params.MaxBlockGas <= 0 || params.MaxBlockTransactions <= 0 {
+		return fmt.Errorf("network %q has invalid block limits", name)
+	}
+	if params.TransactionFee <= 0 {
+		return fmt.Errorf("network %q has an invalid transaction fee", name)
+	}
+	if params.TargetBlockFullness <= 0 || params.TargetBlockFullness > 1 {
+		return fmt.Errorf("network %q has an invalid target block fullness", name)
+	}
+	if params.BaseFeeDestination != BaseFeeBurn && params.BaseFeeDestination != BaseFeeRedistribute {
+		return fmt.Errorf("network %q has an invalid base fee destination %q", name, params.BaseFeeDestination)
+	}
+	for _, allocation := range params.Genesis.Allocations {
+		if _, err := hex.DecodeString(allocation.Key); err != nil || allocation.Key == "" {
+			return fmt.Errorf("network %q has an allocation with an invalid key %q", name, allocation.Key)
+		}
+		if allocation.Amount <= 0 {
+			return fmt.Errorf("network %q has an allocation with an invalid amount %v", name, allocation.Amount)
+		}
+	}
+	if err := verifyUpgrades(params.Upgrades); err != nil {
+		return fmt.Errorf("network %q: %w", name, err)
+	}
+	for _, peer := range params.SeedPeers {
+		if !IsPeerAddress(peer) {
+			return fmt.Errorf("network %q has an invalid seed peer %q", name, peer)
+		}
+	}
+	Network = params
+	TransactionFee = params.TransactionFee
+	BodyFeePerByte = params.BodyFeePerByte
+	GasPrice = params.GasPrice
+	BlocksBeforeReward = params.BlocksBeforeReward
+	InitialBlockDifficulty = params.InitialBlockDifficulty
+	MinimumBlockDifficulty = params.MinimumBlockDifficulty
+	MaxBlockBytes = params.MaxBlockBytes
+	MaxBlockGas = params.MaxBlockGas
+	MaxBlockTransactions = params.MaxBlockTransactions
+	TargetBlockFullness = params.TargetBlockFullness
+	BaseFeeDestination = params.BaseFeeDestination
+	if params.Upgrades != nil {
+		Env.Upgrades = NetworkUpgrades{}
+		for upgrade, height := range params.Upgrades {
+			Env.Upgrades[upgrade] = height
+		}
+	}
+	genesisHash := HashBlock(GenesisBlock(), 0)
+	networkID = name + "/" + hex.EncodeToString(genesisHash[:8])
+	PeerClient.Transport = &networkTransport{base: http.DefaultTransport, legacyPeers: make(map[string]bool)}
+	return nil
+}
+
+func readJSONFile(path string, v any) error {
+	jsonBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(jsonBytes, v)
+}
+
+// NetworkID returns the ID of the network the node is on.
+func NetworkID() string {
+	return networkID
+}
+
+// SameNetwork reports whether the network ID sent with a request, in NetworkHeader, is compatible with this node's.
+// Requests without one are served.
+func SameNetwork(peerNetworkID string) bool {
+	return peerNetworkID == "" || peerNetworkID == networkID
+}
+
+// networkTransport sends the node's network ID with every request, and refuses responses from other networks.
+// Responses without a network ID are only accepted from peers whose "/info" shows the same genesis block, or from
+// peers too old to show one when the node is on LegacyNetwork.
+type networkTransport struct {
+	base        http.RoundTripper
+	legacyPeers map[string]bool // Whether each peer that doesn't send a network ID has the same genesis block, by host
+	mutex       sync.Mutex
+}
+
+func (t *networkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(NetworkHeader, networkID)
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	peerNetworkID := res.Header.Get(NetworkHeader)
+	if peerNetworkID == "" && !t.sameGenesis(req.URL) {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("%w: %s doesn't send a network ID or show the same genesis block", ErrWrongNetwork, req.URL.Host)
+	}
+	if peerNetworkID != "" && peerNetworkID != networkID {
+		_ = res.Body.Close()
+		return nil, fmt.Errorf("%w: %s is on %s", ErrWrongNetwork, req.URL.Host, peerNetworkID)
+	}
+	return res, nil
+}
+
+// sameGenesis reports whether a peer's "/info" shows the same genesis block as this node's. A peer without "/info", or
+// whose "/info" doesn't show a genesis block, predates networks, so it is only on the same network as nodes on
+// LegacyNetwork. The answer is remembered, unless the peer can't be reached.
+func (t *networkTransport) sameGenesis(peer *url.URL) bool {
+	t.mutex.Lock()
+	same, checked := t.legacyPeers[peer.Host]
+	t.mutex.Unlock()
+	if checked {
+		return same
+	}
+	req, err := http.NewRequest(http.MethodGet, peer.Scheme+"://"+peer.Host+"/info", nil)
+	if err != nil {
+		return false
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+	var info NodeInfo
+	if res.StatusCode == http.StatusOK && json.NewDecoder(res.Body).Decode(&info) == nil && info.Genesis != "" {
+		genesisHash := HashBlock(GenesisBlock(), 0)
+		same = info.Genesis == hex.EncodeToString(genesisHash[:])
+	} else {
+		same = Network.Name == LegacyNetwork
+	}
+	t.mutex.Lock()
+	t.legacyPeers[peer.Host] = same
+	t.mutex.Unlock()
+	return same
+}
+
+// NetworkHandler serves requests from nodes on the same network with a handler, and rejects the rest.
+func NetworkHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(NetworkHeader, networkID)
+		if peerNetworkID := req.Header.Get(NetworkHeader); !SameNetwork(peerNetworkID) {
+			Log(fmt.Sprintf("Ignoring request from a node on %s.", peerNetworkID), true)
+			WriteRejection(w, &ValidationError{Code: ReasonWrongNetwork, Message: "node is on " + networkID, Err: ErrWrongNetwork})
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
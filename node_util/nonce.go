@@ -0,0 +1,131 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Overview
+// Once the Kyoto upgrade is active, every signed transaction carries a nonce: 1 for an account's first transaction,
+// and one more than the last for each transaction after that. The nonce is part of the signed message and the
+// transaction hash, so a transaction can't be replayed, and a sender's transactions are always mined in nonce order.
+// Transactions created by smart contracts aren't signed, and don't have nonces.
+// Before the upgrade, transactions must not have a nonce (a nonce of 0).
+
+// NoncesActive reports whether transactions in the block at the given height must have nonces.
+func NoncesActive(height int) bool {
+	return IsActive(Kyoto, height)
+}
+
+// AccountNonce returns the nonce of the last mined transaction sent by a public key, or 0 if it hasn't sent any.
+func AccountNonce(key []byte) uint64 {
+	account, _ := AccountLedger.Account(key)
+	return account.Nonce
+}
+
+// NextNonce returns the nonce a public key should use for its next transaction, counting its pending transactions.
+func NextNonce(key []byte) uint64 {
+	nonce := AccountNonce(key)
+	for _, transaction := range Pool.SenderTransactions(key) {
+		if transaction.Nonce == nonce+1 {
+			nonce++
+		}
+	}
+	return nonce + 1
+}
+
+// VerifyNonces checks that every signed transaction in a block at the given height has the sender's next nonce.
+func VerifyNonces(transactions []Transaction, height int) bool {
+	return ValidateNonces(NodeState, transactions, height)
+}
+
+// ValidateNonces checks the nonces of a block's transactions against the account nonces in a state, as VerifyNonces
+// does.
+func ValidateNonces(state StateView, transactions []Transaction, height int) bool {
+	active := NoncesActive(height)
+	expected := make(map[string]uint64)
+	for _, transaction := range transactions {
+		if transaction.FromSmartContract {
+			continue
+		}
+		if !active {
+			if transaction.Nonce != 0 {
+				Log("Transaction has a nonce before nonces are active.", true)
+				return false
+			}
+			continue
+		}
+		sender := string(transaction.Sender.Y)
+		if _, ok := expected[sender]; !ok {
+			expected[sender] = state.Nonce(transaction.Sender.Y) + 1
+		}
+		if transaction.Nonce != expected[sender] {
+			Log(fmt.Sprintf("Transaction has nonce %d, expected %d.", transaction.Nonce, expected[sender]), true)
+			return false
+		}
+		expected[sender]++
+	}
+	return true
+}
+
+// VerifyPendingNonce checks whether a transaction's nonce could still be mined, given the transactions already mined.
+func VerifyPendingNonce(transaction Transaction) bool {
+	if transaction.FromSmartContract {
+		return true
+	}
+	if !NoncesActive(len(Blockchain)) {
+		return transaction.Nonce == 0
+	}
+	return transaction.Nonce > AccountNonce(transaction.Sender.Y)
+}
+
+// NonceInfo is the nonce information for an account, as served by the "/nonce" endpoint.
+type NonceInfo struct {
+	Confirmed uint64 `json:"confirmed"` // Nonce of the last mined transaction
+	Next      uint64 `json:"next"`      // Nonce to use for the next transaction, counting pending transactions
+}
+
+// FetchNextNonce asks peers for the next nonce of a public key, so pending transactions on other nodes are counted.
+//
+// The highest nonce given by any peer is used, falling back to the local blockchain and mempool.
+func FetchNextNonce(key []byte) uint64 {
+	next := NextNonce(key)
+	keyBytes, err := json.Marshal(key)
+	if err != nil {
+		panic(err)
+	}
+	for _, peer := range GetPeers() {
+		req, err := http.NewRequest(http.MethodGet, peer+"/nonce", strings.NewReader(string(keyBytes)))
+		if err != nil {
+			panic(err)
+		}
+		res, err := PeerClient.Do(req)
+		if err != nil {
+			continue
+		}
+		infoBytes, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil || res.StatusCode != http.StatusOK {
+			continue
+		}
+		var info NonceInfo
+		if err = json.Unmarshal(infoBytes, &info); err != nil {
+			continue
+		}
+		if info.Next > next {
+			next = info.Next
+		}
+	}
+	return next
+}
@@ -0,0 +1,209 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Overview
+// Syncing asks every peer for its headers at once, then downloads the block bodies of the chosen chain from every
+// peer that has that chain, rather than from a single peer. The bodies are split into ranges of MaxBodiesPerRequest
+// blocks, and each of up to MaxParallelDownloads peers downloads one range at a time, so faster peers download more
+// ranges. A range that a peer fails to serve is given to another peer. Peers that fail requests are penalized, and
+// peers that serve headers or blocks that don't verify are penalized heavily. Once a peer's penalties reach
+// PeerBanScore, it is left out of syncs for PeerBanDuration.
+
+var ErrNoSyncPeers = errors.New("no peers can serve the blocks")
+
+// PeerScoreboard keeps track of the penalties of peers that misbehaved during a sync.
+type PeerScoreboard struct {
+	penalties   map[string]int
+	bannedUntil map[string]time.Time
+	mutex       sync.Mutex
+}
+
+var PeerScores = NewPeerScoreboard()
+
+func NewPeerScoreboard() *PeerScoreboard {
+	return &PeerScoreboard{penalties: make(map[string]int), bannedUntil: make(map[string]time.Time)}
+}
+
+// Penalize adds to a peer's penalties, and bans the peer once they reach PeerBanScore.
+func (p *PeerScoreboard) Penalize(peer string, penalty int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.penalties[peer] += penalty
+	if p.penalties[peer] >= PeerBanScore {
+		Warn(fmt.Sprintf("Not syncing with peer %s for %s after repeated failures.", peer, PeerBanDuration))
+		p.bannedUntil[peer] = time.Now().Add(PeerBanDuration)
+		delete(p.penalties, peer)
+	}
+}
+
+// Penalty returns a peer's penalties since it was last banned.
+func (p *PeerScoreboard) Penalty(peer string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.penalties[peer]
+}
+
+// Banned reports whether a peer is currently left out of syncs.
+func (p *PeerScoreboard) Banned(peer string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	until, ok := p.bannedUntil[peer]
+	if ok && time.Now().After(until) {
+		delete(p.bannedUntil, peer)
+		return false
+	}
+	return ok
+}
+
+// penalizeSyncError penalizes a peer for a failed sync request, more heavily if it served invalid data.
+func penalizeSyncError(peer string, err error) {
+	if errors.Is(err, ErrInvalidSyncData) {
+		PeerScores.Penalize(peer, InvalidDataPenalty)
+	} else {
+		PeerScores.Penalize(peer, FailedRequestPenalty)
+	}
+}
+
+// SyncPeers returns the peers that aren't banned from syncing.
+func SyncPeers() []string {
+	var peers []string
+	for _, peer := range GetPeers() {
+		if !PeerScores.Banned(peer) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// fetchSyncCandidates downloads and verifies the headers of all the given peers at once. Peers that fail are
+// penalized and left out of the result.
+func fetchSyncCandidates(peers []string) []syncCandidate {
+	candidates := make([]*syncCandidate, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			candidate, err := fetchSyncCandidate(peer)
+			if err != nil {
+				Log(fmt.Sprintf("Invalid blockchain received from peer %s: %s", peer, err), true)
+				penalizeSyncError(peer, err)
+				return
+			}
+			candidates[i] = &candidate
+		}(i, peer)
+	}
+	wg.Wait()
+	var result []syncCandidate
+	for _, candidate := range candidates {
+		if candidate != nil {
+			result = append(result, *candidate)
+		}
+	}
+	return result
+}
+
+// hasHeader reports whether a candidate's chain has the block with the given hash at the given height.
+func (c syncCandidate) hasHeader(height int, hash [64]byte) bool {
+	if height < c.Start {
+		return height < len(Blockchain) && BlockHashAt(height) == hash
+	}
+	return height-c.Start < len(c.Headers) && c.Headers[height-c.Start].Hash == hash
+}
+
+// bodySources returns the peers that can serve the bodies of the best candidate's chain: the ones whose chains
+// contain its last block, and so all of its blocks. The best candidate's peer comes first.
+func bodySources(best syncCandidate, candidates []syncCandidate) []string {
+	tip := best.Start + len(best.Headers) - 1
+	sources := []string{best.Peer}
+	for _, candidate := range candidates {
+		// Peers that don't support headers-first sync can't serve bodies
+		if candidate.Peer == best.Peer || candidate.Blocks != nil || len(best.Headers) == 0 {
+			continue
+		}
+		if candidate.hasHeader(tip, best.Headers[len(best.Headers)-1].Hash) {
+			sources = append(sources, candidate.Peer)
+		}
+	}
+	if len(sources) > MaxParallelDownloads {
+		sources = sources[:MaxParallelDownloads]
+	}
+	return sources
+}
+
+// bodyRange is a range of blocks to download, as offsets into the headers being downloaded.
+type bodyRange struct {
+	From int
+	To   int
+}
+
+// bodyResult is the outcome of downloading a range from a peer.
+type bodyResult struct {
+	Peer   string
+	Range  bodyRange
+	Blocks []Block
+	Err    error
+}
+
+// DownloadBodies downloads the blocks for headers starting at the given height from several peers at once, checking
+// each against its header. Each peer downloads one range of blocks at a time. A range a peer fails to serve is
+// retried with the other peers, and the failing peer is penalized and not given any more ranges.
+func DownloadBodies(peers []string, start int, headers []HeaderRecord) ([]Block, error) {
+	var pending []bodyRange
+	for from := 0; from < len(headers); from += MaxBodiesPerRequest {
+		to := from + MaxBodiesPerRequest
+		if to > len(headers) {
+			to = len(headers)
+		}
+		pending = append(pending, bodyRange{From: from, To: to})
+	}
+	idle := append([]string{}, peers...)
+	blocks := make([]Block, len(headers))
+	results := make(chan bodyResult)
+	inFlight := 0
+	for len(pending) > 0 || inFlight > 0 {
+		// Give each idle peer the lowest range still to download
+		sort.Slice(pending, func(i, j int) bool {
+			return pending[i].From < pending[j].From
+		})
+		for len(idle) > 0 && len(pending) > 0 {
+			peer, r := idle[0], pending[0]
+			idle, pending = idle[1:], pending[1:]
+			inFlight++
+			go func(peer string, r bodyRange) {
+				downloaded, err := FetchBodies(peer, start+r.From, headers[r.From:r.To])
+				results <- bodyResult{Peer: peer, Range: r, Blocks: downloaded, Err: err}
+			}(peer, r)
+		}
+		if inFlight == 0 {
+			// Every peer has failed
+			return nil, fmt.Errorf("%w: blocks %d-%d", ErrNoSyncPeers, start+pending[0].From, start+pending[0].To)
+		}
+		result := <-results
+		inFlight--
+		if result.Err != nil {
+			Log(fmt.Sprintf("Failed to download blocks %d-%d from peer %s: %s", start+result.Range.From, start+result.Range.To, result.Peer, result.Err), true)
+			penalizeSyncError(result.Peer, result.Err)
+			pending = append(pending, result.Range)
+			continue
+		}
+		copy(blocks[result.Range.From:], result.Blocks)
+		idle = append(idle, result.Peer)
+	}
+	return blocks, nil
+}
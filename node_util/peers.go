@@ -11,32 +11,44 @@ package node_util
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strings"
 )
 
+// AddPeer adds a peer to peers.txt. The network's seed peers are kept if peers.txt was empty.
+//
+// The file is rewritten atomically, so a crash can't leave a partially written peer behind.
 func AddPeer(ip string) {
-	f, err := os.OpenFile("peers.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-	if err != nil {
+	ip = strings.TrimSpace(ip)
+	if !IsPeerAddress(ip) {
+		Warn(fmt.Sprintf("Ignoring invalid peer address %q.", ip))
+		return
+	}
+	peers := append(GetPeers(), ip)
+	if err := WriteFileAtomic("peers.txt", []byte(FormatPeers(peers)), 0600); err != nil {
 		panic(err)
 	}
+}
 
-	defer func(f *os.File) {
-		err := f.Close()
-		if err != nil {
-			panic(err)
-		}
-	}(f)
-
-	if _, err = f.WriteString(ip); err != nil {
-		panic(err)
+// FormatPeers formats a list of peers as the contents of peers.txt, one peer per line.
+func FormatPeers(peers []string) string {
+	result := ""
+	for _, peer := range peers {
+		result += peer + "\n"
 	}
+	return result
 }
 
+// GetPeers returns the peers in peers.txt, or the network's seed peers if there are none.
 func GetPeers() []string {
 	file, err := os.Open("peers.txt")
+	if errors.Is(err, os.ErrNotExist) {
+		return append([]string{}, Network.SeedPeers...)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -50,7 +62,12 @@ func GetPeers() []string {
 	scanner := bufio.NewScanner(file)
 	var result []string
 	for scanner.Scan() {
-		result = append(result, scanner.Text())
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			result = append(result, line)
+		}
+	}
+	if len(result) == 0 {
+		return append([]string{}, Network.SeedPeers...)
 	}
 	return result
 }
@@ -95,7 +112,7 @@ func ConnectToPeer(ip string) {
 	ipStr := "http://" + myIp.Query + ":8080"
 	requestBody := strings.NewReader(ipStr)
 	req, err := http.NewRequest(http.MethodGet, ip+"/addPeer", requestBody)
-	_, err = http.DefaultClient.Do(req)
+	_, err = PeerClient.Do(req)
 	if err != nil {
 		Log("Failed to connect to peer.", true)
 	}
@@ -0,0 +1,159 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Overview
+// A pruned node keeps full blocks only for the last BlocksUntilFinality+PruneMargin blocks.
+// Older blocks are replaced by their headers (the block without its transactions, transition and proof),
+// which every node keeps in a second block store (blocks/headers), so difficulty and reward calculations still work.
+// The state, account ledger (including base fees) and transaction history at the pruned height are saved to
+// blocks/prune_snapshot.json, and are used as the starting point for the state cache, ledger and transaction index
+// when the node is restarted.
+
+var PruneMode = false
+var PrunedHeight = 0 // Blocks below this height only have their headers
+var HeaderStore *BlockStore
+
+// PruneSnapshot is everything a pruned node needs to rebuild its indexes without the pruned blocks.
+type PruneSnapshot struct {
+	Height      int
+	State       State
+	Accounts    map[string]Account // Keyed by hex-encoded public key
+	MinerCounts []int64
+	BaseFees    []float64
+	TxHistory   map[string][]HistoryEntry // Keyed by hex-encoded public key
+}
+
+func pruneSnapshotPath() string {
+	return filepath.Join(BlockStoreDir, "prune_snapshot.json")
+}
+
+// BlockHeader returns a copy of a block without its transactions, state transition and proof.
+func BlockHeader(block Block) Block {
+	block.LegacyTransactions = nil
+	block.ZenTransactions = nil
+	block.Transition = StateTransition{}
+	block.ZenProof = nil
+	return block
+}
+
+// PruneBlockchain replaces every block below the given height with its header.
+//
+// The state and ledger at the given height are saved first, so the pruned blocks are never needed again.
+func PruneBlockchain(height int) {
+	if height <= PrunedHeight {
+		return
+	}
+	Log(fmt.Sprintf("Pruning blocks below height %d...", height), true)
+	state := ChainState.Prune(height)
+	accounts, minerCounts, baseFees := AccountLedger.Prune(height)
+	history := TxIndex.Prune(height)
+	if Store != nil {
+		snapshot := PruneSnapshot{
+			Height:      height,
+			State:       state,
+			Accounts:    make(map[string]Account),
+			MinerCounts: minerCounts,
+			BaseFees:    baseFees,
+			TxHistory:   make(map[string][]HistoryEntry),
+		}
+		for key, account := range accounts {
+			snapshot.Accounts[hex.EncodeToString([]byte(key))] = account
+		}
+		for address, entries := range history {
+			snapshot.TxHistory[hex.EncodeToString([]byte(address))] = entries
+		}
+		writePruneSnapshot(snapshot)
+	}
+	for i := PrunedHeight; i < height; i++ {
+		Blockchain[i] = BlockHeader(Blockchain[i])
+	}
+	PrunedHeight = height
+	if Store != nil && HeaderStore != nil {
+		if err := Store.DropSegmentsBelow(height); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func writePruneSnapshot(snapshot PruneSnapshot) {
+	snapshotBytes, err := json.Marshal(snapshot)
+	if err != nil {
+		panic(err)
+	}
+	if err = WriteFileAtomic(pruneSnapshotPath(), snapshotBytes, 0644); err != nil {
+		panic(err)
+	}
+}
+
+func readPruneSnapshot() (PruneSnapshot, bool) {
+	snapshotBytes, err := os.ReadFile(pruneSnapshotPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return PruneSnapshot{}, false
+	}
+	if err != nil {
+		panic(err)
+	}
+	var snapshot PruneSnapshot
+	if err = json.Unmarshal(snapshotBytes, &snapshot); err != nil {
+		panic(err)
+	}
+	return snapshot, true
+}
+
+// LoadPrunedBlockchain loads the headers of the blocks in the block store, then restores the state cache and account
+// ledger from the prune snapshot. It is called by LoadBlockchain once the block and header stores are open.
+//
+// A store that has been pruned can't be loaded as a full node, so this also switches the node into pruned mode.
+func LoadPrunedBlockchain() {
+	if !PruneMode {
+		Warn("The block store has been pruned. Running as a pruned node.")
+		PruneMode = true
+	}
+	Store.SegmentSize = PruneSegmentSize
+	snapshot, ok := readPruneSnapshot()
+	PrunedHeight = 0
+	if ok {
+		if snapshot.Height > Store.Len() {
+			panic(fmt.Sprintf("prune snapshot at height %d is past the end of the block store", snapshot.Height))
+		}
+		PrunedHeight = snapshot.Height
+	}
+	Blockchain = loadHeaders()
+	if ok {
+		accounts := make(map[string]Account)
+		for key, account := range snapshot.Accounts {
+			keyBytes, err := hex.DecodeString(key)
+			if err != nil {
+				panic(err)
+			}
+			accounts[string(keyBytes)] = account
+		}
+		history := make(map[string][]HistoryEntry)
+		for address, entries := range snapshot.TxHistory {
+			addressBytes, err := hex.DecodeString(address)
+			if err != nil {
+				panic(err)
+			}
+			history[string(addressBytes)] = entries
+		}
+		ChainState.SetBase(snapshot.Height, snapshot.State)
+		AccountLedger.SetBase(snapshot.Height, accounts, snapshot.MinerCounts, snapshot.BaseFees)
+		TxIndex.SetBase(snapshot.Height, history)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Overview
+// Regtest mode runs a private chain on one machine, for integration testing wallets and contracts. The node joins the
+// regtest network, whose minimum difficulty is 1, and its blockchain is only kept in memory. Blocks are mined on
+// demand with Generate (the generate command, or the "/generate" endpoint) rather than by the miner loop. Regtest
+// blocks don't need time verifiers, and proofs come from a stub prover, so the VM doesn't need to be running.
+// Every generated block claims RegtestMiningTime, which keeps the difficulty at its minimum.
+// After the Qingdao upgrade a block without transactions can't be mined, so when the mempool is empty, Generate mines
+// a transaction that sends nothing from the node's key to itself.
+
+var ErrNotRegtest = errors.New("blocks can only be generated in regtest mode")
+
+const RegtestNetwork = "regtest"
+const RegtestMiningTime = time.Minute
+const MaxGenerateBlocks = 1000 // Most blocks the "/generate" endpoint mines per request
+
+// RegtestProof is the proof the stub prover gives every block.
+var RegtestProof = []byte("regtest")
+
+var Regtest = false
+
+// EnableRegtest switches the node to the regtest network.
+func EnableRegtest() {
+	Regtest = true
+	Env.Network = RegtestNetwork
+	if err := LoadNetwork(RegtestNetwork); err != nil {
+		panic(err)
+	}
+}
+
+// Generate mines n blocks on top of the blockchain from the mempool, and broadcasts them to peers.
+func Generate(n int) ([]Block, error) {
+	if !Regtest {
+		return nil, ErrNotRegtest
+	}
+	var blocks []Block
+	for i := 0; i < n; i++ {
+		if Pool.Len() == 0 {
+			if err := Pool.Accept(fillerTransaction()); err != nil {
+				return blocks, err
+			}
+		}
+		block, err := CreateBlock()
+		if err != nil {
+			return blocks, err
+		}
+		if problems := BlockProblems(block, len(Blockchain)); len(problems) > 0 {
+			return blocks, problems[0]
+		}
+		if err = Append(block); err != nil {
+			return blocks, err
+		}
+		BroadcastBlock(block)
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// fillerTransaction returns a signed transaction that sends nothing from the node's key to itself.
+func fillerTransaction() Transaction {
+	key := GetKey("")
+	transaction := Transaction{
+		Sender:    key.PublicKey,
+		Recipient: key.PublicKey,
+		Timestamp: time.Unix(0, time.Now().UnixNano()),
+	}
+	if NoncesActive(len(Blockchain)) {
+		transaction.Nonce = NextNonce(key.PublicKey.Y)
+	}
+	hash := TransactionSigningHash(transaction)
+	signature, err := key.X.Sign(hash[:])
+	if err != nil {
+		panic(err)
+	}
+	transaction.SenderSignature = Signature{S: signature}
+	return transaction
+}
+
+// HandleGenerateRequest mines the number of blocks given by the "blocks" query parameter (1 by default), and serves
+// their hashes.
+func HandleGenerateRequest(w http.ResponseWriter, req *http.Request) {
+	n := 1
+	if blocks := req.URL.Query().Get("blocks"); blocks != "" {
+		var err error
+		if n, err = strconv.Atoi(blocks); err != nil || n < 1 || n > MaxGenerateBlocks {
+			http.Error(w, fmt.Sprintf("blocks must be between 1 and %d", MaxGenerateBlocks), http.StatusBadRequest)
+			return
+		}
+	}
+	height := len(Blockchain)
+	blocks, err := Generate(n)
+	hashes := make([]string, len(blocks))
+	for i, block := range blocks {
+		hash := HashBlock(block, height+i)
+		hashes[i] = fmt.Sprintf("%x", hash)
+	}
+	if err != nil {
+		Log("Failed to generate blocks: "+err.Error(), true)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	hashesBytes, err := json.Marshal(hashes)
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(hashesBytes))
+	if err != nil {
+		panic(err)
+	}
+}
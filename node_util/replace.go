@@ -0,0 +1,163 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Overview
+// A pending transaction can be replaced by a new transaction from the same sender that either has the same nonce,
+// or names the pending transaction's hash in its Replaces field. The replacement must pay at least
+// ReplacementFeeBump times the fee of the transaction it replaces, so replacements can't be used to spam the network.
+// Fees are raised with a tip, which is paid to the miner on top of the usual fees (see fee_market.go).
+// A transaction is cancelled by replacing it with a transaction that sends nothing to the sender.
+// Tips and replaced hashes were added by the Kyoto upgrade, along with nonces.
+
+// ReplacesTransaction reports whether a transaction replaces a pending transaction.
+func ReplacesTransaction(replacement Transaction, pending Transaction) bool {
+	if replacement.FromSmartContract || !bytes.Equal(replacement.Sender.Y, pending.Sender.Y) {
+		return false
+	}
+	if replacement.Nonce != 0 && replacement.Nonce == pending.Nonce {
+		return true
+	}
+	return replacement.Replaces != [32]byte{} && replacement.Replaces == TransactionHash(pending)
+}
+
+// VerifyTips checks that the tips of transactions in a block at the given height are valid, and that tips and
+// replaced hashes aren't used before the Kyoto upgrade.
+func VerifyTips(transactions []Transaction, height int) bool {
+	active := NoncesActive(height)
+	for _, transaction := range transactions {
+		if transaction.Tip < 0 || math.IsNaN(transaction.Tip) || math.IsInf(transaction.Tip, 0) {
+			Log("Transaction has an invalid tip.", true)
+			return false
+		}
+		if !active && (transaction.Tip != 0 || transaction.Replaces != [32]byte{}) {
+			Log("Transaction has a tip or replaces a transaction before the Kyoto upgrade.", true)
+			return false
+		}
+	}
+	return true
+}
+
+// ReplacementTip returns the smallest tip that lets a transaction replace a pending transaction paying the given total
+// fee.
+func ReplacementTip(transaction Transaction, pendingFee float64) float64 {
+	tip := pendingFee*ReplacementFeeBump - BaseFees(transaction, BaseFee(len(Blockchain)))
+	if tip <= 0 {
+		return 0
+	}
+	// Round up, so the replacement's fee isn't just under the required fee
+	return math.Ceil(tip*1e8) / 1e8
+}
+
+// PendingRecord describes a pending transaction, as served by the "/pending" endpoint.
+type PendingRecord struct {
+	Hash   string  `json:"hash"`
+	Sender string  `json:"sender"` // Hex encoded public key
+	Nonce  uint64  `json:"nonce"`
+	Fee    float64 `json:"fee"` // Fees and tip paid by the sender
+}
+
+// NewPendingRecord describes a mempool entry.
+func NewPendingRecord(entry MempoolEntry) PendingRecord {
+	return PendingRecord{
+		Hash:   hex.EncodeToString(entry.Hash[:]),
+		Sender: hex.EncodeToString(entry.Transaction.Sender.Y),
+		Nonce:  entry.Transaction.Nonce,
+		Fee:    entry.TotalFee(),
+	}
+}
+
+// FetchPendingTransaction looks up a pending transaction in the local mempool, and then in peers' mempools.
+func FetchPendingTransaction(hash [32]byte) (PendingRecord, bool) {
+	if entry, ok := Pool.Get(hash); ok {
+		return NewPendingRecord(entry), true
+	}
+	for _, peer := range GetPeers() {
+		req, err := http.NewRequest(http.MethodGet, peer+"/pending", strings.NewReader(hex.EncodeToString(hash[:])))
+		if err != nil {
+			panic(err)
+		}
+		res, err := PeerClient.Do(req)
+		if err != nil {
+			continue
+		}
+		recordBytes, err := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil || res.StatusCode != http.StatusOK {
+			continue
+		}
+		var record PendingRecord
+		if err = json.Unmarshal(recordBytes, &record); err != nil {
+			continue
+		}
+		return record, true
+	}
+	return PendingRecord{}, false
+}
+
+// CancelTransaction replaces a pending transaction sent by this node's key with a transaction that sends nothing to
+// the sender, and tips just enough to replace it.
+func CancelTransaction(hash [32]byte) error {
+	if !NoncesActive(len(Blockchain)) {
+		return errors.New("transactions can't be cancelled before the Kyoto upgrade")
+	}
+	if _, ok := TxIndex.Lookup(hash); ok {
+		return ErrTransactionMined
+	}
+	record, ok := FetchPendingTransaction(hash)
+	if !ok {
+		return errors.New("transaction isn't pending on this node or its peers")
+	}
+	key := GetKey("")
+	if record.Sender != hex.EncodeToString(key.PublicKey.Y) {
+		return errors.New("only the sender can cancel a transaction")
+	}
+	transaction := Transaction{
+		Sender:    key.PublicKey,
+		Recipient: key.PublicKey,
+		Timestamp: time.Unix(0, time.Now().UnixNano()),
+		Nonce:     record.Nonce,
+		Replaces:  hash,
+	}
+	transaction.Tip = ReplacementTip(transaction, record.Fee)
+	signingHash := TransactionSigningHash(transaction)
+	sigBytes, err := key.X.Sign(signingHash[:])
+	if err != nil {
+		return err
+	}
+	sigStr, err := json.Marshal(Signature{S: sigBytes})
+	if err != nil {
+		return err
+	}
+	senderStr := EncodePublicKey(key.PublicKey)
+	body := fmt.Sprintf("%s$%s$0$%s$%d$[]$[]$[]", senderStr, senderStr, sigStr, transaction.Timestamp.UnixNano()) + extensionFields(transaction)
+	for _, peer := range GetPeers() {
+		Log("Sending cancellation to peer: "+peer, false)
+		req, err := http.NewRequest(http.MethodGet, peer+"/mine", strings.NewReader(body))
+		if err != nil {
+			return err
+		}
+		Wg.Add(1)
+		go SendRequest(req)
+	}
+	return nil
+}
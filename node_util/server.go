@@ -10,7 +10,9 @@ package node_util
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -20,65 +22,87 @@ import (
 	"time"
 )
 
-func HandleMineRequest(_ http.ResponseWriter, req *http.Request) {
+// HandleMineRequest adds a transaction to the mempool and broadcasts it to peers. A rejected transaction is answered
+// with a RejectionResponse.
+func HandleMineRequest(w http.ResponseWriter, req *http.Request) {
 	bodyBytes, err := io.ReadAll(req.Body)
 	if err != nil {
 		panic(err)
 	}
-	body := string(bodyBytes)
+	transaction, err := parseMineRequest(string(bodyBytes))
+	if err != nil {
+		Log("Ignoring mine request with invalid fields: "+err.Error(), true)
+		WriteRejection(w, NewValidationError(ReasonMalformed, err.Error()))
+		return
+	}
+	hash := TransactionHash(transaction)
+	if Pool.Contains(hash) {
+		Log("No new job. Ignoring mine request.", true)
+		WriteRejection(w, AsValidationError(ErrMempoolDuplicate))
+		return
+	}
+	if _, ok := TxIndex.Lookup(hash); ok {
+		Log("No new job. Ignoring mine request.", true)
+		WriteRejection(w, AsValidationError(ErrTransactionMined))
+		return
+	}
+	if err = Pool.Accept(transaction); err != nil {
+		Log("Transaction is invalid. Ignoring transaction request: "+err.Error(), true)
+		WriteRejection(w, AsValidationError(err))
+		return
+	}
+	Log("New job.", false)
+	Log("Broadcasting job to peers...", true)
+	for _, peer := range GetPeers() {
+		// Create a new body
+		body := strings.NewReader(string(bodyBytes))
+		req, err := http.NewRequest(http.MethodGet, peer+"/mine", body)
+		if err != nil {
+			panic(err)
+		}
+		_, err = PeerClient.Do(req)
+		if err != nil {
+			Log(fmt.Sprintf("Peer, %s is down.", peer), true)
+		}
+	}
+}
+
+// parseMineRequest decodes the "$"-separated fields of a mine request into a transaction.
+func parseMineRequest(body string) (Transaction, error) {
 	fields := strings.Split(body, "$")
-	senderStr := fields[0]
-	senderKey := DecodePublicKey(senderStr)
-	recipientStr := fields[1]
-	recipientKey := DecodePublicKey(recipientStr)
+	if len(fields) < 8 {
+		return Transaction{}, fmt.Errorf("expected at least 8 fields, got %d", len(fields))
+	}
+	senderKey, err := ParsePublicKey(fields[0])
+	if err != nil {
+		return Transaction{}, err
+	}
+	recipientKey, err := ParsePublicKey(fields[1])
+	if err != nil {
+		return Transaction{}, err
+	}
 	amount, err := strconv.ParseFloat(fields[2], 64)
 	if err != nil {
-		panic(err)
+		return Transaction{}, err
 	}
 	timestampInt, err := strconv.ParseInt(fields[4], 10, 64)
 	if err != nil {
-		panic(err)
+		return Transaction{}, err
 	}
 	timestamp := time.Unix(0, timestampInt)
-	sStr := fields[3]
 	var s Signature
-	err = json.Unmarshal([]byte(sStr), &s)
-	if err != nil {
-		panic(err)
+	if err = json.Unmarshal([]byte(fields[3]), &s); err != nil {
+		return Transaction{}, err
 	}
-	contractsStr := fields[5]
 	var contracts []Contract
-	err = json.Unmarshal([]byte(contractsStr), &contracts)
-	if err != nil {
-		panic(err)
+	if err = json.Unmarshal([]byte(fields[5]), &contracts); err != nil {
+		return Transaction{}, err
 	}
 	transactionBody := []byte(fields[6])
-	transactionBodySignaturesStr := fields[7]
 	var transactionBodySignatures []Signature
-	err = json.Unmarshal([]byte(transactionBodySignaturesStr), &transactionBodySignatures)
-	if err != nil {
-		panic(err)
+	if err = json.Unmarshal([]byte(fields[7]), &transactionBodySignatures); err != nil {
+		return Transaction{}, err
 	}
-	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%f:%d", senderStr, recipientStr, amount, timestamp.UnixNano())))
-	if TransactionHashes[hash] > 0 {
-		Log("No new job. Ignoring mine request.", true)
-		return
-	}
-	for _, block := range Blockchain {
-		for _, transaction := range ExtractTransactions(block) {
-			onchainHash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%f:%d", transaction.Sender.Y, transaction.Recipient.Y, transaction.Amount, transaction.Timestamp)))
-			if onchainHash == hash {
-				Log("No new job. Ignoring mine request.", true)
-				return
-			}
-		}
-	}
-	if !VerifyTransaction(senderKey, recipientKey, strconv.FormatFloat(amount, 'f', -1, 64), timestamp, s.S) {
-		Log("Transaction is invalid. Ignoring transaction request.", true)
-		return
-	}
-	Log("New job.", false)
-	TransactionHashes[hash] = 1
 	// Create a copy of the timestamp
 	marshaledTimestamp, err := json.Marshal(timestamp)
 	if err != nil {
@@ -99,49 +123,18 @@ func HandleMineRequest(_ http.ResponseWriter, req *http.Request) {
 		Body:            transactionBody,
 		BodySignatures:  transactionBodySignatures,
 	}
-	var smartContractTransactions []Transaction
-	if len(transaction.Contracts) > 0 {
-		for i, contract := range transaction.Contracts {
-			executeResult, transition,
-				gasUsed, err := contract.Execute(GetBalance(senderKey.Y)/GasPrice, transaction.Sender)
-			if NextTransitions == nil {
-				NextTransitions = map[[32]byte]StateTransition{}
-			}
-			NextTransitions[hash] = transition
-			if err != nil {
-				Warn("Error executing contract: " + err.Error())
-				continue
-			}
-			if executeResult != nil {
-				smartContractTransactions = append(smartContractTransactions, executeResult...)
-			}
-			transaction.Contracts[i].GasUsed = gasUsed
-		}
-	}
-	MiningTransactions = append(MiningTransactions, transaction)
-	for _, smartContractTransaction := range smartContractTransactions {
-		MiningTransactions = append(MiningTransactions, smartContractTransaction)
-		transactionString := fmt.Sprintf("%s:%s:%f:%d", EncodePublicKey(smartContractTransaction.Sender), EncodePublicKey(smartContractTransaction.Recipient), smartContractTransaction.Amount, smartContractTransaction.Timestamp.UnixNano())
-		transactionBytes := []byte(transactionString)
-		hash := sha256.Sum256(transactionBytes)
-		TransactionHashes[hash] = 1
-	}
-	Log("Broadcasting job to peers...", true)
-	for _, peer := range GetPeers() {
-		// Create a new body
-		body := strings.NewReader(string(bodyBytes))
-		req, err := http.NewRequest(http.MethodGet, peer+"/mine", body)
-		if err != nil {
-			panic(err)
-		}
-		_, err = http.DefaultClient.Do(req)
-		if err != nil {
-			Log(fmt.Sprintf("Peer, %s is down.", peer), true)
+	// The nonce, tip and replaced hash fields were added by the Kyoto upgrade, so older wallets leave them out
+	if len(fields) > 8 {
+		if err = setTransactionExtensions(&transaction, fields[8:]); err != nil {
+			return Transaction{}, err
 		}
 	}
+	return transaction, nil
 }
 
-func HandleBlockRequest(_ http.ResponseWriter, req *http.Request) {
+// HandleBlockRequest adds a block to the blockchain, or to a competing branch, and broadcasts it to peers. A rejected
+// block is answered with a RejectionResponse.
+func HandleBlockRequest(w http.ResponseWriter, req *http.Request) {
 	bodyBytes, err := io.ReadAll(req.Body)
 	if err != nil {
 		panic(err)
@@ -149,23 +142,40 @@ func HandleBlockRequest(_ http.ResponseWriter, req *http.Request) {
 	block := Block{}
 	err = json.Unmarshal(bodyBytes, &block)
 	if err != nil {
-		panic(err)
-	}
-	if !VerifyBlock(block, len(Blockchain)) {
-		Log("Block is invalid. Ignoring block request.", true)
+		Log("Ignoring malformed block: "+err.Error(), true)
+		WriteRejection(w, NewValidationError(ReasonMalformed, err.Error()))
 		return
 	}
-	for _, transaction := range ExtractTransactions(block) {
-		// Get transaction as string
-		transactionString := fmt.Sprintf("%s:%s:%f:%d", EncodePublicKey(transaction.Sender), EncodePublicKey(transaction.Recipient), transaction.Amount, transaction.Timestamp.UnixNano())
-		transactionBytes := []byte(transactionString)
-		// Get hash of transaction
-		hash := sha256.Sum256(transactionBytes)
-		// Mark transaction as completed
-		TransactionHashes[hash] = 2
-	}
-	Append(block)
-	Log("Block appended to local blockchain!", true)
+	if len(Blockchain) > 0 && block.PreviousBlockHash != BlockHashAt(len(Blockchain)-1) {
+		// The block doesn't extend our tip, so it belongs to a competing branch
+		reorganized, err := Forks.AddBlock(block)
+		if errors.Is(err, ErrUnknownParent) {
+			Log("Block has an unknown parent. Syncing with peers...", true)
+			WriteRejection(w, AsValidationError(err))
+			SyncBlockchain(len(Blockchain) + BlocksUntilFinality)
+			return
+		}
+		if err != nil {
+			Log("Ignoring competing block: "+err.Error(), true)
+			WriteRejection(w, AsValidationError(err))
+			return
+		}
+		if !reorganized {
+			return
+		}
+	} else {
+		if problems := BlockProblems(block, len(Blockchain)); len(problems) > 0 {
+			Log("Block is invalid. Ignoring block request.", true)
+			WriteRejection(w, problems...)
+			return
+		}
+		if err = Append(block); err != nil {
+			Error("Could not store block: "+err.Error(), false)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Log("Block appended to local blockchain!", true)
+	}
 	// Broadcast block to peers
 	Log("Broadcasting block to peers...", true)
 	bodyChars, err := json.Marshal(&block)
@@ -178,15 +188,46 @@ func HandleBlockRequest(_ http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			panic(err)
 		}
-		_, err = http.DefaultClient.Do(req)
+		_, err = PeerClient.Do(req)
 		if err != nil {
 			Log("Peer is down.", true)
 		}
 	}
 }
 
-func HandleBlockchainRequest(w http.ResponseWriter, _ *http.Request) {
-	blockchainChars, err := json.Marshal(Blockchain)
+// HandleBlockchainRequest serves the blockchain, or the blocks in the range given by the "from" and "to" query parameters.
+//
+// A pruned node refuses ranges that include pruned blocks with 410 Gone, since it only has their headers.
+func HandleBlockchainRequest(w http.ResponseWriter, req *http.Request) {
+	from := 0
+	to := len(Blockchain)
+	var err error
+	if fromStr := req.URL.Query().Get("from"); fromStr != "" {
+		from, err = strconv.Atoi(fromStr)
+		if err != nil {
+			http.Error(w, "invalid range", http.StatusBadRequest)
+			return
+		}
+	}
+	if toStr := req.URL.Query().Get("to"); toStr != "" {
+		to, err = strconv.Atoi(toStr)
+		if err != nil {
+			http.Error(w, "invalid range", http.StatusBadRequest)
+			return
+		}
+	}
+	if to > len(Blockchain) {
+		to = len(Blockchain)
+	}
+	if from < 0 || from > to {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	if from < PrunedHeight {
+		http.Error(w, fmt.Sprintf("blocks below height %d have been pruned", PrunedHeight), http.StatusGone)
+		return
+	}
+	blockchainChars, err := json.Marshal(BlocksAt(from, to))
 	if err != nil {
 		panic(err)
 	}
@@ -196,6 +237,188 @@ func HandleBlockchainRequest(w http.ResponseWriter, _ *http.Request) {
 	}
 }
 
+// HandleHeadersRequest serves the headers after the highest block in the requester's locator, or in the range given
+// by the "from" and "to" query parameters. At most MaxHeadersPerRequest headers are served at once.
+func HandleHeadersRequest(w http.ResponseWriter, req *http.Request) {
+	from, to, err := syncRange(req, MaxHeadersPerRequest)
+	if errors.Is(err, ErrNoCommonBlock) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	responseBytes, err := json.Marshal(HeadersResponse{Start: from, Headers: Headers(from, to)})
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(responseBytes))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// HandleBodiesRequest serves the blocks after the highest block in the requester's locator, or in the range given by
+// the "from" and "to" query parameters. At most MaxBodiesPerRequest blocks are served at once.
+//
+// A pruned node refuses ranges that include pruned blocks with 410 Gone, since it only has their headers.
+func HandleBodiesRequest(w http.ResponseWriter, req *http.Request) {
+	from, to, err := syncRange(req, MaxBodiesPerRequest)
+	if errors.Is(err, ErrNoCommonBlock) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	if from < PrunedHeight {
+		http.Error(w, fmt.Sprintf("blocks below height %d have been pruned", PrunedHeight), http.StatusGone)
+		return
+	}
+	responseBytes, err := json.Marshal(BodiesResponse{Start: from, Blocks: BlocksAt(from, to)})
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(responseBytes))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func HandleTransactionLookupRequest(w http.ResponseWriter, req *http.Request) {
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	hashBytes, err := hex.DecodeString(strings.TrimSpace(string(bodyBytes)))
+	if err != nil || len(hashBytes) != 32 {
+		http.Error(w, "invalid transaction hash", http.StatusBadRequest)
+		return
+	}
+	transaction, location, ok := GetTransaction([32]byte(hashBytes))
+	if !ok {
+		http.Error(w, "transaction not found", http.StatusNotFound)
+		return
+	}
+	recordBytes, err := json.Marshal(NewTransactionRecord(transaction, location))
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(recordBytes))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func HandleHistoryRequest(w http.ResponseWriter, req *http.Request) {
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	var address []byte
+	err = json.Unmarshal(bodyBytes, &address)
+	if err != nil {
+		http.Error(w, "invalid public key", http.StatusBadRequest)
+		return
+	}
+	historyBytes, err := json.Marshal(GetHistory(address))
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(historyBytes))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func HandleNonceRequest(w http.ResponseWriter, req *http.Request) {
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	var address []byte
+	err = json.Unmarshal(bodyBytes, &address)
+	if err != nil {
+		http.Error(w, "invalid public key", http.StatusBadRequest)
+		return
+	}
+	nonceBytes, err := json.Marshal(NonceInfo{
+		Confirmed: AccountNonce(address),
+		Next:      NextNonce(address),
+	})
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(nonceBytes))
+	if err != nil {
+		panic(err)
+	}
+}
+
+func HandlePendingRequest(w http.ResponseWriter, req *http.Request) {
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		panic(err)
+	}
+	hash, err := hex.DecodeString(strings.TrimSpace(string(bodyBytes)))
+	if err != nil || len(hash) != 32 {
+		http.Error(w, "invalid transaction hash", http.StatusBadRequest)
+		return
+	}
+	entry, ok := Pool.Get([32]byte(hash))
+	if !ok {
+		http.Error(w, "transaction not pending", http.StatusNotFound)
+		return
+	}
+	recordBytes, err := json.Marshal(NewPendingRecord(entry))
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(recordBytes))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// NodeInfo describes a node to its peers, as served by the "/info" endpoint.
+type NodeInfo struct {
+	Height       int    `json:"height"`
+	Pruned       bool   `json:"pruned"`
+	PrunedHeight int    `json:"prunedHeight"` // Blocks below this height can't be requested from the node
+	Genesis      string `json:"genesis"`      // Hex encoded hash of the network's genesis block
+}
+
+func HandleInfoRequest(w http.ResponseWriter, _ *http.Request) {
+	genesisHash := HashBlock(GenesisBlock(), 0)
+	infoBytes, err := json.Marshal(NodeInfo{
+		Height:       len(Blockchain),
+		Pruned:       PruneMode,
+		PrunedHeight: PrunedHeight,
+		Genesis:      hex.EncodeToString(genesisHash[:]),
+	})
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(infoBytes))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// HandleRejectionsRequest serves the number of blocks and transactions rejected for each reason.
+func HandleRejectionsRequest(w http.ResponseWriter, _ *http.Request) {
+	countsBytes, err := json.Marshal(Rejections.Counts())
+	if err != nil {
+		panic(err)
+	}
+	_, err = io.WriteString(w, string(countsBytes))
+	if err != nil {
+		panic(err)
+	}
+}
+
 func HandleIdentifyRequest(w http.ResponseWriter, req *http.Request) {
 	// Get body of request
 	bodyBytes, err := io.ReadAll(req.Body)
@@ -237,7 +460,7 @@ func HandlePeerIpRequest(w http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			panic(err)
 		}
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := PeerClient.Do(req)
 		if err != nil {
 			Log("Peer is down.", true)
 			continue
@@ -277,7 +500,7 @@ func HandleVerifyTimeRequest(w http.ResponseWriter, req *http.Request) {
 	var miningFinishedTime time.Time
 	if block.MiningTime > 0 {
 		// Get the time mining finished
-		if Env.Upgrades.Yangon <= len(Blockchain) && Env.Upgrades.Yangon != -1 {
+		if IsActive(Yangon, len(Blockchain)) {
 			previousBlockFinishedTime := Blockchain[len(Blockchain)-1].Timestamp.Add(Blockchain[len(Blockchain)-1].MiningTime)
 			miningFinishedTime = previousBlockFinishedTime.Add(block.MiningTime)
 		} else {
@@ -356,12 +579,23 @@ func Serve(mine bool, port string) {
 	if mine {
 		http.HandleFunc("/mine", HandleMineRequest)
 	}
+	if Regtest {
+		http.HandleFunc("/generate", HandleGenerateRequest)
+	}
 	http.HandleFunc("/block", HandleBlockRequest)
 	http.HandleFunc("/blockchain", HandleBlockchainRequest)
+	http.HandleFunc("/headers", HandleHeadersRequest)
+	http.HandleFunc("/bodies", HandleBodiesRequest)
 	http.HandleFunc("/identify", HandleIdentifyRequest)
 	http.HandleFunc("/peerIp", HandlePeerIpRequest)
 	http.HandleFunc("/verifyTime", HandleVerifyTimeRequest)
 	http.HandleFunc("/peers", HandlePeersRequest)
 	http.HandleFunc("/addPeer", HandleAddPeerRequest)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+	http.HandleFunc("/transaction", HandleTransactionLookupRequest)
+	http.HandleFunc("/history", HandleHistoryRequest)
+	http.HandleFunc("/nonce", HandleNonceRequest)
+	http.HandleFunc("/pending", HandlePendingRequest)
+	http.HandleFunc("/info", HandleInfoRequest)
+	http.HandleFunc("/rejections", HandleRejectionsRequest)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), NetworkHandler(http.DefaultServeMux)))
 }
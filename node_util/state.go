@@ -39,17 +39,41 @@ func TransitionState(state State, transition StateTransition) State {
 	return state
 }
 
-func CalculateCurrentState() State {
-	state := State{
+// EmptyState returns the state before any block has been applied.
+func EmptyState() State {
+	return State{
 		LegacyData:      make(map[string][]byte),
 		LegacyContracts: make(map[uint64]Contract),
 		ZenData:         make([]MerkleNode, 0),
 		ZenContracts:    make([]MerkleNode, 0),
 	}
-	for _, block := range Blockchain {
-		state = TransitionState(state, block.Transition)
+}
+
+// CloneState returns a deep copy of a state, so that transitions applied to the copy don't affect the original.
+func CloneState(state State) State {
+	res := EmptyState()
+	for key, value := range state.LegacyData {
+		res.LegacyData[key] = append([]byte{}, value...)
+	}
+	for key, value := range state.LegacyContracts {
+		res.LegacyContracts[key] = value
 	}
-	return state
+	res.ZenData = CloneTree(state.ZenData)
+	res.ZenContracts = CloneTree(state.ZenContracts)
+	return res
+}
+
+// CalculateCurrentState returns the state after applying every block in the blockchain.
+//
+// The state is maintained incrementally by ChainState, so this does not replay the blockchain. It is shared, so it
+// must not be modified.
+func CalculateCurrentState() State {
+	return ChainState.Current()
+}
+
+// CalculateStateAt returns the state after applying the first `height` blocks of the blockchain.
+func CalculateStateAt(height int) State {
+	return ChainState.At(height)
 }
 
 func GetFromState(location string) []byte {
@@ -68,8 +92,8 @@ func GetFromState(location string) []byte {
 }
 
 func GetPendingState() State {
-	res := State{}
-	for _, subTransition := range NextTransitions {
+	res := State{LegacyData: make(map[string][]byte)}
+	for _, subTransition := range Pool.PendingTransitions() {
 		for location, data := range subTransition.LegacyUpdatedData {
 			res.LegacyData[location] = data
 		}
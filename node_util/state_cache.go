@@ -0,0 +1,181 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import "sync"
+
+type StateSnapshot struct {
+	Cursor ChainCursor
+	State  State
+}
+
+// StateCache maintains the current state as blocks are appended, instead of replaying the blockchain.
+//
+// Every StateSnapshotInterval blocks a copy of the state is kept, so the state can be rolled back on a reorg
+// (or rebuilt at a historic height) by replaying from the nearest snapshot instead of from the genesis block.
+// On a pruned node, blocks below the base snapshot no longer have transitions, so replays start from the base.
+//
+// The current state is handed out without copying it, so it is copied before the next block changes it instead.
+type StateCache struct {
+	cursor    ChainCursor
+	state     State
+	shared    bool // Whether the current state has been handed out, and must be copied before it is changed
+	snapshots []StateSnapshot
+	base      *StateSnapshot
+	mutex     sync.Mutex
+}
+
+var ChainState = NewStateCache()
+
+func NewStateCache() *StateCache {
+	return &StateCache{
+		state: EmptyState(),
+	}
+}
+
+// restore resets the cache to the newest snapshot at or below the given height that is still part of the blockchain.
+func (c *StateCache) restore(height int) {
+	for len(c.snapshots) > 0 {
+		snapshot := c.snapshots[len(c.snapshots)-1]
+		if snapshot.Cursor.Height <= height && snapshot.Cursor.Valid() {
+			c.cursor = snapshot.Cursor
+			c.state, c.shared = CloneState(snapshot.State), false
+			return
+		}
+		c.snapshots = c.snapshots[:len(c.snapshots)-1]
+	}
+	if c.base != nil && c.base.Cursor.Height <= height && c.base.Cursor.Valid() {
+		c.cursor = c.base.Cursor
+		c.state, c.shared = CloneState(c.base.State), false
+		return
+	}
+	c.cursor = ChainCursor{}
+	c.state, c.shared = EmptyState(), false
+}
+
+// advance applies blocks to the cached state until it reaches the given height.
+func (c *StateCache) advance(height int) {
+	for c.cursor.Height < height {
+		if c.shared {
+			c.state, c.shared = CloneState(c.state), false
+		}
+		c.state = TransitionState(c.state, BlockAt(c.cursor.Height).Transition)
+		c.cursor.Advance()
+		if c.cursor.Height%StateSnapshotInterval == 0 {
+			c.snapshots = append(c.snapshots, StateSnapshot{
+				Cursor: c.cursor,
+				State:  CloneState(c.state),
+			})
+			if len(c.snapshots) > MaxStateSnapshots {
+				c.snapshots = c.snapshots[1:]
+			}
+		}
+	}
+}
+
+// Update applies any blocks appended since the last update, rolling back first if the blockchain was rewritten.
+func (c *StateCache) Update() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+}
+
+func (c *StateCache) update() {
+	if !c.cursor.Valid() {
+		c.restore(len(Blockchain))
+	}
+	c.advance(len(Blockchain))
+}
+
+// Rollback discards the cached state for blocks at or above the given height.
+func (c *StateCache) Rollback(height int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cursor.Height > height {
+		c.restore(height)
+	}
+}
+
+// Current returns the state after applying every block in the blockchain.
+//
+// The state is shared with the cache and every other caller, so it must not be modified (use CloneState to get a copy
+// that can be).
+func (c *StateCache) Current() State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	c.shared = true
+	return c.state
+}
+
+// At returns the state after applying the first `height` blocks, replaying from the nearest snapshot.
+//
+// Like Current, the state must not be modified.
+func (c *StateCache) At(height int) State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	return c.at(height)
+}
+
+func (c *StateCache) at(height int) State {
+	if height >= c.cursor.Height {
+		c.shared = true
+		return c.state
+	}
+	replay := ChainCursor{}
+	state := EmptyState()
+	if c.base != nil && c.base.Cursor.Height <= height {
+		replay = c.base.Cursor
+		state = CloneState(c.base.State)
+	}
+	for i := len(c.snapshots) - 1; i >= 0; i-- {
+		if c.snapshots[i].Cursor.Height <= height && c.snapshots[i].Cursor.Height > replay.Height {
+			replay = c.snapshots[i].Cursor
+			state = CloneState(c.snapshots[i].State)
+			break
+		}
+	}
+	for replay.Height < height {
+		state = TransitionState(state, BlockAt(replay.Height).Transition)
+		replay.Advance()
+	}
+	return state
+}
+
+// Prune makes the state at the given height the base snapshot, so blocks below it no longer need their transitions.
+//
+// It returns the base state, so it can be persisted alongside the pruned block store.
+func (c *StateCache) Prune(height int) State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.update()
+	state := c.at(height)
+	c.base = &StateSnapshot{
+		Cursor: NewChainCursor(height),
+		State:  CloneState(state),
+	}
+	for len(c.snapshots) > 0 && c.snapshots[0].Cursor.Height < height {
+		c.snapshots = c.snapshots[1:]
+	}
+	return state
+}
+
+// SetBase installs a base snapshot loaded from disk. The blockchain must already contain the snapshot's height.
+func (c *StateCache) SetBase(height int, state State) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.base = &StateSnapshot{
+		Cursor: NewChainCursor(height),
+		State:  CloneState(state),
+	}
+	c.snapshots = nil
+	c.restore(len(Blockchain))
+	c.advance(len(Blockchain))
+}
@@ -46,7 +46,7 @@ func RequestTimeVerification(block Block) ([]Signature, []PublicKey) {
 		if err != nil {
 			panic(err)
 		}
-		res, err := http.DefaultClient.Do(req)
+		res, err := PeerClient.Do(req)
 		if err != nil {
 			Log("Peer down.", true)
 			continue
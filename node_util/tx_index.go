@@ -0,0 +1,292 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+type TransactionLocation struct {
+	Hash        [32]byte
+	BlockHeight int
+	Position    int // Position in the block's transactions, as returned by ExtractTransactions
+}
+
+type HistoryEntry struct {
+	Location TransactionLocation
+	Sent     bool
+	Received bool
+}
+
+// TransactionRecord is the JSON representation of an indexed transaction, as served by the "/transaction" and "/history" endpoints.
+type TransactionRecord struct {
+	Hash          string  `json:"hash"`
+	BlockHeight   int     `json:"blockHeight"`
+	Position      int     `json:"position"`
+	Confirmations int     `json:"confirmations"`
+	Sender        string  `json:"sender"`
+	Recipient     string  `json:"recipient"`
+	Amount        float64 `json:"amount"`
+	Timestamp     int64   `json:"timestamp"`
+	Sent          bool    `json:"sent,omitempty"`
+	Received      bool    `json:"received,omitempty"`
+	Pruned        bool    `json:"pruned,omitempty"` // The block has been pruned, so only the location is known
+}
+
+func NewTransactionRecord(transaction Transaction, location TransactionLocation) TransactionRecord {
+	return TransactionRecord{
+		Hash:          hex.EncodeToString(location.Hash[:]),
+		BlockHeight:   location.BlockHeight,
+		Position:      location.Position,
+		Confirmations: len(Blockchain) - location.BlockHeight,
+		Sender:        hex.EncodeToString(transaction.Sender.Y),
+		Recipient:     hex.EncodeToString(transaction.Recipient.Y),
+		Amount:        transaction.Amount,
+		Timestamp:     transaction.Timestamp.UnixNano(),
+		Pruned:        location.BlockHeight < PrunedHeight,
+	}
+}
+
+// txIndexUndo records what a block added to the transaction index, so the block can be rolled back.
+type txIndexUndo struct {
+	cursor    ChainCursor // The cursor before the block was applied
+	hashes    [][32]byte
+	addresses []string // Every address a history entry was added for, in order
+}
+
+// txIndexBase is the transaction index at the base height of a pruned node, below which blocks have no transactions.
+type txIndexBase struct {
+	cursor  ChainCursor
+	history map[string][]HistoryEntry
+}
+
+// TransactionIndex indexes on-chain transactions by hash and by address, maintained incrementally as blocks are appended.
+//
+// Like the account ledger, the last LedgerUndoDepth blocks can be rolled back without rebuilding the index.
+// Deeper rollbacks rebuild it from the genesis block, or from the base snapshot on a pruned node.
+type TransactionIndex struct {
+	cursor    ChainCursor
+	locations map[[32]byte]TransactionLocation
+	history   map[string][]HistoryEntry
+	undo      []txIndexUndo
+	base      *txIndexBase
+	mutex     sync.Mutex
+}
+
+var TxIndex = NewTransactionIndex()
+
+func NewTransactionIndex() *TransactionIndex {
+	return &TransactionIndex{
+		locations: make(map[[32]byte]TransactionLocation),
+		history:   make(map[string][]HistoryEntry),
+	}
+}
+
+func (x *TransactionIndex) apply() {
+	height := x.cursor.Height
+	undo := txIndexUndo{
+		cursor: x.cursor,
+	}
+	for position, transaction := range ExtractTransactions(BlockAt(height)) {
+		location := TransactionLocation{
+			Hash:        TransactionHash(transaction),
+			BlockHeight: height,
+			Position:    position,
+		}
+		if _, ok := x.locations[location.Hash]; !ok {
+			x.locations[location.Hash] = location
+			undo.hashes = append(undo.hashes, location.Hash)
+		}
+		sender := string(transaction.Sender.Y)
+		x.history[sender] = append(x.history[sender], HistoryEntry{
+			Location: location,
+			Sent:     true,
+			Received: bytes.Equal(transaction.Sender.Y, transaction.Recipient.Y),
+		})
+		undo.addresses = append(undo.addresses, sender)
+		if !bytes.Equal(transaction.Sender.Y, transaction.Recipient.Y) {
+			recipient := string(transaction.Recipient.Y)
+			x.history[recipient] = append(x.history[recipient], HistoryEntry{
+				Location: location,
+				Received: true,
+			})
+			undo.addresses = append(undo.addresses, recipient)
+		}
+	}
+	x.cursor.Advance()
+	x.undo = append(x.undo, undo)
+	if len(x.undo) > LedgerUndoDepth {
+		x.undo = x.undo[1:]
+	}
+}
+
+func (x *TransactionIndex) revert() {
+	undo := x.undo[len(x.undo)-1]
+	x.undo = x.undo[:len(x.undo)-1]
+	for _, hash := range undo.hashes {
+		delete(x.locations, hash)
+	}
+	for i := len(undo.addresses) - 1; i >= 0; i-- {
+		address := undo.addresses[i]
+		x.history[address] = x.history[address][:len(x.history[address])-1]
+		if len(x.history[address]) == 0 {
+			delete(x.history, address)
+		}
+	}
+	x.cursor = undo.cursor
+}
+
+func (x *TransactionIndex) update() {
+	for !x.cursor.Valid() {
+		if len(x.undo) == 0 {
+			x.reset()
+			break
+		}
+		x.revert()
+	}
+	for x.cursor.Height < len(Blockchain) {
+		x.apply()
+	}
+}
+
+// Update indexes any blocks appended since the last update, rolling back first if the blockchain was rewritten.
+func (x *TransactionIndex) Update() {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.update()
+}
+
+// Rollback removes blocks at or above the given height from the index.
+func (x *TransactionIndex) Rollback(height int) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for x.cursor.Height > height {
+		if len(x.undo) == 0 {
+			x.reset()
+			break
+		}
+		x.revert()
+	}
+}
+
+func (x *TransactionIndex) reset() {
+	x.cursor = ChainCursor{}
+	x.locations = make(map[[32]byte]TransactionLocation)
+	x.history = make(map[string][]HistoryEntry)
+	x.undo = nil
+	if x.base != nil && x.base.cursor.Valid() {
+		x.cursor = x.base.cursor
+		for address, entries := range x.base.history {
+			x.history[address] = append([]HistoryEntry{}, entries...)
+			for _, entry := range entries {
+				// A hash is indexed at its first occurrence, like in apply
+				location, ok := x.locations[entry.Location.Hash]
+				if !ok || entry.Location.BlockHeight < location.BlockHeight ||
+					entry.Location.BlockHeight == location.BlockHeight && entry.Location.Position < location.Position {
+					x.locations[entry.Location.Hash] = entry.Location
+				}
+			}
+		}
+	}
+}
+
+// Prune makes the index at the given height the base snapshot, so blocks below it no longer need their transactions.
+//
+// The height must be within the last LedgerUndoDepth blocks. The history of every address at that height is returned,
+// so it can be persisted alongside the pruned block store.
+func (x *TransactionIndex) Prune(height int) map[string][]HistoryEntry {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.update()
+	if height > x.cursor.Height || height < x.cursor.Height-len(x.undo) {
+		panic(fmt.Sprintf("cannot prune the transaction index at height %d", height))
+	}
+	history := make(map[string][]HistoryEntry, len(x.history))
+	for address, entries := range x.history {
+		history[address] = append([]HistoryEntry{}, entries...)
+	}
+	i := len(x.undo) - 1
+	for ; i >= 0 && x.undo[i].cursor.Height >= height; i-- {
+		for j := len(x.undo[i].addresses) - 1; j >= 0; j-- {
+			address := x.undo[i].addresses[j]
+			history[address] = history[address][:len(history[address])-1]
+			if len(history[address]) == 0 {
+				delete(history, address)
+			}
+		}
+	}
+	x.undo = x.undo[i+1:]
+	x.base = &txIndexBase{
+		cursor:  NewChainCursor(height),
+		history: history,
+	}
+	return history
+}
+
+// SetBase installs a base snapshot loaded from disk. The blockchain must already contain the snapshot's height.
+func (x *TransactionIndex) SetBase(height int, history map[string][]HistoryEntry) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.base = &txIndexBase{
+		cursor:  NewChainCursor(height),
+		history: history,
+	}
+	x.reset()
+	x.update()
+}
+
+// Lookup finds the block height and position of an on-chain transaction by its hash.
+func (x *TransactionIndex) Lookup(hash [32]byte) (TransactionLocation, bool) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.update()
+	location, ok := x.locations[hash]
+	return location, ok
+}
+
+// History returns every on-chain transaction sent or received by an address, oldest first.
+func (x *TransactionIndex) History(address []byte) []HistoryEntry {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.update()
+	return append([]HistoryEntry{}, x.history[string(address)]...)
+}
+
+// GetTransaction returns an on-chain transaction by its hash, along with its location.
+//
+// If the transaction's block has been pruned, only the location is returned.
+func GetTransaction(hash [32]byte) (Transaction, TransactionLocation, bool) {
+	location, ok := TxIndex.Lookup(hash)
+	if !ok {
+		return Transaction{}, TransactionLocation{}, false
+	}
+	if location.BlockHeight < PrunedHeight {
+		return Transaction{}, location, true
+	}
+	return ExtractTransactions(BlockAt(location.BlockHeight))[location.Position], location, true
+}
+
+// GetHistory returns records of every on-chain transaction sent or received by an address, oldest first.
+func GetHistory(address []byte) []TransactionRecord {
+	var records []TransactionRecord
+	for _, entry := range TxIndex.History(address) {
+		var transaction Transaction
+		if entry.Location.BlockHeight >= PrunedHeight {
+			transaction = ExtractTransactions(BlockAt(entry.Location.BlockHeight))[entry.Location.Position]
+		}
+		record := NewTransactionRecord(transaction, entry.Location)
+		record.Sent = entry.Sent
+		record.Received = entry.Received
+		records = append(records, record)
+	}
+	return records
+}
@@ -0,0 +1,115 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import "fmt"
+
+// Overview
+// Network upgrades change the consensus rules from a given block height. UpgradeRegistry lists every upgrade the node
+// knows about, in the order they were introduced, and each network sets their activation heights under `upgrades` in
+// env.json, or in its params.json if it fixes them (see network.go). A height of -1, or leaving an upgrade out,
+// disables it. (Before the registry, -1 made some upgrades active from the genesis block instead; network_updates.md
+// lists which.) Code that depends on an upgrade asks IsActive whether it applies to a block height, rather than
+// comparing against the heights itself.
+// To add an upgrade, declare its name, add it to the end of UpgradeRegistry, and give it a height in env.json. Schedule
+// it above the testnet's current height, so that blocks already mined aren't judged by its rules.
+
+// UpgradeName is the name of a network upgrade, as it appears in env.json.
+type UpgradeName string
+
+const (
+	Guadalajara UpgradeName = "guadalajara"
+	Jinan       UpgradeName = "jinan"
+	Alexandria  UpgradeName = "alexandria"
+	Yangon      UpgradeName = "yangon"
+	Washington  UpgradeName = "washington"
+	Dalian      UpgradeName = "dalian"
+	Qingdao     UpgradeName = "qingdao"
+	Zen         UpgradeName = "zen"
+	Kyoto       UpgradeName = "kyoto"
+	Lagos       UpgradeName = "lagos"
+	Oslo        UpgradeName = "oslo"
+)
+
+// Upgrade is a network upgrade the node supports.
+type Upgrade struct {
+	Name        UpgradeName
+	Description string
+}
+
+// UpgradeRegistry is every network upgrade, in the order they were introduced.
+var UpgradeRegistry = []Upgrade{
+	{Guadalajara, "Raises the block reward multiplier from 0.95 to 0.99 per miner"},
+	{Jinan, "Removes the limit on the number of miners"},
+	{Alexandria, "Multiplies the block reward by 5 every year"},
+	{Yangon, "Measures mining time from when the previous block finished mining"},
+	{Washington, "Changes the format blocks are hashed in"},
+	{Dalian, "Retunes the difficulty adjustment curve"},
+	{Qingdao, "Divides difficulty by the number of transactions in a block"},
+	{Zen, "Verifies smart contracts with ZK proofs and stores state in a Merkle tree"},
+	{Kyoto, "Adds nonces, tips, replace-by-fee and validity windows to transactions"},
+	{Lagos, "Limits the size, gas and number of transactions in a block"},
+	{Oslo, "Adds a base fee that adjusts with block fullness, which is burned or redistributed instead of paid to the miner"},
+}
+
+// NetworkUpgrades is the activation height of each upgrade on a network, keyed by name.
+type NetworkUpgrades map[UpgradeName]int
+
+// Upgrade statuses, as shown by the upgrades command.
+const (
+	UpgradeActive   = "active"
+	UpgradePending  = "pending"
+	UpgradeDisabled = "disabled"
+)
+
+// LookupUpgrade returns the registered upgrade with a name.
+func LookupUpgrade(name UpgradeName) (Upgrade, bool) {
+	for _, upgrade := range UpgradeRegistry {
+		if upgrade.Name == name {
+			return upgrade, true
+		}
+	}
+	return Upgrade{}, false
+}
+
+// ActivationHeight returns the height an upgrade activates at on the current network, or false if it is disabled.
+func ActivationHeight(name UpgradeName) (int, bool) {
+	height, ok := Env.Upgrades[name]
+	if !ok || height < 0 {
+		return 0, false
+	}
+	return height, true
+}
+
+// IsActive reports whether an upgrade's rules apply to the block at the given height on the current network.
+func IsActive(name UpgradeName, height int) bool {
+	activation, ok := ActivationHeight(name)
+	return ok && activation <= height
+}
+
+// UpgradeStatus returns whether an upgrade is active, pending or disabled for the block at the given height.
+func UpgradeStatus(name UpgradeName, height int) string {
+	if _, ok := ActivationHeight(name); !ok {
+		return UpgradeDisabled
+	}
+	if IsActive(name, height) {
+		return UpgradeActive
+	}
+	return UpgradePending
+}
+
+// verifyUpgrades checks that a network's upgrades are all registered.
+func verifyUpgrades(upgrades NetworkUpgrades) error {
+	for name := range upgrades {
+		if _, ok := LookupUpgrade(name); !ok {
+			return fmt.Errorf("unknown network upgrade %q", name)
+		}
+	}
+	return nil
+}
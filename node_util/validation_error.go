@@ -0,0 +1,179 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package node_util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Overview
+// Validation reports why a block or transaction is invalid with a ValidationError. Each error has a reason code,
+// which is stable across versions, so peers and operators can act on it without parsing messages. The "/block" and
+// "/mine" endpoints send rejections back to the peer as a JSON RejectionResponse, with an HTTP status that depends on
+// the reason, and every rejection is counted by reason. The counts are served by the "/rejections" endpoint.
+
+// ReasonCode identifies why a block or transaction was rejected.
+type ReasonCode string
+
+const (
+	ReasonMalformed               ReasonCode = "malformed"
+	ReasonInvalid                 ReasonCode = "invalid" // Any other reason
+	ReasonBadProofOfWork          ReasonCode = "bad-pow"
+	ReasonBadDifficulty           ReasonCode = "bad-difficulty"
+	ReasonBadTimeVerifiers        ReasonCode = "bad-time-verifiers"
+	ReasonInvalidZKProof          ReasonCode = "invalid-zk-proof"
+	ReasonBadContractTransactions ReasonCode = "bad-contract-transactions"
+	ReasonBadSignature            ReasonCode = "bad-signature"
+	ReasonDoubleSpend             ReasonCode = "double-spend"
+	ReasonBadNonce                ReasonCode = "bad-nonce"
+	ReasonBadTip                  ReasonCode = "bad-tip"
+	ReasonOutsideValidityWindow   ReasonCode = "outside-validity-window"
+	ReasonBadPreviousHash         ReasonCode = "bad-previous-hash"
+	ReasonBadGenesis              ReasonCode = "bad-genesis"
+	ReasonTooManyMiners           ReasonCode = "too-many-miners"
+	ReasonFutureTimestamp         ReasonCode = "future-timestamp"
+	ReasonCheckpointConflict      ReasonCode = "checkpoint-conflict"
+	ReasonExceedsBlockLimits      ReasonCode = "exceeds-block-limits"
+	ReasonDuplicate               ReasonCode = "duplicate"
+	ReasonUnknownParent           ReasonCode = "unknown-parent"
+	ReasonForkTooDeep             ReasonCode = "fork-too-deep"
+	ReasonAlreadyMined            ReasonCode = "already-mined"
+	ReasonExpired                 ReasonCode = "expired"
+	ReasonStaleNonce              ReasonCode = "stale-nonce"
+	ReasonReplacementUnderpriced  ReasonCode = "replacement-underpriced"
+	ReasonMempoolFull             ReasonCode = "mempool-full"
+	ReasonWrongNetwork            ReasonCode = "wrong-network"
+)
+
+// HTTPStatus returns the status a rejection with this reason is served with.
+func (c ReasonCode) HTTPStatus() int {
+	switch c {
+	case ReasonMalformed:
+		return http.StatusBadRequest
+	case ReasonDuplicate, ReasonUnknownParent, ReasonAlreadyMined, ReasonStaleNonce, ReasonReplacementUnderpriced:
+		return http.StatusConflict
+	case ReasonMempoolFull:
+		return http.StatusServiceUnavailable
+	case ReasonWrongNetwork:
+		return http.StatusMisdirectedRequest
+	default:
+		return http.StatusUnprocessableEntity
+	}
+}
+
+// ValidationError is the reason a block or transaction was rejected.
+type ValidationError struct {
+	Code    ReasonCode `json:"code"`
+	Message string     `json:"message"`
+	Err     error      `json:"-"` // Underlying error, so errors.Is still matches it
+}
+
+func NewValidationError(code ReasonCode, message string) *ValidationError {
+	return &ValidationError{Code: code, Message: message}
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// reasonCodes gives the reason code of each error that isn't a ValidationError.
+var reasonCodes = []struct {
+	Err  error
+	Code ReasonCode
+}{
+	{ErrMempoolDuplicate, ReasonDuplicate},
+	{ErrMempoolFull, ReasonMempoolFull},
+	{ErrReplacementUnderpriced, ReasonReplacementUnderpriced},
+	{ErrTransactionMined, ReasonAlreadyMined},
+	{ErrTransactionExpired, ReasonExpired},
+	{ErrStaleNonce, ReasonStaleNonce},
+	{ErrUnknownParent, ReasonUnknownParent},
+	{ErrForkTooDeep, ReasonForkTooDeep},
+	{ErrInvalidProofOfWork, ReasonBadProofOfWork},
+	{ErrCheckpointConflict, ReasonCheckpointConflict},
+	{ErrWrongNetwork, ReasonWrongNetwork},
+}
+
+// AsValidationError returns the ValidationError in an error's chain, or wraps the error in one.
+func AsValidationError(err error) *ValidationError {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr
+	}
+	code := ReasonInvalid
+	for _, reason := range reasonCodes {
+		if errors.Is(err, reason.Err) {
+			code = reason.Code
+			break
+		}
+	}
+	return &ValidationError{Code: code, Message: err.Error(), Err: err}
+}
+
+// RejectionResponse is served by the "/block" and "/mine" endpoints when they reject a block or transaction, and to
+// requests from nodes on other networks.
+type RejectionResponse struct {
+	Errors []*ValidationError `json:"errors"`
+}
+
+// WriteRejection counts a rejection and sends it to the peer, with the status of its first error.
+func WriteRejection(w http.ResponseWriter, errs ...*ValidationError) {
+	Rejections.Record(errs...)
+	responseBytes, err := json.Marshal(RejectionResponse{Errors: errs})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errs[0].Code.HTTPStatus())
+	_, _ = w.Write(responseBytes)
+}
+
+// RejectionCounter counts rejected blocks and transactions by reason.
+type RejectionCounter struct {
+	counts map[ReasonCode]uint64
+	mutex  sync.Mutex
+}
+
+var Rejections = NewRejectionCounter()
+
+func NewRejectionCounter() *RejectionCounter {
+	return &RejectionCounter{counts: make(map[ReasonCode]uint64)}
+}
+
+// Record counts a rejection once for each distinct reason.
+func (r *RejectionCounter) Record(errs ...*ValidationError) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	seen := make(map[ReasonCode]bool)
+	for _, err := range errs {
+		if !seen[err.Code] {
+			seen[err.Code] = true
+			r.counts[err.Code]++
+		}
+	}
+}
+
+// Counts returns the number of rejections for each reason.
+func (r *RejectionCounter) Counts() map[ReasonCode]uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	counts := make(map[ReasonCode]uint64, len(r.counts))
+	for code, count := range r.counts {
+		counts[code] = count
+	}
+	return counts
+}
@@ -21,19 +21,42 @@ import (
 	"github.com/open-quantum-safe/liboqs-go/oqs"
 )
 
-func VerifyTransaction(senderKey PublicKey, recipientKey PublicKey, amount string, timestamp time.Time, sig []byte) bool {
-	amountFloat, err := strconv.ParseFloat(amount, 64)
-	if err != nil {
-		panic(err)
+// VerifyTransaction checks a signed transaction's signature, that it hasn't expired, and that the sender can afford
+// it. Pool.Accept also checks that the sender can afford it on top of their other pending transactions.
+func VerifyTransaction(transaction Transaction) bool {
+	return ValidateTransaction(NodeChain, NodeState, transaction)
+}
+
+// ValidateTransaction checks a signed transaction against a chain and its state, as VerifyTransaction does.
+func ValidateTransaction(chain ChainView, state StateView, transaction Transaction) bool {
+	return CheckTransaction(chain, state, transaction) == nil
+}
+
+// CheckTransaction checks a signed transaction against a chain and its state, and returns why it is invalid, or nil if
+// it is valid.
+func CheckTransaction(chain ChainView, state StateView, transaction Transaction) *ValidationError {
+	if TransactionExpired(transaction, chain.Height(), time.Now()) {
+		Log("Expired transaction detected.", true)
+		return &ValidationError{Code: ReasonExpired, Message: "transaction has expired", Err: ErrTransactionExpired}
+	}
+	if !verifyTransactionSignature(transaction) {
+		return &ValidationError{Code: ReasonBadSignature, Message: "invalid transaction signature", Err: ErrInvalidTransaction}
+	}
+	if !validateTransactionBalance(chain, state, transaction, 0) {
+		return &ValidationError{Code: ReasonDoubleSpend, Message: "sender can't afford the transaction", Err: ErrInvalidTransaction}
 	}
-	transactionString := fmt.Sprintf("%s:%s:%s:%d", senderKey.Y, recipientKey.Y, amount, timestamp.UnixNano())
-	hash := sha256.Sum256([]byte(transactionString))
+	return nil
+}
+
+// verifyTransactionSignature checks that a transaction was signed by its sender.
+func verifyTransactionSignature(transaction Transaction) bool {
+	hash := TransactionSigningHash(transaction)
 	verifier := oqs.Signature{}
 	sigName := "Dilithium3"
 	if err := verifier.Init(sigName, nil); err != nil {
 		Error("Failed to initialize Dilithium2 verifier", true)
 	}
-	isValid, err := verifier.Verify(hash[:], sig, senderKey.Y)
+	isValid, err := verifier.Verify(hash[:], transaction.SenderSignature.S, transaction.Sender.Y)
 	if err != nil {
 		panic(err)
 	}
@@ -41,26 +64,23 @@ func VerifyTransaction(senderKey PublicKey, recipientKey PublicKey, amount strin
 		Log("Invalid transaction signature detected", true)
 		return false
 	}
-	// Calculate amount spent so far in this block
-	var amountSpentInCurrentBlock float64
-	for _, transaction := range MiningTransactions {
-		if bytes.Equal(transaction.Sender.Y, senderKey.Y) {
-			if amountSpentInCurrentBlock+transaction.Amount > amountSpentInCurrentBlock {
-				Log("Overflow detected.", true)
-				return false
-			}
-			amountSpentInCurrentBlock += transaction.Amount
-			if len(Blockchain) > 50 {
-				amountSpentInCurrentBlock += TransactionFee                                  // Base fee
-				amountSpentInCurrentBlock += BodyFeePerByte * float64(len(transaction.Body)) // Body fee
-				for _, contract := range transaction.Contracts {
-					amountSpentInCurrentBlock += GasPrice * contract.GasUsed // Gas fee
-				}
-			}
-		}
-	}
-	amountSpentInCurrentBlock -= amountFloat
-	if GetBalance(senderKey.Y) < amountSpentInCurrentBlock {
+	return true
+}
+
+// transactionCost returns what a transaction takes from its sender's balance in the block after a chain: its amount
+// and tip, and once fees are active, its base fees.
+func transactionCost(chain ChainView, transaction Transaction) float64 {
+	cost := transaction.Amount + transaction.Tip
+	if chain.Height() > 50 {
+		cost += BaseFees(transaction, chain.BaseFee(chain.Height()))
+	}
+	return cost
+}
+
+// validateTransactionBalance checks that the sender of a transaction can afford it in the block after a chain, on top
+// of the amount they already spend.
+func validateTransactionBalance(chain ChainView, state StateView, transaction Transaction, spent float64) bool {
+	if state.Balance(transaction.Sender.Y) < spent+transactionCost(chain, transaction) {
 		Log("Double spending detected.", true)
 		return false
 	}
@@ -68,55 +88,85 @@ func VerifyTransaction(senderKey PublicKey, recipientKey PublicKey, amount strin
 }
 
 func VerifyMiner(miner PublicKey) bool {
-	if Env.Upgrades.Jinan <= len(Blockchain) {
+	return ValidateMiner(NodeChain, miner)
+}
+
+// ValidateMiner checks that a miner may mine the block after a chain, since the number of miners is limited before
+// the Jinan upgrade.
+func ValidateMiner(chain ChainView, miner PublicKey) bool {
+	height := chain.Height()
+	if IsActive(Jinan, height) {
 		return true
 	}
-	if IsNewMiner(miner, len(Blockchain)) && GetMinerCount(len(Blockchain)) >= GetMaxMiners() {
-		Log(fmt.Sprintf("Miner count: %d", GetMinerCount(len(Blockchain))), true)
-		Log(fmt.Sprintf("Maximum miner count: %d", GetMaxMiners()), true)
+	if chain.IsNewMiner(miner.Y, height) && chain.MinerCount(height) >= MaxMiners(height) {
+		Log(fmt.Sprintf("Miner count: %d", chain.MinerCount(height)), true)
+		Log(fmt.Sprintf("Maximum miner count: %d", MaxMiners(height)), true)
 		return false
 	}
 	return true
 }
 
-func VerifyTransactions(transactions []Transaction) bool {
+func VerifyTransactions(transactions []Transaction, height int) bool {
+	return ValidateTransactions(NodeChain, NodeState, transactions, height)
+}
+
+// ValidateTransactions checks the transactions of a block at the given height against a chain and its state.
+func ValidateTransactions(chain ChainView, state StateView, transactions []Transaction, height int) bool {
+	return CheckTransactions(chain, state, transactions, height) == nil
+}
+
+// CheckTransactions checks the transactions of a block at the given height against a chain and its state, and returns
+// why they are invalid, or nil if they are valid. Each sender must be able to afford all of their transactions in the
+// block together.
+func CheckTransactions(chain ChainView, state StateView, transactions []Transaction, height int) *ValidationError {
+	if !ValidateNonces(state, transactions, height) {
+		Log("Block has a transaction with an invalid nonce. Ignoring block request.", true)
+		return NewValidationError(ReasonBadNonce, "transaction with an invalid nonce")
+	}
+	if !VerifyTips(transactions, height) {
+		Log("Block has a transaction with an invalid tip. Ignoring block request.", true)
+		return NewValidationError(ReasonBadTip, "transaction with an invalid tip")
+	}
+	spent := make(map[string]float64)
 	for _, transaction := range transactions {
 		if transaction.FromSmartContract {
-			return true
+			continue
 		}
-		if !VerifyTransaction(transaction.Sender, transaction.Recipient, strconv.FormatFloat(transaction.Amount, 'f', -1, 64), transaction.Timestamp, transaction.SenderSignature.S) {
-			Log("Block has invalid transaction/transaction signature. Ignoring block request.", true)
-			return false
+		sender := string(transaction.Sender.Y)
+		if !validateTransactionBalance(chain, state, transaction, spent[sender]) {
+			Log("Block has a double spending transaction. Ignoring block request.", true)
+			return NewValidationError(ReasonDoubleSpend, "sender can't afford a transaction")
+		}
+		spent[sender] += transactionCost(chain, transaction)
+		if !SkipFullVerification(height) && !verifyTransactionSignature(transaction) {
+			Log("Block has invalid transaction signature. Ignoring block request.", true)
+			return NewValidationError(ReasonBadSignature, "invalid transaction signature")
 		}
 	}
-	return true
+	return nil
 }
 
-func DetectFork(block Block) bool {
-	for i, b := range Blockchain {
-		if i == len(Blockchain)-1 {
-			break
-		}
-		if b.PreviousBlockHash == block.PreviousBlockHash {
-			Log("Block creates a fork. Possible reorg necessary.", true)
-			SyncBlockchain(len(Blockchain) + BlocksUntilFinality) // Reorg if other chain is more than `BlocksUntilFinality` blocks longer than the current chain
+func DetectDuplicateBlock(hashBytes [64]byte) bool {
+	return containsBlock(NodeChain, hashBytes)
+}
+
+// containsBlock reports whether a chain has a block with the given hash.
+func containsBlock(chain ChainView, hashBytes [64]byte) bool {
+	for height := 0; height < chain.Height(); height++ {
+		if chain.BlockHash(height) == hashBytes {
 			return true
 		}
 	}
 	return false
 }
 
-func DetectDuplicateBlock(hashBytes [64]byte) bool {
-	isDuplicate := false
-	for i, b := range Blockchain {
-		if HashBlock(b, i) == hashBytes {
-			isDuplicate = true
-		}
-	}
-	return isDuplicate
+func VerifySmartContractTransactionsPreZen(block Block) bool {
+	return validateSmartContractTransactionsPreZen(NodeState, block)
 }
 
-func VerifySmartContractTransactionsPreZen(block Block) bool {
+// validateSmartContractTransactionsPreZen re-executes a pre-Zen block's contracts in the VM, and checks their
+// transactions and state transitions. The VM executes contracts against the node's pending state.
+func validateSmartContractTransactionsPreZen(state StateView, block Block) bool {
 	// Ensure the transactions created by smart contracts are valid
 	// Iterate through smart contracts
 	var smartContractCreatedTransactions []Transaction
@@ -132,7 +182,7 @@ func VerifySmartContractTransactionsPreZen(block Block) bool {
 				return false
 			}
 			// Execute the contract
-			transactions, transition, gasUsed, err := contract.Execute(GetBalance(transaction.Sender.Y)/GasPrice, transaction.Sender)
+			transactions, transition, gasUsed, err := contract.Execute(state.Balance(transaction.Sender.Y)/GasPrice, transaction.Sender)
 			if err != nil {
 				continue
 			}
@@ -172,16 +222,31 @@ func VerifySmartContractTransactionsPreZen(block Block) bool {
 }
 
 func VerifySmartContractTransactions(block Block) bool {
-	if len(Blockchain) < Env.Upgrades.Zen && Env.Upgrades.Zen != -1 {
-		return VerifySmartContractTransactionsPreZen(block)
+	return ValidateSmartContractTransactions(NodeChain, NodeState, block)
+}
+
+// ValidateSmartContractTransactions checks the contract transactions and state transition of the block after a chain,
+// using its ZK proof after the Zen upgrade.
+func ValidateSmartContractTransactions(chain ChainView, chainState StateView, block Block) bool {
+	return CheckSmartContractTransactions(chain, chainState, block) == nil
+}
+
+// CheckSmartContractTransactions checks the block after a chain as ValidateSmartContractTransactions does, and returns
+// why it is invalid, or nil if it is valid.
+func CheckSmartContractTransactions(chain ChainView, chainState StateView, block Block) *ValidationError {
+	if !IsActive(Zen, chain.Height()) {
+		if !validateSmartContractTransactionsPreZen(chainState, block) {
+			return NewValidationError(ReasonBadContractTransactions, "invalid smart contract transactions or state transition")
+		}
+		return nil
 	}
 	for _, tx := range ExtractTransactions(block) {
 		if tx.FromSmartContract {
 			// Zen doesn't support smart contract transactions
-			return false
+			return NewValidationError(ReasonBadContractTransactions, "smart contract transactions aren't allowed after the Zen upgrade")
 		}
 	}
-	state := CalculateCurrentState()
+	state := chainState.State()
 	var root string
 	if len(state.ZenData) > 0 {
 		root = state.ZenData[0].Hash
@@ -201,12 +266,12 @@ func VerifySmartContractTransactions(block Block) bool {
 		}
 	}
 	for _, transaction := range ExtractTransactions(block) {
-		hasher.Write([]byte(strconv.Itoa(int(GetBalance(transaction.Sender.Y) / GasPrice))))
+		hasher.Write([]byte(strconv.Itoa(int(chainState.Balance(transaction.Sender.Y) / GasPrice))))
 	}
 	for _, transaction := range ExtractTransactions(block) {
 		hasher.Write([]byte(hex.EncodeToString(transaction.Sender.Y)))
 	}
-	hasher.Write([]byte(strconv.Itoa(len(Blockchain))))
+	hasher.Write([]byte(strconv.Itoa(chain.Height())))
 	hash := hasher.Sum(nil)
 	var transitionRoot string
 	if len(block.Transition.ZenUpdatedData) > 0 {
@@ -216,28 +281,53 @@ func VerifySmartContractTransactions(block Block) bool {
 	}
 	if !ZKVerify(block.ZenProof, root, hex.EncodeToString(hash), transitionRoot) {
 		Warn("Block has invalid ZK proof. Ignoring block request.")
-		return false
+		return NewValidationError(ReasonInvalidZKProof, "invalid ZK proof")
 	}
-	return true
+	return nil
 }
 
 func VerifyBlock(block Block, blockHeight int) bool {
-	isValid := VerifyTransactions(ExtractTransactions(block))
+	return len(BlockProblems(block, blockHeight)) == 0
+}
+
+// BlockProblems verifies a block at the given height against the blockchain below it, and returns the reason for
+// every check the block fails. A valid block has no problems.
+func BlockProblems(block Block, blockHeight int) []*ValidationError {
+	return ValidateBlock(NodeChain, NodeState, block, blockHeight)
+}
+
+// ValidateBlock verifies a block at the given height against a chain and the state at its tip, and returns the reason
+// for every check the block fails. The block normally extends the chain, so its height is the chain's height.
+func ValidateBlock(chain ChainView, state StateView, block Block, blockHeight int) []*ValidationError {
+	var problems []*ValidationError
+	if err := CheckTransactions(chain, state, ExtractTransactions(block), blockHeight); err != nil {
+		problems = append(problems, err)
+	}
+	if err := CheckBlockLimits(ExtractTransactions(block), blockHeight); err != nil {
+		Log("Block goes past the block limits. Ignoring block request.", true)
+		problems = append(problems, err)
+	}
+	if !VerifyExpiry(ExtractTransactions(block), blockHeight, block.Timestamp) {
+		Log("Block has a transaction outside its validity window. Ignoring block request.", true)
+		problems = append(problems, NewValidationError(ReasonOutsideValidityWindow, "transaction outside its validity window"))
+	}
 	hashBytes := HashBlock(block, blockHeight)
 	hash := binary.BigEndian.Uint64(hashBytes[:]) // Take the last 64 bits-- we won't ever need more than 64 zeroes.
-	isValid = hash <= MaximumUint64/block.Difficulty && isValid
-	if DetectDuplicateBlock(hashBytes) {
-		return false
+	if block.Difficulty == 0 || hash > MaximumUint64/block.Difficulty {
+		problems = append(problems, NewValidationError(ReasonBadProofOfWork, "invalid proof of work"))
+	}
+	if containsBlock(chain, hashBytes) {
+		return append(problems, NewValidationError(ReasonDuplicate, "duplicate block"))
 	}
-	isValid = !DetectFork(block) && isValid
-	if len(Blockchain) > 0 && block.PreviousBlockHash != HashBlock(Blockchain[len(Blockchain)-1], len(Blockchain)-1) {
-		Log("Block has invalid previous block hash. Possible reorg is necessary.", true)
-		SyncBlockchain(len(Blockchain) + BlocksUntilFinality) // Reorg if other chain is more than `BlocksUntilFinality` blocks longer than the current chain
-		isValid = false
+	if blockHeight > 0 && blockHeight <= chain.Height() && block.PreviousBlockHash != chain.BlockHash(blockHeight-1) {
+		Log("Block has invalid previous block hash. Ignoring block request.", true)
+		problems = append(problems, NewValidationError(ReasonBadPreviousHash, "invalid previous block hash"))
+	}
+	if !ValidateMiner(chain, block.Miner) {
+		problems = append(problems, NewValidationError(ReasonTooManyMiners, "too many miners"))
 	}
-	isValid = VerifyMiner(block.Miner) && isValid
 	// Get the correct difficulty for the block
-	lastMinedBlock, found := GetLastMinedBlock(block.Miner.Y)
+	lastMinedBlock, found := chain.LastMinedBlock(block.Miner.Y)
 	if !found {
 		lastMinedBlock.Difficulty = InitialBlockDifficulty
 		lastMinedBlock.MiningTime = time.Minute
@@ -248,25 +338,39 @@ func VerifyBlock(block Block, blockHeight int) bool {
 		Log("The node software is designed to prevent difficulty manipulation, so this invalid difficulty will not cause issues for the network.", false)
 		Log(fmt.Sprintf("Expected difficulty: %d", correctDifficulty), true)
 		Log(fmt.Sprintf("Actual difficulty: %d", block.Difficulty), true)
-		isValid = false
+		problems = append(problems, NewValidationError(ReasonBadDifficulty, fmt.Sprintf("difficulty %d, expected %d", block.Difficulty, correctDifficulty)))
 	}
 	if block.Timestamp.After(time.Now()) {
 		Log("Block has invalid timestamp. Ignoring block request.", true)
 		Log("Timestamp is in the future.", true)
-		isValid = false
+		problems = append(problems, NewValidationError(ReasonFutureTimestamp, "timestamp in the future"))
+	}
+	if !MatchesCheckpoint(blockHeight, hashBytes) {
+		Log("Block conflicts with a checkpoint. Ignoring block request.", true)
+		problems = append(problems, NewValidationError(ReasonCheckpointConflict, "conflicts with a checkpoint"))
 	}
-	if !VerifyTimeVerifiers(block, block.TimeVerifiers, block.TimeVerifierSignatures, false) || !VerifyTimeVerifiers(block, block.PreMiningTimeVerifiers, block.PreMiningTimeVerifierSignatures, true) {
+	if SkipFullVerification(blockHeight) {
+		// The checkpoint the block leads to vouches for its signatures and proofs
+		return problems
+	}
+	if !ValidateTimeVerifiers(chain, block, block.TimeVerifiers, block.TimeVerifierSignatures, false) || !ValidateTimeVerifiers(chain, block, block.PreMiningTimeVerifiers, block.PreMiningTimeVerifierSignatures, true) {
 		Log("Block has invalid time verifiers. Ignoring block request.", true)
-		isValid = false
+		problems = append(problems, NewValidationError(ReasonBadTimeVerifiers, "invalid time verifiers"))
 	}
-	if !VerifySmartContractTransactions(block) {
+	if err := CheckSmartContractTransactions(chain, state, block); err != nil {
 		Log("Block has invalid smart contract transactions. Ignoring block request.", true)
-		isValid = false
+		problems = append(problems, err)
 	}
-	return isValid
+	return problems
 }
 
 func VerifyTimeVerifiers(block Block, verifiers []PublicKey, signatures []Signature, premining bool) bool {
+	return ValidateTimeVerifiers(NodeChain, block, verifiers, signatures, premining)
+}
+
+// ValidateTimeVerifiers checks the time verifiers of the block after a chain: their signatures, that they are miners
+// on the chain, and that enough of them also verified the chain's last block.
+func ValidateTimeVerifiers(chain ChainView, block Block, verifiers []PublicKey, signatures []Signature, premining bool) bool {
 	if len(verifiers) != len(signatures) {
 		Log("Signature count does not match verifier count.", true)
 		return false
@@ -309,19 +413,20 @@ func VerifyTimeVerifiers(block Block, verifiers []PublicKey, signatures []Signat
 		verifierMap[string(verifier.Y)] = true
 	}
 	// Ensure verifiers are miners
+	lastBlock := chain.Block(chain.Height() - 1)
 	fromLastBlock := 0
 	for _, verifier := range verifiers {
-		if IsNewMiner(verifier, len(Blockchain)+1) {
+		if chain.IsNewMiner(verifier.Y, chain.Height()+1) {
 			Log("Time verifier is not a miner.", true)
 			return false
 		}
-		for _, exitingVerifier := range Blockchain[len(Blockchain)-1].TimeVerifiers {
+		for _, exitingVerifier := range lastBlock.TimeVerifiers {
 			if bytes.Equal(verifier.Y, exitingVerifier.Y) {
 				fromLastBlock++
 				continue
 			}
 		}
-		for _, exitingVerifier := range Blockchain[len(Blockchain)-1].PreMiningTimeVerifiers {
+		for _, exitingVerifier := range lastBlock.PreMiningTimeVerifiers {
 			if bytes.Equal(verifier.Y, exitingVerifier.Y) {
 				fromLastBlock++
 				continue
@@ -329,7 +434,7 @@ func VerifyTimeVerifiers(block Block, verifiers []PublicKey, signatures []Signat
 		}
 	}
 	// Ensure there are enough verifiers
-	if len(verifiers) < GetMinVerifiers() {
+	if len(verifiers) < MinVerifiers(chain) {
 		Log("Not enough time verifiers.", true)
 		return false
 	}
@@ -342,8 +447,13 @@ func VerifyTimeVerifiers(block Block, verifiers []PublicKey, signatures []Signat
 }
 
 func GetMinVerifiers() int {
+	return MinVerifiers(NodeChain)
+}
+
+// MinVerifiers returns the minimum number of time verifiers for the block after a chain.
+func MinVerifiers(chain ChainView) int {
 	// Get the last block
-	lastBlock := Blockchain[len(Blockchain)-1]
+	lastBlock := chain.Block(chain.Height() - 1)
 	// Get the number of verifiers in the last block
 	lastVerifierCount := len(lastBlock.TimeVerifiers)
 	// Get the minimum number of verifiers
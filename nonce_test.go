@@ -0,0 +1,132 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func nonceTestTransaction(sender string, amount float64, nonce uint64) Transaction {
+	return Transaction{
+		Sender:    PublicKey{Y: []byte(sender)},
+		Recipient: PublicKey{Y: []byte("recipient")},
+		Amount:    amount,
+		Timestamp: time.Unix(int64(nonce), 0),
+		Nonce:     nonce,
+	}
+}
+
+func TestNonces(t *testing.T) {
+	t.Run("It only serializes the nonce when it is set", func(t *testing.T) {
+		// Arrange
+		withNonce := nonceTestTransaction("a", 1, 7)
+		withoutNonce := nonceTestTransaction("a", 1, 0)
+		// Act
+		withNonceJson, err := json.Marshal(withNonce)
+		assert.Nil(t, err)
+		withoutNonceJson, err := json.Marshal(withoutNonce)
+		assert.Nil(t, err)
+		var decoded Transaction
+		assert.Nil(t, json.Unmarshal(withNonceJson, &decoded))
+		// Assert
+		assert.Equal(t, uint64(7), decoded.Nonce)
+		assert.Equal(t, 9, strings.Count(string(withNonceJson), "^"))
+		assert.Equal(t, 8, strings.Count(string(withoutNonceJson), "^"))
+	})
+	t.Run("It includes the nonce in the transaction hash", func(t *testing.T) {
+		// Arrange
+		first := nonceTestTransaction("a", 1, 1)
+		replayed := first
+		replayed.Nonce = 2
+		// Act
+		firstHash := TransactionHash(first)
+		replayedHash := TransactionHash(replayed)
+		// Assert
+		assert.NotEqual(t, firstHash, replayedHash)
+	})
+	t.Run("It requires consecutive nonces in a block", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Blockchain = nil
+		Append(GenesisBlock())
+		contractTransaction := Transaction{Sender: PublicKey{Y: []byte("a")}, FromSmartContract: true}
+		// Act
+		consecutive := VerifyNonces([]Transaction{nonceTestTransaction("a", 1, 1), contractTransaction, nonceTestTransaction("a", 1, 2)}, 1)
+		repeated := VerifyNonces([]Transaction{nonceTestTransaction("a", 1, 1), nonceTestTransaction("a", 1, 1)}, 1)
+		missing := VerifyNonces([]Transaction{nonceTestTransaction("a", 1, 0)}, 1)
+		// Assert
+		assert.True(t, consecutive)
+		assert.False(t, repeated)
+		assert.False(t, missing)
+	})
+	t.Run("It rejects nonces before the upgrade", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Env.Upgrades[Kyoto] = 5
+		defer LoadEnv()
+		// Act
+		before := VerifyNonces([]Transaction{nonceTestTransaction("a", 1, 1)}, 4)
+		legacy := VerifyNonces([]Transaction{nonceTestTransaction("a", 1, 0)}, 4)
+		// Assert
+		assert.False(t, before)
+		assert.True(t, legacy)
+	})
+	t.Run("It ignores replayed transactions in balances", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Blockchain = nil
+		Append(GenesisBlock())
+		payment := nonceTestTransaction("a", 1, 1)
+		// Act
+		Append(Block{Nonce: 1, LegacyTransactions: []Transaction{payment}})
+		Append(Block{Nonce: 2, LegacyTransactions: []Transaction{payment}})
+		// Assert
+		assert.Equal(t, uint64(1), AccountNonce([]byte("a")))
+		assert.Equal(t, 1.0, GetBalance([]byte("recipient")))
+	})
+	t.Run("It mines a sender's transactions in nonce order without gaps", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Blockchain = nil
+		Append(GenesisBlock())
+		pool := NewMempool()
+		assert.Nil(t, pool.Add(NewMempoolEntry(nonceTestTransaction("a", 2, 2), nil, StateTransition{})))
+		assert.Nil(t, pool.Add(NewMempoolEntry(nonceTestTransaction("a", 1, 1), nil, StateTransition{})))
+		assert.Nil(t, pool.Add(NewMempoolEntry(nonceTestTransaction("b", 4, 4), nil, StateTransition{})))
+		// Act
+		selected := pool.Select(10, time.Now())
+		taken := pool.Add(NewMempoolEntry(nonceTestTransaction("a", 3, 2), nil, StateTransition{}))
+		// Assert
+		assert.Equal(t, []float64{1, 2}, selectedAmounts(selected))
+		assert.Equal(t, ErrReplacementUnderpriced, taken)
+	})
+	t.Run("It counts pending transactions in the next nonce", func(t *testing.T) {
+		// Arrange
+		loadLatestEnv()
+		Blockchain = nil
+		Append(GenesisBlock())
+		Append(Block{Nonce: 1, LegacyTransactions: []Transaction{nonceTestTransaction("a", 0, 1)}})
+		Pool = NewMempool()
+		defer func() {
+			Pool = NewMempool()
+		}()
+		assert.Nil(t, Pool.Add(NewMempoolEntry(nonceTestTransaction("a", 0, 2), nil, StateTransition{})))
+		assert.Nil(t, Pool.Add(NewMempoolEntry(nonceTestTransaction("a", 0, 4), nil, StateTransition{})))
+		// Act
+		next := NextNonce([]byte("a"))
+		// Assert
+		assert.Equal(t, uint64(3), next)
+	})
+}
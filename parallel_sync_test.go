@@ -0,0 +1,115 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// bodiesTestPeer starts a peer that serves block bodies from the blockchain, counting its requests.
+func bodiesTestPeer(requests *int32) *httptest.Server {
+	return httptest.NewServer(NetworkHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(requests, 1)
+		HandleBodiesRequest(w, req)
+	})))
+}
+
+// tamperingTestPeer starts a peer that serves block bodies that don't match their headers.
+func tamperingTestPeer() *httptest.Server {
+	return httptest.NewServer(NetworkHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		recorder := httptest.NewRecorder()
+		HandleBodiesRequest(recorder, req)
+		var response BodiesResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for i := range response.Blocks {
+			response.Blocks[i].Nonce++
+		}
+		responseBytes, _ := json.Marshal(response)
+		_, _ = w.Write(responseBytes)
+	})))
+}
+
+// bodiesTestHeaders returns the header records of downloaded blocks starting at height 1.
+func bodiesTestHeaders(blocks []Block) []HeaderRecord {
+	var headers []HeaderRecord
+	for i, block := range blocks {
+		headers = append(headers, HeaderRecord{Header: BlockHeader(block), Hash: HashBlock(block, i+1), Transactions: len(ExtractTransactions(block))})
+	}
+	return headers
+}
+
+func TestParallelSync(t *testing.T) {
+	testChain(t, 2*MaxBodiesPerRequest+10)
+	headers := Headers(1, len(Blockchain))
+	t.Run("It splits the download across peers", func(t *testing.T) {
+		// Arrange
+		PeerScores = NewPeerScoreboard()
+		var firstRequests, secondRequests int32
+		first := bodiesTestPeer(&firstRequests)
+		defer first.Close()
+		second := bodiesTestPeer(&secondRequests)
+		defer second.Close()
+		// Act
+		blocks, err := DownloadBodies([]string{first.URL, second.URL}, 1, headers)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, headers, bodiesTestHeaders(blocks))
+		assert.Equal(t, int32(3), firstRequests+secondRequests)
+		assert.Greater(t, firstRequests, int32(0))
+		assert.Greater(t, secondRequests, int32(0))
+	})
+	t.Run("It retries ranges elsewhere and penalizes peers that serve invalid blocks", func(t *testing.T) {
+		// Arrange
+		PeerScores = NewPeerScoreboard()
+		var requests int32
+		honest := bodiesTestPeer(&requests)
+		defer honest.Close()
+		tampering := tamperingTestPeer()
+		defer tampering.Close()
+		// Act
+		blocks, err := DownloadBodies([]string{tampering.URL, honest.URL}, 1, headers)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, headers, bodiesTestHeaders(blocks))
+		assert.Equal(t, InvalidDataPenalty, PeerScores.Penalty(tampering.URL))
+		assert.Equal(t, 0, PeerScores.Penalty(honest.URL))
+	})
+	t.Run("It fails once no peer can serve a range", func(t *testing.T) {
+		// Arrange
+		PeerScores = NewPeerScoreboard()
+		tampering := tamperingTestPeer()
+		defer tampering.Close()
+		// Act
+		_, err := DownloadBodies([]string{tampering.URL}, 1, headers)
+		// Assert
+		assert.True(t, errors.Is(err, ErrNoSyncPeers))
+	})
+	t.Run("It bans peers once their penalties add up", func(t *testing.T) {
+		// Arrange
+		scores := NewPeerScoreboard()
+		// Act
+		for penalty := 0; penalty < PeerBanScore; penalty += InvalidDataPenalty {
+			scores.Penalize("http://peer", InvalidDataPenalty)
+		}
+		// Assert
+		assert.True(t, scores.Banned("http://peer"))
+		assert.False(t, scores.Banned("http://other"))
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"os"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneBlockchain(t *testing.T) {
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	buildChain := func() []Block {
+		r := rand.New(rand.NewSource(3))
+		chain := []Block{GenesisBlock()}
+		for height := 1; height < 130; height++ {
+			chain = append(chain, randomLedgerBlock(r, keys))
+		}
+		return chain
+	}
+	expectedBalances := func(chain []Block) map[string]float64 {
+		Blockchain = chain
+		balances := make(map[string]float64)
+		for _, key := range keys {
+			balances[string(key)] = scanBalance(key)
+		}
+		return balances
+	}
+	t.Run("It keeps full blocks only for recent history", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Env.Upgrades[Kyoto] = -1 // The random transactions don't have nonces
+		Env.Upgrades[Oslo] = -1  // The reference balances predate the fee market
+		expected := expectedBalances(buildChain())
+		Blockchain = nil
+		PruneMode = true
+		defer func() {
+			PruneMode = false
+			PrunedHeight = 0
+		}()
+		// Act
+		for _, block := range buildChain() {
+			Append(block)
+		}
+		// Assert
+		assert.Equal(t, 100, PrunedHeight)
+		for height := 1; height < PrunedHeight; height++ {
+			assert.Empty(t, ExtractTransactions(Blockchain[height]))
+		}
+		for _, key := range keys {
+			assert.Equal(t, expected[string(key)], GetBalance(key))
+		}
+	})
+	t.Run("It restores balances from the prune snapshot after a restart", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Env.Upgrades[Kyoto] = -1 // The random transactions don't have nonces
+		Env.Upgrades[Oslo] = -1  // The reference balances predate the fee market
+		// Blocks are read back from the store as they are applied, so they have been through JSON.
+		chainJson, err := json.Marshal(buildChain())
+		assert.Nil(t, err)
+		var storedBlocks []Block
+		assert.Nil(t, json.Unmarshal(chainJson, &storedBlocks))
+		expected := expectedBalances(storedBlocks)
+		wd, err := os.Getwd()
+		assert.Nil(t, err)
+		assert.Nil(t, os.Chdir(t.TempDir()))
+		Blockchain = nil
+		PruneMode = true
+		defer func() {
+			_ = Store.Close()
+			_ = HeaderStore.Close()
+			Store = nil
+			HeaderStore = nil
+			PruneMode = false
+			PrunedHeight = 0
+			_ = os.Chdir(wd)
+		}()
+		LoadBlockchain()
+		for _, block := range buildChain() {
+			Append(block)
+		}
+		// Act
+		assert.Nil(t, Store.Close())
+		assert.Nil(t, HeaderStore.Close())
+		Store = nil
+		HeaderStore = nil
+		PrunedHeight = 0
+		Blockchain = nil
+		ChainState, AccountLedger, TxIndex = NewStateCache(), NewLedger(), NewTransactionIndex()
+		LoadBlockchain()
+		// Assert
+		assert.Equal(t, 130, len(Blockchain))
+		assert.Equal(t, 100, PrunedHeight)
+		historyLengths := make(map[string]int)
+		for _, block := range storedBlocks[1:] {
+			for _, transaction := range ExtractTransactions(block) {
+				_, _, ok := GetTransaction(TransactionHash(transaction))
+				assert.True(t, ok)
+				historyLengths[string(transaction.Sender.Y)]++
+				if string(transaction.Sender.Y) != string(transaction.Recipient.Y) {
+					historyLengths[string(transaction.Recipient.Y)]++
+				}
+			}
+		}
+		for _, key := range keys {
+			assert.Equal(t, expected[string(key)], GetBalance(key))
+			assert.Equal(t, historyLengths[string(key)], len(GetHistory(key)))
+		}
+	})
+}
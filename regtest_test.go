@@ -0,0 +1,123 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	. "cryptocurrency/node_interface"
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// regtestChain switches to regtest mode with a new key and a blockchain holding only the genesis block, in a
+// temporary directory.
+func regtestChain(t *testing.T) {
+	LoadEnv()
+	EnableRegtest()
+	wd, err := os.Getwd()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Chdir(t.TempDir()))
+	t.Cleanup(func() {
+		_ = os.Chdir(wd)
+	})
+	KeygenCmd(nil)
+	Blockchain = nil
+	Pool = NewMempool()
+	Append(GenesisBlock())
+}
+
+// regtestTransfer returns a transaction sending the given amount from the node's key to a new key.
+func regtestTransfer(t *testing.T, amount float64) Transaction {
+	recipient := testSignedTransaction(t)
+	key := GetKey("")
+	transaction := Transaction{Sender: key.PublicKey, Recipient: recipient.Sender, Amount: amount, Timestamp: recipient.Timestamp, Nonce: NextNonce(key.PublicKey.Y)}
+	hash := TransactionSigningHash(transaction)
+	signature, err := key.X.Sign(hash[:])
+	assert.Nil(t, err)
+	transaction.SenderSignature = Signature{S: signature}
+	return transaction
+}
+
+func TestRegtest(t *testing.T) {
+	defer func() {
+		Regtest = false
+		LoadEnv()
+	}()
+	t.Run("It only generates blocks in regtest mode", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Regtest = false
+		// Act
+		blocks, err := Generate(1)
+		// Assert
+		assert.Equal(t, ErrNotRegtest, err)
+		assert.Empty(t, blocks)
+	})
+	t.Run("It generates blocks without time verifiers or a prover", func(t *testing.T) {
+		// Arrange
+		regtestChain(t)
+		// Act
+		blocks, err := Generate(3)
+		// Assert
+		assert.Nil(t, err)
+		assert.Len(t, blocks, 3)
+		assert.Equal(t, 4, len(Blockchain))
+		assert.Equal(t, uint64(1), Blockchain[3].Difficulty)
+		assert.Equal(t, RegtestProof, Blockchain[3].ZenProof)
+		assert.Empty(t, Blockchain[3].TimeVerifiers)
+		assert.Greater(t, GetBalance(GetKey("").PublicKey.Y), 0.0)
+	})
+	t.Run("It mines pending transactions", func(t *testing.T) {
+		// Arrange
+		regtestChain(t)
+		_, err := Generate(1)
+		assert.Nil(t, err)
+		transaction := regtestTransfer(t, 0.5)
+		assert.Nil(t, Pool.Accept(transaction))
+		// Act
+		_, err = Generate(1)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, 0, Pool.Len())
+		assert.Equal(t, 0.5, GetBalance(transaction.Recipient.Y))
+	})
+	t.Run("It keeps a block's transactions in the pool until the block is added", func(t *testing.T) {
+		// Arrange
+		regtestChain(t)
+		_, err := Generate(1)
+		assert.Nil(t, err)
+		assert.Nil(t, Pool.Accept(regtestTransfer(t, 0.5)))
+		// Act
+		block, err := CreateBlock()
+		pending := Pool.Len()
+		assert.Nil(t, Append(block))
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, 1, pending)
+		assert.Equal(t, 0, Pool.Len())
+	})
+	t.Run("It serves the hashes of generated blocks", func(t *testing.T) {
+		// Arrange
+		regtestChain(t)
+		recorder := httptest.NewRecorder()
+		// Act
+		HandleGenerateRequest(recorder, httptest.NewRequest(http.MethodGet, "/generate?blocks=2", nil))
+		// Assert
+		var hashes []string
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &hashes))
+		assert.Len(t, hashes, 2)
+		assert.Equal(t, 3, len(Blockchain))
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceByFee(t *testing.T) {
+	t.Run("It replaces a pending transaction with the same nonce and a higher fee", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		original := NewMempoolEntry(nonceTestTransaction("a", 1, 1), nil, StateTransition{})
+		assert.Nil(t, pool.Add(original))
+		replacementTransaction := nonceTestTransaction("a", 2, 1)
+		replacementTransaction.Tip = original.TotalFee()
+		replacement := NewMempoolEntry(replacementTransaction, nil, StateTransition{})
+		// Act
+		err := pool.Add(replacement)
+		// Assert
+		assert.Nil(t, err)
+		assert.False(t, pool.Contains(original.Hash))
+		assert.True(t, pool.Contains(replacement.Hash))
+		assert.Equal(t, 1, pool.Len())
+	})
+	t.Run("It rejects a replacement that doesn't raise the fee enough", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		original := NewMempoolEntry(nonceTestTransaction("a", 1, 1), nil, StateTransition{})
+		assert.Nil(t, pool.Add(original))
+		replacementTransaction := nonceTestTransaction("a", 2, 1)
+		replacementTransaction.Tip = original.TotalFee() * (ReplacementFeeBump - 1) / 2
+		// Act
+		err := pool.Add(NewMempoolEntry(replacementTransaction, nil, StateTransition{}))
+		// Assert
+		assert.Equal(t, ErrReplacementUnderpriced, err)
+		assert.True(t, pool.Contains(original.Hash))
+	})
+	t.Run("It replaces a transaction named by its hash", func(t *testing.T) {
+		// Arrange
+		pool := NewMempool()
+		original := NewMempoolEntry(nonceTestTransaction("a", 1, 0), nil, StateTransition{})
+		assert.Nil(t, pool.Add(original))
+		cancellation := nonceTestTransaction("a", 0, 0)
+		cancellation.Recipient = cancellation.Sender
+		cancellation.Replaces = original.Hash
+		cancellation.Tip = ReplacementTip(cancellation, original.TotalFee())
+		// Act
+		err := pool.Add(NewMempoolEntry(cancellation, nil, StateTransition{}))
+		// Assert
+		assert.Nil(t, err)
+		assert.False(t, pool.Contains(original.Hash))
+		assert.Equal(t, 1, pool.Len())
+	})
+	t.Run("It doesn't let another sender replace a transaction", func(t *testing.T) {
+		// Arrange
+		original := nonceTestTransaction("a", 1, 1)
+		other := nonceTestTransaction("b", 1, 1)
+		other.Replaces = TransactionHash(original)
+		// Act
+		replaces := ReplacesTransaction(other, original)
+		// Assert
+		assert.False(t, replaces)
+	})
+	t.Run("It serializes and hashes the tip and replaced hash", func(t *testing.T) {
+		// Arrange
+		transaction := nonceTestTransaction("a", 1, 1)
+		transaction.Tip = 0.5
+		transaction.Replaces = [32]byte{1, 2, 3}
+		untipped := nonceTestTransaction("a", 1, 1)
+		// Act
+		transactionJson, err := json.Marshal(transaction)
+		assert.Nil(t, err)
+		var decoded Transaction
+		err = json.Unmarshal(transactionJson, &decoded)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, transaction.Tip, decoded.Tip)
+		assert.Equal(t, transaction.Replaces, decoded.Replaces)
+		assert.NotEqual(t, TransactionHash(untipped), TransactionHash(transaction))
+		assert.NotEqual(t, TransactionSigningHash(untipped), TransactionSigningHash(transaction))
+	})
+	t.Run("It rejects tips before the upgrade", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Env.Upgrades[Kyoto] = 5
+		defer LoadEnv()
+		tipped := nonceTestTransaction("a", 1, 0)
+		tipped.Tip = 0.1
+		negative := nonceTestTransaction("a", 1, 1)
+		negative.Tip = -1
+		// Act
+		before := VerifyTips([]Transaction{tipped}, 4)
+		after := VerifyTips([]Transaction{tipped}, 5)
+		invalid := VerifyTips([]Transaction{negative}, 5)
+		// Assert
+		assert.False(t, before)
+		assert.True(t, after)
+		assert.False(t, invalid)
+	})
+	t.Run("It pays tips to the miner", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Blockchain = nil
+		Append(GenesisBlock())
+		payment := nonceTestTransaction("a", 1, 1)
+		payment.Tip = 0.5
+		// Act
+		Append(Block{Nonce: 1, Miner: PublicKey{Y: []byte("miner")}, LegacyTransactions: []Transaction{payment}})
+		// Assert
+		account, _ := AccountLedger.Account([]byte("a"))
+		miner, _ := AccountLedger.Account([]byte("miner"))
+		assert.Equal(t, -1.5, account.Total)
+		assert.InDelta(t, 0.5, miner.MiningTotal-CalculateBlockReward(1, 1), 1e-9)
+	})
+}
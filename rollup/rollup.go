@@ -2,7 +2,6 @@ package rollup
 
 import (
 	"bytes"
-	"crypto/sha256"
 	. "cryptocurrency/node_util"
 	"encoding/json"
 	"fmt"
@@ -44,7 +43,7 @@ func HandleTransactionRequest(_ http.ResponseWriter, req *http.Request) {
 			if err != nil {
 				panic(err)
 			}
-			res, err := http.DefaultClient.Do(req)
+			res, err := PeerClient.Do(req)
 			if err != nil {
 				Log("Peer is down.", true)
 				continue
@@ -72,9 +71,16 @@ func HandleTransactionRequest(_ http.ResponseWriter, req *http.Request) {
 		rollup += "0.0"
 		rollup += "$"
 		timestamp := time.Now().UnixNano()
-		transactionStr := fmt.Sprintf("%s:%s:%s:%d", key.PublicKey.Y, key.PublicKey.Y, "0", timestamp)
-		hash := sha256.Sum256([]byte(transactionStr))
-		fmt.Println(transactionStr)
+		nonce := uint64(0)
+		if NoncesActive(len(Blockchain)) {
+			nonce = FetchNextNonce(key.PublicKey.Y)
+		}
+		hash := TransactionSigningHash(Transaction{
+			Sender:    key.PublicKey,
+			Recipient: key.PublicKey,
+			Timestamp: time.Unix(0, timestamp),
+			Nonce:     nonce,
+		})
 		sigBytes, err := key.X.Sign(hash[:])
 		if err != nil {
 			panic(err)
@@ -106,6 +112,10 @@ func HandleTransactionRequest(_ http.ResponseWriter, req *http.Request) {
 			panic(err)
 		}
 		rollup += string(signaturesStr)
+		if nonce != 0 {
+			rollup += "$"
+			rollup += strconv.FormatUint(nonce, 10)
+		}
 		// Send rollup to all peers
 		fmt.Println("Sending rollup to peers...")
 		for _, peer := range GetPeers() {
@@ -113,7 +123,7 @@ func HandleTransactionRequest(_ http.ResponseWriter, req *http.Request) {
 			if err != nil {
 				panic(err)
 			}
-			_, err = http.DefaultClient.Do(req)
+			_, err = PeerClient.Do(req)
 			if err != nil {
 				Log("Peer is down.", true)
 			}
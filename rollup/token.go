@@ -54,8 +54,8 @@ func BodyContainsL2Transactions(body string) bool {
 
 func GetL2TokenBalances() map[string]uint64 {
 	balances := make(map[string]uint64)
-	for _, block := range Blockchain {
-		for _, transaction := range ExtractTransactions(block) {
+	for height := range Blockchain {
+		for _, transaction := range ExtractTransactions(BlockAt(height)) {
 			body := transaction.Body
 			if !BodyContainsL2Transactions(string(body)) {
 				continue
@@ -68,7 +68,7 @@ func TestGetL2TokenBalances(t *testing.T) {
 		panic(err)
 	}
 	block := Block{
-		Transactions: []Transaction{
+		LegacyTransactions: []Transaction{
 			{
 				Body: body,
 				BodySignatures: []Signature{
@@ -0,0 +1,106 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	. "cryptocurrency/analysis"
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulate(t *testing.T) {
+	LoadEnv()
+	config := SimulationConfig{Hashrates: []float64{50000, 200000}, Duration: 2 * time.Hour, Transactions: 1, Seed: 1}
+	t.Run("It replays the difficulty adjustment and block reward", func(t *testing.T) {
+		// Arrange
+		emission := 0.0
+		// Act
+		result, err := Simulate(config)
+		// Assert
+		assert.Nil(t, err)
+		assert.NotEmpty(t, result.Blocks)
+		for i, block := range result.Blocks {
+			assert.Equal(t, i+1, block.Height)
+			assert.LessOrEqual(t, block.Time, config.Duration.Seconds())
+			assert.GreaterOrEqual(t, block.Difficulty, MinimumBlockDifficulty)
+			emission += block.Reward
+			assert.InDelta(t, emission, block.Emission, 1e-9)
+		}
+		assert.InDelta(t, emission, result.TotalEmission, 1e-9)
+		assert.Len(t, result.Miners, 2)
+		assert.Equal(t, len(result.Blocks), result.Miners[0].Blocks+result.Miners[1].Blocks)
+		assert.Greater(t, result.Miners[1].Blocks, result.Miners[0].Blocks)
+	})
+	t.Run("It gives the same result for the same seed", func(t *testing.T) {
+		// Arrange
+		first, err := Simulate(config)
+		assert.Nil(t, err)
+		// Act
+		second, err := Simulate(config)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, first, second)
+	})
+	t.Run("It simulates other upgrade heights without changing the environment", func(t *testing.T) {
+		// Arrange
+		upgrades := NetworkUpgrades{}
+		for name, height := range Env.Upgrades {
+			upgrades[name] = height
+		}
+		upgrades[Guadalajara] = 1000000
+		simulation := config
+		simulation.Upgrades = upgrades
+		// Act
+		result, err := Simulate(simulation)
+		// Assert
+		assert.Nil(t, err)
+		assert.Equal(t, 0, Env.Upgrades[Guadalajara])
+		assert.NotEqual(t, CalculateBlockReward(1, 1), result.Blocks[0].Reward)
+	})
+	t.Run("It refuses simulations without miners or transactions", func(t *testing.T) {
+		// Arrange
+		noMiners, noTransactions := config, config
+		noMiners.Hashrates = nil
+		noTransactions.Transactions = 0
+		// Act
+		_, noMinersErr := Simulate(noMiners)
+		_, noTransactionsErr := Simulate(noTransactions)
+		// Assert
+		assert.NotNil(t, noMinersErr)
+		assert.NotNil(t, noTransactionsErr)
+	})
+	t.Run("It writes blocks and miners as CSV or JSON", func(t *testing.T) {
+		// Arrange
+		result, err := Simulate(config)
+		assert.Nil(t, err)
+		var blocksCSV, minersCSV, resultJSON bytes.Buffer
+		// Act
+		assert.Nil(t, WriteSimulationCSV(&blocksCSV, result, false))
+		assert.Nil(t, WriteSimulationCSV(&minersCSV, result, true))
+		assert.Nil(t, WriteSimulationJSON(&resultJSON, result))
+		// Assert
+		blockRows, err := csv.NewReader(strings.NewReader(blocksCSV.String())).ReadAll()
+		assert.Nil(t, err)
+		assert.Len(t, blockRows, len(result.Blocks)+1)
+		assert.Equal(t, "emission", blockRows[0][6])
+		minerRows, err := csv.NewReader(strings.NewReader(minersCSV.String())).ReadAll()
+		assert.Nil(t, err)
+		assert.Len(t, minerRows, 3)
+		var decoded SimulationResult
+		assert.Nil(t, json.Unmarshal(resultJSON.Bytes(), &decoded))
+		assert.Equal(t, result.TotalEmission, decoded.TotalEmission)
+	})
+}
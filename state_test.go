@@ -3,6 +3,7 @@ package main
 import (
 	"cryptocurrency/node_util"
 	"github.com/stretchr/testify/assert"
+	"strconv"
 	"testing"
 )
 
@@ -49,3 +50,68 @@ func TestTransitionState(t *testing.T) {
 		assert.Equal(t, state, newState)
 	})
 }
+
+func TestChainState(t *testing.T) {
+	transitionBlock := func(key string, value string) node_util.Block {
+		return node_util.Block{
+			Nonce: int64(len(node_util.Blockchain)),
+			Transition: node_util.StateTransition{
+				LegacyUpdatedData: map[string][]byte{
+					key: []byte(value),
+				},
+			},
+		}
+	}
+	t.Run("It maintains the current state as blocks are appended", func(t *testing.T) {
+		// Arrange
+		node_util.Blockchain = nil
+		node_util.Append(node_util.GenesisBlock())
+		// Act
+		node_util.Append(transitionBlock("a", "1"))
+		node_util.Append(transitionBlock("a", "2"))
+		// Assert
+		state := node_util.CalculateCurrentState()
+		assert.Equal(t, []byte("2"), state.LegacyData["a"])
+		assert.Equal(t, []byte("1"), node_util.CalculateStateAt(2).LegacyData["a"])
+	})
+	t.Run("It rolls back the state when the blockchain is truncated", func(t *testing.T) {
+		// Arrange
+		node_util.Blockchain = nil
+		node_util.Append(node_util.GenesisBlock())
+		for i := 0; i < node_util.StateSnapshotInterval+5; i++ {
+			node_util.Append(transitionBlock("b", strconv.Itoa(i)))
+		}
+		// Act
+		node_util.TruncateBlockchain(node_util.StateSnapshotInterval - 5)
+		node_util.Append(transitionBlock("c", "1"))
+		// Assert
+		state := node_util.CalculateCurrentState()
+		assert.Equal(t, []byte(strconv.Itoa(node_util.StateSnapshotInterval-7)), state.LegacyData["b"])
+		assert.Equal(t, []byte("1"), state.LegacyData["c"])
+	})
+	t.Run("It notices when the blockchain is replaced directly", func(t *testing.T) {
+		// Arrange
+		node_util.Blockchain = nil
+		node_util.Append(node_util.GenesisBlock())
+		node_util.Append(transitionBlock("d", "1"))
+		node_util.CalculateCurrentState()
+		// Act
+		node_util.Blockchain = nil
+		node_util.Append(node_util.GenesisBlock())
+		// Assert
+		_, ok := node_util.CalculateCurrentState().LegacyData["d"]
+		assert.False(t, ok)
+	})
+	t.Run("It doesn't change a state it handed out when more blocks are appended", func(t *testing.T) {
+		// Arrange
+		node_util.Blockchain = nil
+		node_util.Append(node_util.GenesisBlock())
+		node_util.Append(transitionBlock("e", "1"))
+		state := node_util.CalculateCurrentState()
+		// Act
+		node_util.Append(transitionBlock("e", "2"))
+		// Assert
+		assert.Equal(t, []byte("1"), state.LegacyData["e"])
+		assert.Equal(t, []byte("2"), node_util.CalculateCurrentState().LegacyData["e"])
+	})
+}
@@ -0,0 +1,127 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/open-quantum-safe/liboqs-go/oqs"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadLatestEnv loads the environment with the upgrades that aren't scheduled on the testnet yet active from the
+// genesis block, so that their rules can be tested.
+func loadLatestEnv() {
+	LoadEnv()
+	for _, upgrade := range []UpgradeName{Kyoto, Lagos, Oslo} {
+		Env.Upgrades[upgrade] = 0
+	}
+}
+
+// testChain resets the blockchain to the genesis block followed by `length` valid mined blocks, each with one signed
+// transaction. Zen is scheduled far ahead, since verifying Zen blocks needs the ZK prover. The environment and block
+// difficulties are restored when the test finishes.
+func testChain(t *testing.T, length int) {
+	minimumDifficulty := MinimumBlockDifficulty
+	initialDifficulty := InitialBlockDifficulty
+	t.Cleanup(func() {
+		MinimumBlockDifficulty = minimumDifficulty
+		InitialBlockDifficulty = initialDifficulty
+		LoadEnv()
+	})
+	loadLatestEnv()
+	Env.Upgrades[Zen] = 1000
+	MinimumBlockDifficulty = 1
+	InitialBlockDifficulty = 1
+	Blockchain = nil
+	Pool = NewMempool()
+	Append(GenesisBlock())
+	for height := 1; height <= length; height++ {
+		block := Block{
+			Miner:              PublicKey{Y: []byte("miner")},
+			Timestamp:          time.Unix(int64(height), 0).UTC(),
+			MiningTime:         time.Minute,
+			PreviousBlockHash:  BlockHashAt(height - 1),
+			Transition:         StateTransition{LegacyUpdatedData: map[string][]byte{}},
+			LegacyTransactions: []Transaction{testSignedTransaction(t)},
+		}
+		block.Difficulty = ExpectedDifficulty(Blockchain, block, 1, height)
+		for !VerifyProofOfWork(block, height) {
+			block.Nonce++
+		}
+		Append(block)
+	}
+}
+
+// testForgedBranch replaces the blocks of the blockchain from the given height with copies whose first transaction has
+// an invalid signature, mined again so that only their signatures are invalid, and returns the copies.
+func testForgedBranch(from int) []Block {
+	blocks := BlocksAt(from, len(Blockchain))
+	for i := range blocks {
+		height := from + i
+		if i == 0 {
+			signature := &blocks[i].LegacyTransactions[0].SenderSignature
+			signature.S = append([]byte{}, signature.S...)
+			signature.S[0] ^= 1
+		} else {
+			blocks[i].PreviousBlockHash = HashBlock(blocks[i-1], height-1)
+		}
+		for !VerifyProofOfWork(blocks[i], height) {
+			blocks[i].Nonce++
+		}
+	}
+	TruncateBlockchain(from)
+	for _, block := range blocks {
+		Append(block)
+	}
+	return blocks
+}
+
+// testWorkChain resets the blockchain to the genesis block followed by unmined blocks with the given difficulties.
+func testWorkChain(difficulties ...uint64) {
+	loadLatestEnv()
+	Blockchain = nil
+	Pool = NewMempool()
+	Forks = NewForkTracker()
+	Append(GenesisBlock())
+	for i, difficulty := range difficulties {
+		Append(Block{Nonce: int64(i + 1), Difficulty: difficulty, MiningTime: time.Minute, PreviousBlockHash: BlockHashAt(len(Blockchain) - 1)})
+	}
+}
+
+// testSignedTransaction returns a signed zero-value self-send from a new key.
+func testSignedTransaction(t *testing.T) Transaction {
+	return testSignedTransfers(t, 0)[0]
+}
+
+// testSignedTransfers returns signed self-sends of the given amounts from one new key, with consecutive nonces.
+func testSignedTransfers(t *testing.T, amounts ...float64) []Transaction {
+	signer := oqs.Signature{}
+	assert.Nil(t, signer.Init("Dilithium3", nil))
+	publicKey, err := signer.GenerateKeyPair()
+	assert.Nil(t, err)
+	var transactions []Transaction
+	for i, amount := range amounts {
+		transaction := Transaction{
+			Sender:    PublicKey{Y: publicKey},
+			Recipient: PublicKey{Y: publicKey},
+			Amount:    amount,
+			Timestamp: time.Unix(0, time.Now().UnixNano()),
+			Nonce:     uint64(i + 1),
+		}
+		hash := TransactionSigningHash(transaction)
+		signature, err := signer.Sign(hash[:])
+		assert.Nil(t, err)
+		transaction.SenderSignature = Signature{S: signature}
+		transactions = append(transactions, transaction)
+	}
+	return transactions
+}
@@ -13,14 +13,14 @@ func StartTest() {
 	SendTxs(int64(tpsIn), int64(secs))
 	start := time.Now()
 	initialtxs := 0
-	for _, block := range Blockchain {
-		initialtxs += len(ExtractTransactions(block))
+	for height := range Blockchain {
+		initialtxs += len(ExtractTransactions(BlockAt(height)))
 	}
 	for {
 		SyncBlockchain(-1)
 		txs := 0
-		for _, block := range Blockchain {
-			txs += len(ExtractTransactions(block))
+		for height := range Blockchain {
+			txs += len(ExtractTransactions(BlockAt(height)))
 		}
 		if txs-initialtxs >= tpsIn*secs {
 			duration := time.Since(start)
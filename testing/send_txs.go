@@ -9,7 +9,7 @@ import (
 func SendTxs(rate int64, seconds int64) {
 	delay := time.Second / time.Duration(rate)
 	for i := int64(0); i < seconds*rate; i++ {
-		Send("YWJj", "0", []byte(fmt.Sprint(i)))
+		Send("YWJj", "0", []byte(fmt.Sprint(i)), 0, 0)
 		time.Sleep(delay)
 	}
 }
@@ -0,0 +1,83 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionIndex(t *testing.T) {
+	alice := PublicKey{Y: []byte("alice")}
+	bob := PublicKey{Y: []byte("bob")}
+	payment := Transaction{
+		Sender:    alice,
+		Recipient: bob,
+		Amount:    5,
+		Timestamp: time.Unix(0, 1000),
+	}
+	t.Run("It finds a transaction by its hash", func(t *testing.T) {
+		// Arrange
+		Blockchain = nil
+		Append(GenesisBlock())
+		// Act
+		Append(Block{Nonce: 1, LegacyTransactions: []Transaction{{Sender: bob, Recipient: bob}, payment}})
+		// Assert
+		transaction, location, ok := GetTransaction(TransactionHash(payment))
+		assert.True(t, ok)
+		assert.Equal(t, 1, location.BlockHeight)
+		assert.Equal(t, 1, location.Position)
+		assert.Equal(t, payment.Amount, transaction.Amount)
+	})
+	t.Run("It lists the transactions sent and received by an address", func(t *testing.T) {
+		// Arrange
+		Blockchain = nil
+		Append(GenesisBlock())
+		// Act
+		Append(Block{Nonce: 1, LegacyTransactions: []Transaction{payment}})
+		// Assert
+		sent := GetHistory(alice.Y)
+		received := GetHistory(bob.Y)
+		assert.Equal(t, 1, len(sent))
+		assert.True(t, sent[0].Sent)
+		assert.Equal(t, 1, len(received))
+		assert.True(t, received[0].Received)
+	})
+	t.Run("It forgets transactions from truncated blocks", func(t *testing.T) {
+		// Arrange
+		Blockchain = nil
+		Append(GenesisBlock())
+		Append(Block{Nonce: 1, LegacyTransactions: []Transaction{payment}})
+		// Act
+		TruncateBlockchain(1)
+		// Assert
+		_, _, ok := GetTransaction(TransactionHash(payment))
+		assert.False(t, ok)
+		assert.Equal(t, 0, len(GetHistory(bob.Y)))
+	})
+	t.Run("It rebuilds the index when blocks are truncated deeper than it can roll back", func(t *testing.T) {
+		// Arrange
+		Blockchain = nil
+		Append(GenesisBlock())
+		Append(Block{Nonce: 1, LegacyTransactions: []Transaction{payment}})
+		for height := 2; height < LedgerUndoDepth+10; height++ {
+			Append(Block{Nonce: int64(height)})
+		}
+		// Act
+		TruncateBlockchain(2)
+		// Assert
+		_, location, ok := GetTransaction(TransactionHash(payment))
+		assert.True(t, ok)
+		assert.Equal(t, 1, location.BlockHeight)
+		assert.Equal(t, 1, len(GetHistory(bob.Y)))
+	})
+}
@@ -0,0 +1,82 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpgrades(t *testing.T) {
+	defer LoadEnv()
+	t.Run("It activates an upgrade at its height", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Env.Upgrades[Kyoto] = 5
+		// Act
+		before := IsActive(Kyoto, 4)
+		at := IsActive(Kyoto, 5)
+		// Assert
+		assert.False(t, before)
+		assert.True(t, at)
+		assert.Equal(t, UpgradePending, UpgradeStatus(Kyoto, 4))
+		assert.Equal(t, UpgradeActive, UpgradeStatus(Kyoto, 5))
+	})
+	t.Run("It treats a height of -1 as disabled", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		Env.Upgrades[Zen] = -1
+		// Act
+		active := IsActive(Zen, 1000)
+		// Assert
+		assert.False(t, active)
+		assert.Equal(t, UpgradeDisabled, UpgradeStatus(Zen, 1000))
+	})
+	t.Run("It treats a missing upgrade as disabled", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		delete(Env.Upgrades, Jinan)
+		// Act
+		_, ok := ActivationHeight(Jinan)
+		// Assert
+		assert.False(t, ok)
+		assert.False(t, IsActive(Jinan, 1000))
+		assert.Equal(t, -1, UpgradeHeights(Env.Upgrades)["jinan"])
+	})
+	t.Run("It loads a height for every registered upgrade", func(t *testing.T) {
+		// Arrange
+		LoadEnv()
+		// Act
+		heights := UpgradeHeights(Env.Upgrades)
+		// Assert
+		assert.Len(t, heights, len(UpgradeRegistry))
+		for _, upgrade := range UpgradeRegistry {
+			assert.Contains(t, Env.Upgrades, upgrade.Name)
+		}
+	})
+	t.Run("It refuses to load unknown upgrades", func(t *testing.T) {
+		// Arrange
+		wd, err := os.Getwd()
+		assert.Nil(t, err)
+		assert.Nil(t, os.Chdir(t.TempDir()))
+		defer func() {
+			_ = os.Chdir(wd)
+		}()
+		assert.Nil(t, os.WriteFile("env.json", []byte(`{"network": "testnet", "upgrades": {"osaka": 10}}`), 0600))
+		// Act
+		load := func() {
+			LoadEnv()
+		}
+		// Assert
+		assert.Panics(t, load)
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2024, Asher Wrobel
+/*
+This program is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "cryptocurrency/node_util"
+	"github.com/stretchr/testify/assert"
+)
+
+// reasonCodesOf returns the reason codes of validation errors.
+func reasonCodesOf(errs []*ValidationError) []ReasonCode {
+	var codes []ReasonCode
+	for _, err := range errs {
+		codes = append(codes, err.Code)
+	}
+	return codes
+}
+
+// rejectionCodes decodes the reason codes of a RejectionResponse.
+func rejectionCodes(t *testing.T, recorder *httptest.ResponseRecorder) []ReasonCode {
+	var response RejectionResponse
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	return reasonCodesOf(response.Errors)
+}
+
+func TestValidationErrors(t *testing.T) {
+	t.Run("It gives sentinel errors a reason code", func(t *testing.T) {
+		// Arrange
+		err := fmt.Errorf("adding block: %w", ErrUnknownParent)
+		// Act
+		validationErr := AsValidationError(err)
+		// Assert
+		assert.Equal(t, ReasonUnknownParent, validationErr.Code)
+		assert.Equal(t, http.StatusConflict, validationErr.Code.HTTPStatus())
+		assert.True(t, errors.Is(validationErr, ErrUnknownParent))
+	})
+	t.Run("It keeps the reason code of a wrapped validation error", func(t *testing.T) {
+		// Arrange
+		err := fmt.Errorf("block 3 of the new branch is invalid: %w", NewValidationError(ReasonInvalidZKProof, "invalid ZK proof"))
+		// Act
+		validationErr := AsValidationError(err)
+		// Assert
+		assert.Equal(t, ReasonInvalidZKProof, validationErr.Code)
+		assert.Equal(t, http.StatusUnprocessableEntity, validationErr.Code.HTTPStatus())
+	})
+	t.Run("It counts each reason once per rejection", func(t *testing.T) {
+		// Arrange
+		counter := NewRejectionCounter()
+		// Act
+		counter.Record(NewValidationError(ReasonBadSignature, "a"), NewValidationError(ReasonBadSignature, "b"))
+		counter.Record(NewValidationError(ReasonBadSignature, "c"), NewValidationError(ReasonDoubleSpend, "d"))
+		// Assert
+		assert.Equal(t, map[ReasonCode]uint64{ReasonBadSignature: 2, ReasonDoubleSpend: 1}, counter.Counts())
+	})
+	t.Run("It reports every problem with a block", func(t *testing.T) {
+		// Arrange
+		testChain(t, 2)
+		block := Blockchain[2]
+		block.Difficulty += 1000
+		TruncateBlockchain(2)
+		// Act
+		problems := BlockProblems(block, 2)
+		// Assert
+		assert.Contains(t, reasonCodesOf(problems), ReasonBadProofOfWork)
+		assert.Contains(t, reasonCodesOf(problems), ReasonBadDifficulty)
+	})
+	t.Run("It answers an invalid block with its reasons", func(t *testing.T) {
+		// Arrange
+		testChain(t, 2)
+		block := Blockchain[2]
+		block.Difficulty += 1000
+		TruncateBlockchain(2)
+		blockBytes, err := json.Marshal(block)
+		assert.Nil(t, err)
+		before := Rejections.Counts()[ReasonBadProofOfWork]
+		recorder := httptest.NewRecorder()
+		// Act
+		HandleBlockRequest(recorder, httptest.NewRequest(http.MethodGet, "/block", strings.NewReader(string(blockBytes))))
+		// Assert
+		assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+		assert.Contains(t, rejectionCodes(t, recorder), ReasonBadProofOfWork)
+		assert.Equal(t, before+1, Rejections.Counts()[ReasonBadProofOfWork])
+		assert.Equal(t, 2, len(Blockchain))
+	})
+	t.Run("It answers a malformed block with 400", func(t *testing.T) {
+		// Arrange
+		recorder := httptest.NewRecorder()
+		// Act
+		HandleBlockRequest(recorder, httptest.NewRequest(http.MethodGet, "/block", strings.NewReader("{")))
+		// Assert
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Equal(t, []ReasonCode{ReasonMalformed}, rejectionCodes(t, recorder))
+	})
+	t.Run("It answers a malformed mine request with 400", func(t *testing.T) {
+		// Arrange
+		recorder := httptest.NewRecorder()
+		// Act
+		HandleMineRequest(recorder, httptest.NewRequest(http.MethodGet, "/mine", strings.NewReader("[1 2]$[3 4]$abc")))
+		// Assert
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Equal(t, []ReasonCode{ReasonMalformed}, rejectionCodes(t, recorder))
+	})
+	t.Run("It rejects a transaction with a bad signature", func(t *testing.T) {
+		// Arrange
+		testChain(t, 1)
+		transaction := testSignedTransaction(t)
+		transaction.Amount += 1
+		// Act
+		err := Pool.Accept(transaction)
+		// Assert
+		assert.Equal(t, ReasonBadSignature, AsValidationError(err).Code)
+		assert.True(t, errors.Is(err, ErrInvalidTransaction))
+	})
+}
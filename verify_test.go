@@ -34,7 +34,7 @@ func TestVerifyTransaction(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		result := VerifyTransaction(key.PublicKey, key.PublicKey, amount, timestamp, sig)
+		result := VerifyTransaction(Transaction{Sender: key.PublicKey, Recipient: key.PublicKey, Amount: 0, Timestamp: timestamp, SenderSignature: Signature{S: sig}})
 		assert.True(t, result)
 	})
 	t.Run("It should return false if the transaction double spends", func(t *testing.T) {
@@ -49,20 +49,19 @@ func TestVerifyTransaction(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		result := VerifyTransaction(key.PublicKey, key.PublicKey, amount, time.Now(), sig)
+		result := VerifyTransaction(Transaction{Sender: key.PublicKey, Recipient: key.PublicKey, Amount: 1, Timestamp: time.Now(), SenderSignature: Signature{S: sig}})
 		assert.False(t, result)
 	})
 	t.Run("It should return false if the transaction signature is invalid", func(t *testing.T) {
 		key := GetKey("")
 		Blockchain = nil
 		Append(GenesisBlock())
-		amount := "1"
 		message := []byte{1, 2, 3, 4}
 		sig, err := key.X.Sign(message)
 		if err != nil {
 			panic(err)
 		}
-		result := VerifyTransaction(key.PublicKey, key.PublicKey, amount, time.Now(), sig)
+		result := VerifyTransaction(Transaction{Sender: key.PublicKey, Recipient: key.PublicKey, Amount: 1, Timestamp: time.Now(), SenderSignature: Signature{S: sig}})
 		assert.False(t, result)
 	})
 }
@@ -81,12 +80,14 @@ func TestVerifyMiner(t *testing.T) {
 		miner.Y = []byte("123")
 		Blockchain = nil
 		LoadEnv()
+		defer LoadEnv()
+		Env.Upgrades[Jinan] = -1 // Jinan removes the miner limit
 		Append(GenesisBlock())
 		Append(Block{
-			Transactions:      []Transaction{},
-			Miner:             miner,
-			PreviousBlockHash: HashBlock(GenesisBlock(), 0),
-			Difficulty:        1,
+			LegacyTransactions: []Transaction{},
+			Miner:              miner,
+			PreviousBlockHash:  HashBlock(GenesisBlock(), 0),
+			Difficulty:         1,
 		})
 		result := VerifyMiner(key.PublicKey)
 		assert.False(t, result)
@@ -108,17 +109,16 @@ func TestVerifyBlock(t *testing.T) {
 			panic(err)
 		}
 
-		MiningTransactions = []Transaction{
-			{
-				Sender:    sender,
-				Recipient: receiver,
-				Amount:    amount,
-				SenderSignature: Signature{
-					S: sig,
-				},
-				Timestamp: timestamp,
+		Pool = NewMempool()
+		_ = Pool.Add(NewMempoolEntry(Transaction{
+			Sender:    sender,
+			Recipient: receiver,
+			Amount:    amount,
+			SenderSignature: Signature{
+				S: sig,
 			},
-		}
+			Timestamp: timestamp,
+		}, nil, StateTransition{}))
 		block, err := CreateBlock()
 		if err != nil {
 			panic(err)
@@ -139,7 +139,7 @@ func TestVerifyBlock(t *testing.T) {
 			panic(err)
 		}
 		block := Block{
-			Transactions: []Transaction{
+			LegacyTransactions: []Transaction{
 				{
 					Sender:          sender,
 					Recipient:       receiver,